@@ -21,6 +21,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
 	"text/tabwriter"
@@ -29,8 +30,11 @@ import (
 	"github.com/coreos/rkt/pkg/multicall"
 	"github.com/spf13/cobra"
 
+	"github.com/containers/build/engine"
+	_ "github.com/containers/build/engine/stub"
 	"github.com/containers/build/lib"
 	"github.com/containers/build/lib/appc"
+	"github.com/containers/build/util"
 )
 
 const (
@@ -77,6 +81,12 @@ var (
 	aciToModify    string
 	ociToModify    string
 	disableHistory bool
+	compression    string
+	compressLevel  int
+	maxLayerSize   string
+	// historyArgs, if set by a command, replaces its arguments in the history
+	// with a command line for each element.
+	historyArgs [][]string
 
 	cmdExitCode int
 
@@ -106,6 +116,10 @@ func init() {
 	cmdAcbuild.PersistentFlags().StringVar(&aciToModify, "modify-appc", "", "Path to an ACI to modify (ignores build context)")
 	cmdAcbuild.PersistentFlags().StringVar(&ociToModify, "modify-oci", "", "Path to an OCI image to modify (ignores build context)")
 	cmdAcbuild.PersistentFlags().BoolVar(&disableHistory, "no-history", false, "Don't add annotations with the command that was run")
+	cmdAcbuild.PersistentFlags().BoolVar(&noCache, "no-cache", false, "Always perform run and copy steps, instead of using results from the build cache")
+	cmdAcbuild.PersistentFlags().StringVar(&compression, "compression", string(util.CompressionGzip), "Compression for written ACIs and OCI layers: gzip, zstd, xz or none")
+	cmdAcbuild.PersistentFlags().IntVar(&compressLevel, "compression-level", util.DefaultCompressionLevel, "Level of the compression, -1 for its default")
+	cmdAcbuild.PersistentFlags().StringVar(&maxLayerSize, "max-layer-size", fmt.Sprintf("%dM", lib.DefaultMaxLayerSize>>20), "Size of the compressed top OCI layer above which run and copy start a new one, 0 for never")
 
 	cobra.EnablePrefixMatching = true
 }
@@ -115,22 +129,60 @@ func newACBuild() (*lib.ACBuild, error) {
 	if err != nil {
 		return nil, err
 	}
-	return lib.NewACBuild(contextpath, debug, bmode)
+	return newACBuildWithBuildMode(bmode)
 }
 
 func newACBuildWithBuildMode(bmode lib.BuildMode) (*lib.ACBuild, error) {
-	return lib.NewACBuild(contextpath, debug, bmode)
+	a, err := lib.NewACBuild(contextpath, debug, bmode)
+	if err != nil {
+		return nil, err
+	}
+	a.CacheDir = cacheDir()
+	a.CacheReport = reportCache
+	if cmdAcbuild.PersistentFlags().Changed("max-layer-size") {
+		a.MaxLayerSize, err = parseByteSize(maxLayerSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --max-layer-size: %v", err)
+		}
+	} else if size := os.Getenv(maxLayerSizeEnvVar); size != "" {
+		a.MaxLayerSize, err = parseByteSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", maxLayerSizeEnvVar, err)
+		}
+	}
+	a.Compression, err = util.ParseCompression(compression)
+	if err != nil {
+		return nil, err
+	}
+	err = a.Compression.CheckLevel(compressLevel)
+	if err != nil {
+		return nil, err
+	}
+	a.CompressionLevel = compressLevel
+	return a, nil
 }
 
 func getErrorCode(err error) int {
+	if batchErr, ok := err.(*lib.RunBatchError); ok {
+		err = batchErr.Err
+	}
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	if exitErr, ok := err.(*engine.ExitError); ok {
+		return exitErr.Code
+	}
 	switch err {
 	case appc.ErrNotFound:
 		return 2
 	case errCobra:
 		return 3
+	case lib.ErrRunPidsLimit:
+		return 122
+	case lib.ErrRunMemoryLimit:
+		return 123
+	case lib.ErrRunTimeout:
+		return 124
 	case nil:
 		return 0
 	default:
@@ -150,7 +202,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 				return
 			}
 			if cmdExitCode == 0 && !disableHistory {
-				err := addACBuildAnnotation(cmd, args)
+				err := addHistory(cmd, args)
 				if err != nil {
 					stderr("%v", err)
 					cmdExitCode = 1
@@ -228,7 +280,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 			return
 		}
 
-		err = a.Begin(absoluteToModify, false, modifyMode)
+		err = a.Begin(absoluteToModify, false, modifyMode, lib.BeginOptions{})
 		if err != nil {
 			stderr("%v", err)
 			cmdExitCode = getErrorCode(err)
@@ -248,7 +300,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		cmdExitCode = cf(cmd, args)
 
 		if cmdExitCode == 0 && !disableHistory {
-			err := addACBuildAnnotation(cmd, args)
+			err := addHistory(cmd, args)
 			if err != nil {
 				stderr("%v", err)
 				cmdExitCode = 1
@@ -259,7 +311,7 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		dir, file := path.Split(aciToModify)
 		tmpFile := path.Join(dir, "."+file+".tmp")
 
-		_, err = a.Write(tmpFile, true)
+		_, err = a.Write(tmpFile, true, lib.WriteFormatDefault)
 		if err != nil {
 			stderr("%v", err)
 			cmdExitCode = getErrorCode(err)
@@ -288,6 +340,8 @@ func main() {
 	// check if acbuild is executed with a multicall command
 	multicall.MaybeExec()
 
+	maybeReexecRootless()
+
 	cmdAcbuild.SetUsageFunc(func(cmd *cobra.Command) error {
 		tabOut := new(tabwriter.Writer)
 		tabOut.Init(os.Stdout, 0, 8, 1, '\t', 0)
@@ -306,6 +360,41 @@ func main() {
 	os.Exit(cmdExitCode)
 }
 
+// secretValues holds the contents of any secrets passed to this invocation,
+// which must never be recorded anywhere.
+var secretValues []string
+
+const redacted = "<redacted>"
+
+// minSecretLength is the length below which secret values aren't redacted, as
+// they would turn up all over unrelated output.
+const minSecretLength = 4
+
+// addSecretValue marks the value of the secret with the given ID for redaction
+// by redactSecrets. The value is also added with surrounding whitespace
+// removed, as secrets are often read from files with a trailing newline.
+// Values shorter than minSecretLength are left out, with a warning.
+func addSecretValue(id, v string) {
+	if len(strings.TrimSpace(v)) < minSecretLength {
+		stderr("warning: secret %q is shorter than %d characters, so it won't be redacted from the history and debug output", id, minSecretLength)
+		return
+	}
+	secretValues = append(secretValues, v, strings.TrimSpace(v))
+	// Replace longer values first, so that a secret containing another one
+	// is still fully redacted.
+	sort.Slice(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+}
+
+// redactSecrets replaces all occurrences of secret values in s.
+func redactSecrets(s string) string {
+	for _, v := range secretValues {
+		s = strings.Replace(s, v, redacted, -1)
+	}
+	return s
+}
+
 func stderr(format string, a ...interface{}) {
 	out := fmt.Sprintf(format, a...)
 	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
@@ -316,6 +405,21 @@ func stdout(format string, a ...interface{}) {
 	fmt.Fprintln(os.Stdout, strings.TrimSuffix(out, "\n"))
 }
 
+// addHistory records the command that was run in the image's annotations, or
+// each of historyArgs if the command set it.
+func addHistory(cmd *cobra.Command, args []string) error {
+	if historyArgs == nil {
+		return addACBuildAnnotation(cmd, args)
+	}
+	for _, a := range historyArgs {
+		err := addACBuildAnnotation(cmd, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func addACBuildAnnotation(cmd *cobra.Command, args []string) error {
 	const annoNamePattern = "coreos.com/acbuild/command-%d"
 
@@ -349,7 +453,7 @@ func addACBuildAnnotation(cmd *cobra.Command, args []string) error {
 	}
 
 	for _, a := range args {
-		command += fmt.Sprintf(" %q", a)
+		command += fmt.Sprintf(" %q", redactSecrets(a))
 	}
 
 	return acb.AddAnnotation(fmt.Sprintf(annoNamePattern, acbuildCount+1), command)
@@ -21,8 +21,10 @@ import (
 )
 
 var (
-	mode     string
-	cmdBegin = &cobra.Command{
+	mode          string
+	beginRef      string
+	beginPlatform string
+	cmdBegin      = &cobra.Command{
 		Use:     "begin [START_ACI]",
 		Short:   "Start a new build, with either a new and empty image or an existing image",
 		Example: "acbuild begin",
@@ -34,6 +36,8 @@ func init() {
 	cmdAcbuild.AddCommand(cmdBegin)
 	cmdBegin.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over an unencrypted connection")
 	cmdBegin.Flags().StringVar(&mode, "build-mode", "appc", "Which build mode to operate in. Accepts: appc, oci")
+	cmdBegin.Flags().StringVar(&beginRef, "ref", "", "Ref name or docker tag of the image to begin from, if there are several")
+	cmdBegin.Flags().StringVar(&beginPlatform, "platform", "", "Platform of the image to begin from, as os/arch or os/arch/variant, if there are several")
 }
 
 func runBegin(cmd *cobra.Command, args []string) (exit int) {
@@ -62,9 +66,9 @@ func runBegin(cmd *cobra.Command, args []string) (exit int) {
 		return 1
 	}
 	if len(args) == 0 {
-		err = a.Begin("", insecure, bmode)
+		err = a.Begin("", insecure, bmode, lib.BeginOptions{})
 	} else {
-		err = a.Begin(args[0], insecure, bmode)
+		err = a.Begin(args[0], insecure, bmode, lib.BeginOptions{Ref: beginRef, Platform: beginPlatform})
 	}
 
 	if err != nil {
@@ -0,0 +1,80 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// cacheDirEnvVar overrides where the build cache is kept.
+	cacheDirEnvVar = "ACBUILD_CACHE_DIR"
+	// noCacheEnvVar turns the build cache off when set to anything, like
+	// --no-cache.
+	noCacheEnvVar = "ACBUILD_NO_CACHE"
+	// cacheReportEnvVar names a file that a line is appended to for every
+	// step that could have been cached, saying whether it was. acbuild script
+	// uses this to count hits and misses.
+	cacheReportEnvVar = "ACBUILD_CACHE_REPORT"
+
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+)
+
+var noCache bool
+
+// cacheDir returns the directory the build cache is kept in, or "" if the
+// cache is turned off or there's nowhere to keep it.
+func cacheDir() string {
+	if noCache || os.Getenv(noCacheEnvVar) != "" {
+		return ""
+	}
+	if dir := os.Getenv(cacheDirEnvVar); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "acbuild")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".cache", "acbuild")
+	}
+	return ""
+}
+
+// reportCache tells the user, and any script that's running us, whether the
+// result of a step came from the build cache.
+func reportCache(hit bool) {
+	result := cacheMiss
+	if hit {
+		result = cacheHit
+	}
+	if debug {
+		if hit {
+			stderr("Using cached result")
+		} else {
+			stderr("Result not in cache")
+		}
+	}
+	if report := os.Getenv(cacheReportEnvVar); report != "" {
+		f, err := os.OpenFile(report, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(f, result)
+		f.Close()
+	}
+}
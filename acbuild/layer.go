@@ -18,6 +18,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// maxLayerSizeEnvVar sets the size of the top layer above which run and copy
+// start a new one, with a K, M, G or T suffix like run --memory, when the
+// --max-layer-size flag isn't given. 0 turns this off.
+const maxLayerSizeEnvVar = "ACBUILD_MAX_LAYER_SIZE"
+
 var (
 	cmdLayer = &cobra.Command{
 		Use:     "layer",
@@ -0,0 +1,139 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdPathWhitelist = &cobra.Command{
+		Use:   "path-whitelist [command]",
+		Short: "Manage the paths used from dependencies (appc only)",
+	}
+	cmdAddPathWhitelist = &cobra.Command{
+		Use:     "add PATH...",
+		Short:   "Add paths to the path whitelist (appc only)",
+		Example: "acbuild path-whitelist add /etc/ssl /usr/bin/curl",
+		Run:     runWrapper(runAddPathWhitelist),
+	}
+	cmdRmPathWhitelist = &cobra.Command{
+		Use:     "remove PATH",
+		Aliases: []string{"rm"},
+		Short:   "Remove a path from the path whitelist (appc only)",
+		Example: "acbuild path-whitelist remove /usr/bin/curl",
+		Run:     runWrapper(runRmPathWhitelist),
+	}
+	cmdClearPathWhitelist = &cobra.Command{
+		Use:     "clear",
+		Short:   "Clear the path whitelist, so that all paths are used (appc only)",
+		Example: "acbuild path-whitelist clear",
+		Run:     runWrapper(runClearPathWhitelist),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdPathWhitelist)
+	cmdPathWhitelist.AddCommand(cmdAddPathWhitelist)
+	cmdPathWhitelist.AddCommand(cmdRmPathWhitelist)
+	cmdPathWhitelist.AddCommand(cmdClearPathWhitelist)
+}
+
+func runAddPathWhitelist(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	for _, p := range args {
+		if !path.IsAbs(p) {
+			stderr("path-whitelist add: path %q is not absolute", p)
+			return 1
+		}
+	}
+
+	if debug {
+		stderr("Adding %q to the path whitelist", args)
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	err = a.AddPathWhitelist(args...)
+
+	if err != nil {
+		stderr("path-whitelist add: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+func runRmPathWhitelist(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("path-whitelist remove: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Removing %q from the path whitelist", args[0])
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	err = a.RemovePathWhitelist(args[0])
+
+	if err != nil {
+		stderr("path-whitelist remove: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+func runClearPathWhitelist(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("path-whitelist clear: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Clearing the path whitelist")
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	err = a.ClearPathWhitelist()
+
+	if err != nil {
+		stderr("path-whitelist clear: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
+	"github.com/containers/build/registry/docker"
+)
+
+var (
+	pushCredentials string
+	pushChunkSize   int64
+	pushMountFrom   string
+	cmdPush         = &cobra.Command{
+		Use:     "push IMAGE",
+		Short:   "Push the image from the current build to a registry",
+		Example: "acbuild push --credentials ~/.docker/config.json example.com/myapp:v1.0.0",
+		Run:     runWrapper(runPush),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdPush)
+
+	cmdPush.Flags().BoolVar(&insecure, "insecure", false, "Allows pushing over plain HTTP or to registries with unverifiable certificates")
+	cmdPush.Flags().StringVar(&pushCredentials, "credentials", "", "File with the credentials for the registry, in the format of docker's config.json")
+	cmdPush.Flags().Int64Var(&pushChunkSize, "chunk-size", docker.DefaultChunkSize, "Size in bytes of the chunks larger blobs are uploaded in")
+	cmdPush.Flags().StringVar(&pushMountFrom, "mount-from", "", "Repository on the same registry to mount blobs from rather than upload them, if it has them")
+}
+
+func runPush(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("push: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Pushing image to %s", args[0])
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	dgst, err := a.Push(args[0], lib.PushOptions{
+		Insecure:        insecure,
+		CredentialsFile: pushCredentials,
+		ChunkSize:       pushChunkSize,
+		MountFrom:       pushMountFrom,
+	})
+
+	if err != nil {
+		stderr("push: %v", err)
+		return getErrorCode(err)
+	}
+	stdout("%s", dgst)
+	return 0
+}
@@ -0,0 +1,200 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"syscall"
+
+	"github.com/containers/build/util"
+)
+
+const (
+	// rootlessEnvVar tracks the progress of re-executing acbuild inside of a
+	// user namespace.
+	rootlessEnvVar = "ACBUILD_ROOTLESS"
+	// rootlessPending means acbuild has been started in a new user namespace,
+	// but should wait for its parent to set up the ID mappings.
+	rootlessPending = "pending"
+	// rootlessActive means acbuild is running as root in the user namespace.
+	rootlessActive = "active"
+
+	// rootlessSyncFd is the pipe the parent signals on once the ID mappings
+	// are in place.
+	rootlessSyncFd = 3
+)
+
+// maybeReexecRootless re-executes acbuild inside of a new user and mount
+// namespace when it's been called by an unprivileged user who has subordinate
+// ID ranges assigned in /etc/subuid and /etc/subgid. The user is mapped to
+// root inside the namespace and the subordinate ranges to IDs 1 and up, which
+// lets acbuild preserve file ownership and mount overlayfs without any real
+// privileges. If the user namespace can't be set up this returns, and acbuild
+// continues unprivileged.
+//
+// Commands that never touch the build context, like version, aren't
+// re-executed.
+//
+// maybeReexecRootless doesn't return if acbuild was re-executed.
+func maybeReexecRootless() {
+	switch os.Getenv(rootlessEnvVar) {
+	case rootlessPending:
+		finishRootlessReexec()
+	case rootlessActive:
+		return
+	}
+	if os.Geteuid() == 0 || !needsRootless(os.Args[1:]) {
+		return
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return
+	}
+	uids, err := util.SubordinateIDs("/etc/subuid", u.Username, os.Getuid())
+	if err != nil {
+		return
+	}
+	gids, err := util.SubordinateIDs("/etc/subgid", u.Username, os.Getuid())
+	if err != nil {
+		return
+	}
+	newuidmap, err := exec.LookPath("newuidmap")
+	if err != nil {
+		return
+	}
+	newgidmap, err := exec.LookPath("newgidmap")
+	if err != nil {
+		return
+	}
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		stderr("rootless: %v", err)
+		os.Exit(1)
+	}
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       os.Args,
+		Env:        append(os.Environ(), rootlessEnvVar+"="+rootlessPending),
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{syncReader},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+			Pdeathsig:  syscall.SIGKILL,
+		},
+	}
+	err = cmd.Start()
+	syncReader.Close()
+	if err != nil {
+		stderr("rootless: %v", err)
+		os.Exit(1)
+	}
+
+	err = util.WriteIDMap(newuidmap, cmd.Process.Pid, os.Getuid(), uids)
+	if err == nil {
+		err = util.WriteIDMap(newgidmap, cmd.Process.Pid, os.Getgid(), gids)
+	}
+	if err != nil {
+		// Closing the pipe without writing to it tells the child to give up.
+		syncWriter.Close()
+		cmd.Wait()
+		stderr("rootless: %v", err)
+		os.Exit(1)
+	}
+	syncWriter.Write([]byte{1})
+	syncWriter.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(status.ExitStatus())
+	}
+	if err != nil {
+		stderr("rootless: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// noRootlessCommands are the commands that never touch the build context, so
+// there's no need for a user namespace to run them in.
+var noRootlessCommands = map[string]bool{
+	"version":       true,
+	"cat-manifest":  true,
+	"gen-man-pages": true,
+}
+
+// needsRootless returns whether the command named by args might touch the
+// build context. Asking for help, or for a command that doesn't exist, doesn't.
+func needsRootless(args []string) bool {
+	cmd, flags, err := cmdAcbuild.Find(args)
+	if err != nil || cmd == cmdAcbuild || noRootlessCommands[cmd.Name()] {
+		return false
+	}
+	for _, f := range flags {
+		if f == "--" {
+			break
+		}
+		if f == "-h" || f == "--help" {
+			return false
+		}
+	}
+	return true
+}
+
+// finishRootlessReexec waits for the parent to set up the ID mappings of the
+// user namespace, and then executes acbuild again. Capabilities are dropped
+// when executing as an unmapped user, so the second exec is needed to pick up
+// a full set inside of the namespace now that we're root in it.
+func finishRootlessReexec() {
+	syncFile := os.NewFile(rootlessSyncFd, "rootless-sync")
+	buf := make([]byte, 1)
+	n, _ := syncFile.Read(buf)
+	syncFile.Close()
+	if n != 1 {
+		// The parent has already reported what went wrong.
+		os.Exit(1)
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if e != rootlessEnvVar+"="+rootlessPending {
+			env = append(env, e)
+		}
+	}
+	env = append(env, rootlessEnvVar+"="+rootlessActive)
+
+	err := syscall.Exec("/proc/self/exe", os.Args, env)
+	stderr("rootless: %v", err)
+	os.Exit(1)
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNeedsRootless(t *testing.T) {
+	cases := []struct {
+		args  []string
+		needs bool
+	}{
+		{[]string{"begin"}, true},
+		{[]string{"--debug", "run", "--", "ls", "--help"}, true},
+		{[]string{"label", "add", "a", "b"}, true},
+		{[]string{"vers"}, false},
+		{[]string{"cat-manifest", "--file=config"}, false},
+		{[]string{"run", "--help"}, false},
+		{[]string{"help"}, false},
+		{[]string{"no-such-command"}, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if needs := needsRootless(c.args); needs != c.needs {
+			t.Errorf("%v: expected %v, got %v", c.args, c.needs, needs)
+		}
+	}
+}
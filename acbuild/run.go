@@ -15,30 +15,60 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containers/build/engine"
 	"github.com/containers/build/engine/chroot"
+	"github.com/containers/build/engine/external"
+	"github.com/containers/build/engine/namespace"
+	"github.com/containers/build/engine/ociruntime"
 	"github.com/containers/build/engine/systemdnspawn"
+	"github.com/containers/build/lib"
 
 	"github.com/spf13/cobra"
 )
 
+// overlayEnvVar sets the overlay driver run and shell use when no --overlay
+// flag is given.
+const overlayEnvVar = "ACBUILD_OVERLAY"
+
 var (
 	insecure   = false
 	workingdir = ""
 	engineName = ""
+	runMounts  runMountList
+	runSecrets runSecretList
+	hostFiles  = hostFilePolicies{}
+	network    = ""
+	memory     = ""
+	cpus       float64
+	pidsLimit  int64
+	timeout    time.Duration
+	runUser    = ""
+	runGroup   = ""
+	ociRuntime = ""
+	runSteps   = ""
+	overlay    = ""
 	cmdRun     = &cobra.Command{
-		Use:     "run -- CMD [ARGS]",
+		Use:     "run [--script FILE | -- CMD [ARGS]]",
 		Short:   "Run a command in the image, saving changes made",
-		Example: "acbuild run -- yum install nginx",
+		Example: "acbuild run --mount type=cache,id=yum,dst=/var/cache/yum -- yum install nginx",
 		Run:     runWrapper(runRun),
 	}
 
 	engines = map[string]engine.Engine{
 		"systemd-nspawn": systemdnspawn.Engine{},
 		"chroot":         chroot.Engine{},
+		"namespace":      namespace.Engine{},
+		"oci-runtime":    ociruntime.Engine{},
 	}
 )
 
@@ -49,40 +79,337 @@ func init() {
 	for engine, _ := range engines {
 		engineNames = append(engineNames, engine)
 	}
+	sort.Strings(engineNames)
 	engineList := fmt.Sprintf("[%s]", strings.Join(engineNames, ","))
 
 	cmdRun.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
 	cmdRun.Flags().StringVar(&workingdir, "working-dir", "", "The working directory inside the container for this command")
-	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command. Supported engines: "+engineList)
+	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command: one of "+engineList+", or NAME for an acbuild-engine-NAME binary in $PATH")
+	cmdRun.Flags().Var(&runMounts, "mount", "Mount for the duration of the command: type=bind,src=PATH,dst=PATH[,ro] or type=cache,id=ID,dst=PATH[,ro]")
+	cmdRun.Flags().StringVar(&network, "network", "", "The network the command is run with: host or none (default host, or as set by the running script)")
+	cmdRun.Flags().StringVar(&memory, "memory", "", "Memory limit for the command, in bytes or with a K, M, G or T suffix")
+	cmdRun.Flags().Float64Var(&cpus, "cpus", 0, "Number of CPUs the command can use")
+	cmdRun.Flags().Int64Var(&pidsLimit, "pids-limit", 0, "Maximum number of processes and threads the command can use")
+	cmdRun.Flags().DurationVar(&timeout, "timeout", 0, "Kill the command if it runs longer than this, such as 30m")
+	cmdRun.Flags().StringVar(&ociRuntime, "oci-runtime", "", "The OCI runtime binary used by the oci-runtime engine (default $"+ociruntime.RuntimeEnvVar+" or "+ociruntime.DefaultRuntime+")")
+	cmdRun.Flags().StringVar(&runUser, "user", "", "The user to run the command as, by name or ID (default root)")
+	cmdRun.Flags().StringVar(&runGroup, "group", "", "The group to run the command as, by name or ID (default the user's primary group)")
+	cmdRun.Flags().Var(hostFiles, "host-file", "What to do with a file from the host: NAME=inject, NAME=persist or NAME=skip, where NAME is one of ["+strings.Join(lib.HostFileNames(), ",")+"] (default inject)")
+	cmdRun.Flags().StringVar(&runSteps, "script", "", "Run the commands in FILE, one per line, together in one session, saving their changes once at the end")
+	cmdRun.Flags().StringVar(&overlay, "overlay", "", "How the image's layers are combined: auto, kernel, fuse-overlayfs or copy (default $"+overlayEnvVar+" or auto)")
+	cmdRun.Flags().Var(&runSecrets, "secret", "Make a file available as "+lib.SecretsDir+"/ID for the duration of the command: id=ID,src=PATH")
+}
+
+// lookupEngine returns the engine with the given name. Built in engines take
+// precedence over external ones with the same name, so $PATH is only searched
+// for the others.
+func lookupEngine(name string) (engine.Engine, bool) {
+	if e, ok := engines[name]; ok {
+		return e, true
+	}
+	e, ok := external.Lookup(name)
+	if !ok {
+		return nil, false
+	}
+	return e, true
 }
 
 func runRun(cmd *cobra.Command, args []string) (exit int) {
-	if len(args) == 0 {
+	cmds := [][]string{args}
+	switch {
+	case runSteps != "" && len(args) > 0:
+		stderr("run: can't give both a command and --script")
+		return 1
+	case runSteps != "":
+		var err error
+		cmds, err = readRunSteps(runSteps)
+		if err != nil {
+			stderr("run: %v", err)
+			return 1
+		}
+		// Each command is recorded as if it had been run on its own
+		historyArgs = cmds
+	case len(args) == 0:
 		cmd.Usage()
 		return 1
 	}
 
 	if debug {
-		stderr("Running: %v", args)
+		for _, c := range cmds {
+			stderr("Running: %v", redactSecrets(fmt.Sprint(c)))
+		}
 	}
 
-	engine, ok := engines[engineName]
+	engine, ok := lookupEngine(engineName)
 	if !ok {
 		stderr("run: no such engine %q", engineName)
 		return 1
 	}
+	if e, ok := engine.(ociruntime.Engine); ok && ociRuntime != "" {
+		e.Runtime = ociRuntime
+		engine = e
+	}
+
+	memoryLimit, err := parseByteSize(memory)
+	if err != nil {
+		stderr("run: invalid memory limit: %v", err)
+		return 1
+	}
+
+	if network == "" {
+		network = os.Getenv(runNetworkEnvVar)
+	}
+	if overlay == "" {
+		overlay = os.Getenv(overlayEnvVar)
+	}
 
 	a, err := newACBuild()
 	if err != nil {
 		stderr("%v", err)
 		return 1
 	}
-	err = a.Run(args, workingdir, insecure, engine)
+	err = a.RunBatch(context.Background(), cmds, workingdir, insecure, engine, lib.RunOptions{
+		Mounts:    runMounts,
+		Secrets:   runSecrets,
+		Network:   lib.NetworkMode(network),
+		Overlay:   lib.OverlayDriver(overlay),
+		HostFiles: hostFiles,
+		User:      runUser,
+		Group:     runGroup,
+		Limits: lib.RunLimits{
+			Memory:  memoryLimit,
+			CPUs:    cpus,
+			Pids:    pidsLimit,
+			Timeout: timeout,
+		},
+	})
 
 	if err != nil {
+		if batchErr, ok := err.(*lib.RunBatchError); ok {
+			reportRunFailed(batchErr.Index)
+		}
 		stderr("run: %v", err)
 		return getErrorCode(err)
 	}
 
 	return 0
 }
+
+// reportRunFailed tells any script that's running us which of the commands it
+// gave to run --script failed.
+func reportRunFailed(i int) {
+	if report := os.Getenv(runFailedEnvVar); report != "" {
+		ioutil.WriteFile(report, []byte(strconv.Itoa(i)+"\n"), 0644)
+	}
+}
+
+// readRunSteps reads the commands in the file for run --script. Each line is a
+// command, split into arguments as in a script, and lines ending in a backslash
+// are continued on the next one.
+func readRunSteps(file string) ([][]string, error) {
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(blob), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	var cmds [][]string
+	for _, line := range joinLines(lines) {
+		tokens, err := tokenizeLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(tokens) > 0 {
+			cmds = append(cmds, tokens)
+		}
+	}
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("%s: no commands to run", file)
+	}
+	return cmds, nil
+}
+
+// parseByteSize parses a number of bytes with an optional binary unit suffix.
+// The empty string is 0.
+func parseByteSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	str := strings.TrimSuffix(strings.ToUpper(s), "B")
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(str, unit) {
+			str = strings.TrimSuffix(str, unit)
+			multiplier = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size", s)
+	}
+	return n * multiplier, nil
+}
+
+type runMountList []lib.RunMount
+
+func (ms *runMountList) String() string {
+	strMounts := make([]string, len(*ms))
+	for i, m := range *ms {
+		var source string
+		switch m.Type {
+		case lib.RunMountBind:
+			source = "src=" + m.Source
+		case lib.RunMountCache:
+			source = "id=" + m.ID
+		}
+		strMounts[i] = fmt.Sprintf("type=%s,%s,dst=%s", m.Type, source, m.Destination)
+		if m.ReadOnly {
+			strMounts[i] += ",ro"
+		}
+	}
+	return strings.Join(strMounts, " ")
+}
+
+func (ms *runMountList) Set(input string) error {
+	var m lib.RunMount
+	for _, opt := range strings.Split(input, ",") {
+		parts := strings.SplitN(opt, "=", 2)
+		key := parts[0]
+		var value string
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch key {
+		case "type":
+			m.Type = lib.RunMountType(value)
+		case "src", "source":
+			m.Source = value
+		case "id":
+			m.ID = value
+		case "dst", "destination", "target":
+			m.Destination = value
+		case "ro", "readonly":
+			switch value {
+			case "", "true":
+				m.ReadOnly = true
+			case "false":
+				m.ReadOnly = false
+			default:
+				return fmt.Errorf("invalid value for %s: %q", key, value)
+			}
+		default:
+			return fmt.Errorf("unknown mount option %q", key)
+		}
+	}
+	switch m.Type {
+	case lib.RunMountBind:
+		if m.Source == "" {
+			return fmt.Errorf("bind mounts need a src")
+		}
+	case lib.RunMountCache:
+		if m.ID == "" {
+			m.ID = strings.Trim(strings.Replace(m.Destination, "/", "-", -1), "-")
+		}
+	case "":
+		return fmt.Errorf("no type in %q", input)
+	default:
+		return fmt.Errorf("unknown mount type %q", m.Type)
+	}
+	if m.Destination == "" {
+		return fmt.Errorf("no dst in %q", input)
+	}
+	*ms = append(*ms, m)
+	return nil
+}
+
+func (ms *runMountList) Type() string {
+	return "Mounts"
+}
+
+type runSecretList []lib.RunSecret
+
+func (ss *runSecretList) String() string {
+	strSecrets := make([]string, len(*ss))
+	for i, s := range *ss {
+		strSecrets[i] = fmt.Sprintf("id=%s,src=%s", s.ID, s.Source)
+	}
+	return strings.Join(strSecrets, " ")
+}
+
+func (ss *runSecretList) Set(input string) error {
+	var s lib.RunSecret
+	for _, opt := range strings.Split(input, ",") {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid secret option %q", opt)
+		}
+		switch parts[0] {
+		case "id":
+			s.ID = parts[1]
+		case "src", "source":
+			s.Source = parts[1]
+		default:
+			return fmt.Errorf("unknown secret option %q", parts[0])
+		}
+	}
+	if s.Source == "" {
+		return fmt.Errorf("no src in %q", input)
+	}
+	if s.ID == "" {
+		s.ID = path.Base(s.Source)
+	}
+
+	// Remember the value so that it can be kept out of the history
+	// annotations and debug output.
+	blob, err := ioutil.ReadFile(s.Source)
+	if err != nil {
+		return err
+	}
+	addSecretValue(s.ID, string(blob))
+
+	*ss = append(*ss, s)
+	return nil
+}
+
+func (ss *runSecretList) Type() string {
+	return "Secrets"
+}
+
+type hostFilePolicies map[string]lib.HostFilePolicy
+
+func (hs hostFilePolicies) String() string {
+	var strPolicies []string
+	for _, name := range lib.HostFileNames() {
+		if policy, ok := hs[name]; ok {
+			strPolicies = append(strPolicies, name+"="+string(policy))
+		}
+	}
+	return strings.Join(strPolicies, ",")
+}
+
+func (hs hostFilePolicies) Set(input string) error {
+	for _, opt := range strings.Split(input, ",") {
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid host file policy %q", opt)
+		}
+		if _, ok := lib.HostFiles[parts[0]]; !ok {
+			return fmt.Errorf("unknown host file %q", parts[0])
+		}
+		policy := lib.HostFilePolicy(parts[1])
+		switch policy {
+		case lib.HostFileInject, lib.HostFilePersist, lib.HostFileSkip:
+		default:
+			return fmt.Errorf("unknown host file policy %q", parts[1])
+		}
+		hs[parts[0]] = policy
+	}
+	return nil
+}
+
+func (hs hostFilePolicies) Type() string {
+	return "HostFiles"
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	type testcase struct {
+		input  string
+		output int64
+		err    bool
+	}
+	cases := []testcase{
+		testcase{"", 0, false},
+		testcase{"4096", 4096, false},
+		testcase{"512k", 512 << 10, false},
+		testcase{"512M", 512 << 20, false},
+		testcase{"2GB", 2 << 30, false},
+		testcase{"1T", 1 << 40, false},
+		testcase{"1.5G", 0, true},
+		testcase{"-1", 0, true},
+		testcase{"lots", 0, true},
+	}
+	for _, c := range cases {
+		output, err := parseByteSize(c.input)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %d", c.input, output)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.input, err)
+		} else if output != c.output {
+			t.Errorf("%q: expected:%d actual:%d", c.input, c.output, output)
+		}
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	defer func(values []string) { secretValues = values }(secretValues)
+	secretValues = nil
+
+	addSecretValue("short", "1\n")
+	addSecretValue("token", "hunter2\n")
+	addSecretValue("long", "hunter2hunter2")
+	cases := []struct {
+		input  string
+		output string
+	}{
+		{"echo 1 hunter2", "echo 1 <redacted>"},
+		{"echo hunter2hunter2", "echo <redacted>"},
+		{"cat hunter2\n", "cat <redacted>"},
+	}
+	for _, c := range cases {
+		output := redactSecrets(c.input)
+		if output != c.output {
+			t.Errorf("redacting %q, expected:%q actual:%q", c.input, c.output, output)
+		}
+	}
+}
@@ -20,19 +20,34 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
 	"strings"
 
+	"github.com/containers/build/engine"
+	"github.com/containers/build/lib"
+
 	"github.com/spf13/cobra"
 )
 
 const (
 	nestedScriptEnvVar = "ACBUILD_NESTED_SCRIPT"
+	// runNetworkEnvVar passes the script's default network mode on to the
+	// run commands in it.
+	runNetworkEnvVar = "ACBUILD_RUN_NETWORK"
+	// runFailedEnvVar names a file that run --script writes the number of
+	// the command that failed to, counting from 0, so that a script knows
+	// which of the lines it ran together failed.
+	runFailedEnvVar = "ACBUILD_RUN_FAILED"
 )
 
 var (
 	errSingleQuote = fmt.Errorf("unterminated single quote block")
 	errDoubleQuote = fmt.Errorf("unterminated double quote block")
 	errEscape      = fmt.Errorf("ended with an escape")
+	scriptNetwork  = ""
+	debugOnFailure = false
+	batchRuns      = false
 	cmdScript      = &cobra.Command{
 		Use:     "script SCRIPT_FILE",
 		Short:   "Runs an acbuild script",
@@ -43,6 +58,10 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdScript)
+
+	cmdScript.Flags().StringVar(&scriptNetwork, "network", "", "The default network for run commands in the script: host or none")
+	cmdScript.Flags().BoolVar(&debugOnFailure, "debug-on-failure", false, "Start a shell in the image when a line of the script fails, before cleaning up")
+	cmdScript.Flags().BoolVar(&batchRuns, "batch-runs", false, "Run consecutive run lines with the same flags together, as a single step")
 }
 
 func runScript(cmd *cobra.Command, args []string) (exit int) {
@@ -77,7 +96,7 @@ func execScript(rawScript []byte) error {
 		script[i] = s
 
 		if strings.HasPrefix(strings.ToLower(s), "run") && os.Geteuid() != 0 {
-			return fmt.Errorf("scripts using the run subcommand must be run as root")
+			return fmt.Errorf("scripts using the run subcommand must be run as root, or by a user with a subordinate ID range in /etc/subuid and /etc/subgid")
 		}
 
 		if strings.HasPrefix(strings.ToLower(s), "end") {
@@ -85,6 +104,11 @@ func execScript(rawScript []byte) error {
 		}
 	}
 	script = joinLines(script)
+	for _, s := range script {
+		if _, _, err := networkDirective(s); err != nil {
+			return err
+		}
+	}
 
 	var tmpDir string
 	nestedScript := false
@@ -99,18 +123,43 @@ func execScript(rawScript []byte) error {
 		}
 		defer os.RemoveAll(tmpDir)
 		contextpath = tmpDir
+
+		// The lines of the script are run by separate acbuild processes,
+		// which record whether the cache was used in here.
+		cacheReport := path.Join(tmpDir, "cache-report")
+		os.Setenv(cacheReportEnvVar, cacheReport)
+		defer reportCacheUse(cacheReport)
+	}
+	if noCache {
+		os.Setenv(noCacheEnvVar, "1")
 	}
 
-	a, err := newACBuild()
+	// The build mode isn't known until the script's begin line has run, and
+	// isn't needed to end the build.
+	a, err := newACBuildWithBuildMode("")
 	if err != nil {
 		return err
 	}
-	for _, line := range script {
-		if line == "" {
+	runFailed := path.Join(tmpDir, "run-failed")
+	os.Setenv(runFailedEnvVar, runFailed)
+	for _, batch := range batchRunLines(script, batchRuns) {
+		line := batch[0]
+		if network, ok, _ := networkDirective(line); ok {
+			scriptNetwork = network
 			continue
 		}
-		err := execACBuild(tmpDir, line)
+		if len(batch) > 1 {
+			line, err = writeRunBatch(tmpDir, batch)
+			if err != nil {
+				return err
+			}
+		}
+		os.Remove(runFailed)
+		err = execACBuild(tmpDir, line)
 		if err != nil {
+			if debugOnFailure {
+				debugFailedLine(tmpDir, failedLine(batch, runFailed))
+			}
 			if !strings.HasPrefix(line, "begin") && !nestedScript {
 				err1 := a.End()
 				if err1 != nil {
@@ -152,12 +201,209 @@ func execACBuild(workPath, line string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
+	if scriptNetwork != "" {
+		cmd.Env = append(cmd.Env, runNetworkEnvVar+"="+scriptNetwork)
+	}
+	// A --max-layer-size given to the script applies to each of its lines,
+	// unless a line gives its own
+	if cmdAcbuild.PersistentFlags().Changed("max-layer-size") {
+		cmd.Env = append(cmd.Env, maxLayerSizeEnvVar+"="+maxLayerSize)
+	}
 	if suppliedArgs[0] == "script" {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", nestedScriptEnvVar, workPath))
 	}
 	return cmd.Run()
 }
 
+// networkDirective returns the network mode set by line, if it's a network
+// directive. The directive sets the default network for the run lines after
+// it, like script --network, and isn't run as an acbuild command.
+func networkDirective(line string) (string, bool, error) {
+	tokens, err := tokenizeLine(line)
+	if err != nil || len(tokens) == 0 || strings.ToLower(tokens[0]) != "network" {
+		return "", false, nil
+	}
+	if len(tokens) != 2 {
+		return "", true, fmt.Errorf("network takes a single network mode: %s", line)
+	}
+	switch lib.NetworkMode(tokens[1]) {
+	case lib.NetworkHost, lib.NetworkNone:
+		return tokens[1], true, nil
+	}
+	return "", true, fmt.Errorf("unknown network mode %q, expected host or none", tokens[1])
+}
+
+// batchRunLines groups the lines of a script so that, if batch is set,
+// consecutive run lines with the same flags can be run together with run
+// --script, which saves setting up and saving the image for every one of them.
+// Empty lines are dropped, and other lines are in groups of their own.
+func batchRunLines(script []string, batch bool) [][]string {
+	var batches [][]string
+	lastFlags, lastIsRun := "", false
+	for _, line := range script {
+		if line == "" {
+			continue
+		}
+		flags, isRun := runLineFlags(line)
+		if batch && isRun && lastIsRun && flags == lastFlags {
+			batches[len(batches)-1] = append(batches[len(batches)-1], line)
+			continue
+		}
+		lastFlags, lastIsRun = flags, isRun
+		batches = append(batches, []string{line})
+	}
+	return batches
+}
+
+// runLineFlags returns the flags of a script line running a single command,
+// or false if line isn't one.
+func runLineFlags(line string) (string, bool) {
+	tokens, err := tokenizeLine(line)
+	if err != nil || len(tokens) == 0 || strings.ToLower(tokens[0]) != "run" {
+		return "", false
+	}
+	tokens = insertRunTacks(tokens)
+	for i, tok := range tokens[1:] {
+		if strings.HasPrefix(tok, "--script") {
+			return "", false
+		}
+		if tok == "--" {
+			if i+2 == len(tokens) {
+				return "", false
+			}
+			return strings.Join(tokens[1:i+1], "\x00"), true
+		}
+	}
+	return "", false
+}
+
+// writeRunBatch writes the commands of a batch of run lines with the same
+// flags to a file in workPath, and returns a run line that runs them all.
+func writeRunBatch(workPath string, batch []string) (string, error) {
+	f, err := ioutil.TempFile(workPath, "run-steps")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var flags []string
+	for _, line := range batch {
+		tokens, err := tokenizeLine(line)
+		if err != nil {
+			return "", err
+		}
+		tokens = insertRunTacks(tokens)
+		for i, tok := range tokens {
+			if tok == "--" {
+				flags = tokens[1:i]
+				_, err = fmt.Fprintln(f, quoteTokens(tokens[i+1:]))
+				break
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("run %s --script=%s", quoteTokens(flags), quoteTokens([]string{f.Name()})), nil
+}
+
+// quoteTokens joins tokens into a line that tokenizeLine splits back into them.
+func quoteTokens(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, tok := range tokens {
+		tok = strings.Replace(tok, `\`, `\\`, -1)
+		tok = strings.Replace(tok, `"`, `\"`, -1)
+		quoted[i] = `"` + tok + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// reportCacheUse prints how many of the steps in the script had their results
+// taken from the build cache, according to the report file the steps wrote.
+func reportCacheUse(report string) {
+	blob, err := ioutil.ReadFile(report)
+	if err != nil {
+		return
+	}
+	var hits, misses int
+	for _, line := range strings.Split(string(blob), "\n") {
+		switch line {
+		case cacheHit:
+			hits++
+		case cacheMiss:
+			misses++
+		}
+	}
+	stderr("Build cache: %d hits, %d misses", hits, misses)
+}
+
+// failedLine returns the line of batch that failed, which is the first one
+// unless the batch was run together and runFailed says which one it was.
+func failedLine(batch []string, runFailed string) string {
+	blob, err := ioutil.ReadFile(runFailed)
+	if err != nil {
+		return batch[0]
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(string(blob)))
+	if err != nil || i < 0 || i >= len(batch) {
+		return batch[0]
+	}
+	return batch[i]
+}
+
+// debugFailedLine starts a shell in the image after line failed, using the
+// same engine as line if it was a run command. Nested scripts start their own
+// shell at the line that failed in them.
+func debugFailedLine(workPath, line string) {
+	tokens, err := tokenizeLine(line)
+	if err != nil || len(tokens) == 0 {
+		return
+	}
+	switch strings.ToLower(tokens[0]) {
+	case "begin", "script":
+		return
+	}
+
+	args := []string{"--work-path=" + workPath, "shell"}
+	if strings.ToLower(tokens[0]) == "run" {
+		if name := engineFromRunArgs(tokens[1:]); name != "" {
+			args = append(args, "--engine="+name)
+		}
+	}
+
+	stderr("script: %q failed, starting a shell to debug it. The build is cleaned up once it exits.", line)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if scriptNetwork != "" {
+		cmd.Env = append(cmd.Env, runNetworkEnvVar+"="+scriptNetwork)
+	}
+	// Ctrl-C in the shell shouldn't end the script before it has cleaned up
+	engine.IgnoreKeyboardSignals()
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		stderr("script: shell: %v", err)
+	}
+}
+
+// engineFromRunArgs returns the value of the --engine flag in the arguments to
+// a run command, or "" if it isn't set.
+func engineFromRunArgs(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return ""
+		case strings.HasPrefix(arg, "--engine="):
+			return strings.TrimPrefix(arg, "--engine=")
+		case arg == "--engine" && i+1 < len(args):
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
 func joinLines(script []string) []string {
 	for i, line := range script {
 		if strings.HasSuffix(line, `\`) && i != len(script)-1 {
@@ -15,6 +15,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 )
 
@@ -286,6 +289,137 @@ func TestInsertRunTacks(t *testing.T) {
 	}
 }
 
+func TestEngineFromRunArgs(t *testing.T) {
+	cases := []struct {
+		args   []string
+		engine string
+	}{
+		{[]string{"--", "make"}, ""},
+		{[]string{"--engine=chroot", "--", "make"}, "chroot"},
+		{[]string{"--user", "bob", "--engine", "namespace", "--", "make"}, "namespace"},
+		{[]string{"--", "make", "--engine=chroot"}, ""},
+	}
+	for _, c := range cases {
+		engine := engineFromRunArgs(c.args)
+		if engine != c.engine {
+			t.Errorf("engine for %v, expected:%q actual:%q", c.args, c.engine, engine)
+		}
+	}
+}
+
+func TestNetworkDirective(t *testing.T) {
+	cases := []struct {
+		line    string
+		network string
+		ok      bool
+		err     bool
+	}{
+		{"network none", "none", true, false},
+		{"NETWORK host # for apk", "host", true, false},
+		{"network", "", true, true},
+		{"network bridge", "", true, true},
+		{"network none host", "", true, true},
+		{"run --network=none -- make", "", false, false},
+		{"set-name network", "", false, false},
+	}
+	for _, c := range cases {
+		network, ok, err := networkDirective(c.line)
+		if network != c.network || ok != c.ok || (err != nil) != c.err {
+			t.Errorf("%q: expected %q, %v, error %v, got %q, %v, %v", c.line, c.network, c.ok, c.err, network, ok, err)
+		}
+	}
+}
+
+func TestBatchRunLines(t *testing.T) {
+	script := []string{
+		"begin",
+		"run --engine=chroot -- make",
+		"",
+		"run --engine=chroot make install",
+		"run -- ls",
+		"run -- ls -l",
+		"set-name example.com/test",
+		"run -- true",
+		"run --script=steps",
+		"run --script=steps",
+	}
+	expected := [][]string{
+		{"begin"},
+		{"run --engine=chroot -- make", "run --engine=chroot make install"},
+		{"run -- ls", "run -- ls -l"},
+		{"set-name example.com/test"},
+		{"run -- true"},
+		{"run --script=steps"},
+		{"run --script=steps"},
+	}
+	batches := batchRunLines(script, true)
+	if len(batches) != len(expected) {
+		t.Fatalf("expected %d batches, got %d: %q", len(expected), len(batches), batches)
+	}
+	for i := range batches {
+		if !equal(batches[i], expected[i]) {
+			t.Errorf("batch %d, expected:%q actual:%q", i, expected[i], batches[i])
+		}
+	}
+
+	// Without batching, every line is run on its own
+	batches = batchRunLines(script, false)
+	if len(batches) != len(script)-1 {
+		t.Fatalf("expected %d batches, got %d: %q", len(script)-1, len(batches), batches)
+	}
+	for _, batch := range batches {
+		if len(batch) != 1 {
+			t.Errorf("expected a batch of 1 line, got %q", batch)
+		}
+	}
+}
+
+func TestFailedLine(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "acbuild-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	runFailed := path.Join(tmpDir, "run-failed")
+	batch := []string{"run -- true", "run -- false", "run -- ls"}
+
+	cases := []struct {
+		report string
+		line   string
+	}{
+		{"", batch[0]},
+		{"1\n", batch[1]},
+		{"2\n", batch[2]},
+		{"3\n", batch[0]},
+		{"garbage", batch[0]},
+	}
+	for _, c := range cases {
+		os.Remove(runFailed)
+		if c.report != "" {
+			err := ioutil.WriteFile(runFailed, []byte(c.report), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		line := failedLine(batch, runFailed)
+		if line != c.line {
+			t.Errorf("failed line for report %q, expected:%q actual:%q", c.report, c.line, line)
+		}
+	}
+}
+
+func TestQuoteTokens(t *testing.T) {
+	tokens := []string{"echo", "a b", `"quoted"`, `back\slash`, "#hash", "it's"}
+	line := quoteTokens(tokens)
+	result, err := tokenizeLine(line)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !equal(result, tokens) {
+		t.Errorf("expected:%q actual:%q", tokens, result)
+	}
+}
+
 // no really guys, this language is _great_
 func equal(s1 []string, s2 []string) bool {
 	if len(s1) != len(s2) {
@@ -0,0 +1,108 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/lib"
+	"github.com/containers/build/util"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultShell is run by the shell subcommand when no command is given.
+const defaultShell = "/bin/sh"
+
+var (
+	shellEngineName = ""
+	shellKeep       = false
+	shellWorkingDir = ""
+	shellUser       = ""
+	shellGroup      = ""
+	shellOverlay    = ""
+	cmdShell        = &cobra.Command{
+		Use:     "shell [-- CMD [ARGS]]",
+		Short:   "Start an interactive shell in the image",
+		Example: "acbuild shell --engine=namespace",
+		Run:     runWrapper(runShell),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdShell)
+
+	cmdShell.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
+	cmdShell.Flags().StringVar(&shellEngineName, "engine", "systemd-nspawn", "The engine used to run the shell, as for run")
+	cmdShell.Flags().BoolVar(&shellKeep, "keep", false, "Save the changes made in the shell to the image, instead of discarding them")
+	cmdShell.Flags().StringVar(&shellWorkingDir, "working-dir", "", "The working directory inside the container for the shell")
+	cmdShell.Flags().StringVar(&shellUser, "user", "", "The user to run the shell as, by name or ID (default root)")
+	cmdShell.Flags().StringVar(&shellGroup, "group", "", "The group to run the shell as, by name or ID (default the user's primary group)")
+	cmdShell.Flags().StringVar(&shellOverlay, "overlay", "", "How the image's layers are combined, as for run")
+}
+
+func runShell(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		args = []string{defaultShell}
+	}
+	if !shellKeep {
+		// Nothing happened to the image worth recording
+		disableHistory = true
+	}
+
+	if debug {
+		stderr("Starting shell: %v", args)
+	}
+
+	runEngine, ok := lookupEngine(shellEngineName)
+	if !ok {
+		stderr("shell: no such engine %q", shellEngineName)
+		return 1
+	}
+
+	if shellOverlay == "" {
+		shellOverlay = os.Getenv(overlayEnvVar)
+	}
+
+	a, err := newACBuild()
+	if err != nil {
+		stderr("%v", err)
+		return 1
+	}
+	// What's done in a shell isn't known up front, so its result can't be
+	// taken from the build cache, even when its stdin isn't a terminal
+	a.CacheDir = ""
+
+	// Ctrl-C is meant for the shell, and shouldn't stop acbuild from cleaning
+	// up after it.
+	engine.IgnoreKeyboardSignals()
+
+	err = a.Run(context.Background(), args, shellWorkingDir, insecure, runEngine, lib.RunOptions{
+		Network:  lib.NetworkMode(os.Getenv(runNetworkEnvVar)),
+		Overlay:  lib.OverlayDriver(shellOverlay),
+		User:     shellUser,
+		Group:    shellGroup,
+		Discard:  !shellKeep,
+		Terminal: util.IsTerminal(os.Stdin),
+	})
+	if err != nil {
+		stderr("shell: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
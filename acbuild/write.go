@@ -16,12 +16,15 @@ package main
 
 import (
 	"github.com/spf13/cobra"
+
+	"github.com/containers/build/lib"
 )
 
 var (
-	overwrite = false
-	sign      = false
-	cmdWrite  = &cobra.Command{
+	overwrite   = false
+	sign        = false
+	writeFormat = ""
+	cmdWrite    = &cobra.Command{
 		Use:     "write ACI_PATH",
 		Short:   "Write the image from the current build to a file",
 		Example: "acbuild write --sign mynewapp.aci -- --no-default-keyring --keyring ./rkt.gpg",
@@ -34,6 +37,7 @@ func init() {
 
 	cmdWrite.Flags().BoolVar(&overwrite, "overwrite", false, "overwrite the resulting ACI")
 	cmdWrite.Flags().BoolVar(&sign, "sign", false, "(removed) sign the resulting ACI")
+	cmdWrite.Flags().StringVar(&writeFormat, "format", "", "Format to write oci images in. Accepts: oci-dir, oci-archive, docker-archive (default: a gzipped tar of the image layout)")
 }
 
 func runWrite(cmd *cobra.Command, args []string) (exit int) {
@@ -56,7 +60,7 @@ func runWrite(cmd *cobra.Command, args []string) (exit int) {
 		stderr("%v", err)
 		return 1
 	}
-	id, err := a.Write(args[0], overwrite)
+	id, err := a.Write(args[0], overwrite, lib.WriteFormat(writeFormat))
 
 	if err != nil {
 		stderr("write: %v", err)
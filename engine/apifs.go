@@ -0,0 +1,181 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containers/build/util"
+)
+
+// apiDirs are the mountpoints of the API filesystems inside of a container.
+var apiDirs = []string{"proc", "dev", "sys"}
+
+// devices are bind mounted from the host into the container's /dev.
+var devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// CreateAPIMountpoints creates the mountpoints for /proc, /dev and /sys in
+// root if they don't exist yet. The returned function removes the ones that
+// were created, so that they aren't left behind in the image.
+func CreateAPIMountpoints(root string) (remove func(), err error) {
+	var created []string
+	remove = func() {
+		for _, dir := range created {
+			os.Remove(dir)
+		}
+	}
+	for _, dir := range apiDirs {
+		mountpoint := filepath.Join(root, dir)
+		_, err := os.Lstat(mountpoint)
+		switch {
+		case os.IsNotExist(err):
+			err := os.Mkdir(mountpoint, 0755)
+			if err != nil {
+				remove()
+				return nil, err
+			}
+			created = append(created, mountpoint)
+		case err != nil:
+			remove()
+			return nil, err
+		}
+	}
+	return remove, nil
+}
+
+// MountAPIFilesystems mounts /proc, a minimal /dev and a read-only /sys in
+// root. The mountpoints must already exist.
+func MountAPIFilesystems(root string) error {
+	err := mountProc(root)
+	if err != nil {
+		return err
+	}
+	err = mountDev(root)
+	if err != nil {
+		return err
+	}
+	return mountSys(root)
+}
+
+// UnmountAPIFilesystems unmounts everything MountAPIFilesystems mounted in
+// root.
+func UnmountAPIFilesystems(root string) error {
+	var firstErr error
+	for _, dir := range apiDirs {
+		err := syscall.Unmount(filepath.Join(root, dir), syscall.MNT_DETACH)
+		if err != nil && err != syscall.EINVAL && firstErr == nil {
+			firstErr = fmt.Errorf("couldn't unmount /%s: %v", dir, err)
+		}
+	}
+	return firstErr
+}
+
+func mountProc(root string) error {
+	proc := filepath.Join(root, "proc")
+	err := syscall.Mount("proc", proc, "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err == nil {
+		return nil
+	}
+
+	// A fresh procfs can only be mounted by the owner of the PID namespace,
+	// so without a PID namespace of our own, as in a user namespace set up by
+	// a rootless build, we fall back to the host's. That shows the command
+	// every process on the host, so it's read-only and the user is told.
+	fmt.Fprintf(os.Stderr, "warning: couldn't mount a new /proc (%v), mounting the host's read-only instead, which shows the command every process on the host\n", err)
+	err = util.BindMountReadOnly("/proc", proc)
+	if err != nil {
+		return fmt.Errorf("couldn't mount /proc: %v", err)
+	}
+	return nil
+}
+
+func mountDev(root string) error {
+	dev := filepath.Join(root, "dev")
+	err := syscall.Mount("tmpfs", dev, "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k")
+	if err != nil {
+		return fmt.Errorf("couldn't mount /dev: %v", err)
+	}
+
+	for _, d := range devices {
+		target := filepath.Join(dev, d)
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0666)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		err = syscall.Mount(filepath.Join("/dev", d), target, "", syscall.MS_BIND, "")
+		if err != nil {
+			return fmt.Errorf("couldn't bind mount /dev/%s: %v", d, err)
+		}
+	}
+
+	err = os.Mkdir(filepath.Join(dev, "pts"), 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("devpts", filepath.Join(dev, "pts"), "devpts",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620")
+	if err != nil {
+		return fmt.Errorf("couldn't mount /dev/pts: %v", err)
+	}
+
+	err = os.Mkdir(filepath.Join(dev, "shm"), 01777)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("shm", filepath.Join(dev, "shm"), "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=1777,size=65536k")
+	if err != nil {
+		return fmt.Errorf("couldn't mount /dev/shm: %v", err)
+	}
+
+	links := [][2]string{
+		{"pts/ptmx", "ptmx"},
+		{"/proc/self/fd", "fd"},
+		{"/proc/self/fd/0", "stdin"},
+		{"/proc/self/fd/1", "stdout"},
+		{"/proc/self/fd/2", "stderr"},
+	}
+	for _, l := range links {
+		err := os.Symlink(l[0], filepath.Join(dev, l[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mountSys(root string) error {
+	sys := filepath.Join(root, "sys")
+	err := syscall.Mount("sysfs", sys, "sysfs",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC|syscall.MS_RDONLY, "")
+	if err == nil {
+		return nil
+	}
+
+	// Mounting a fresh sysfs isn't always permitted, in which case we fall
+	// back to a read-only view of the host's, submounts like /sys/fs/cgroup
+	// included.
+	err = util.BindMountReadOnly("/sys", sys)
+	if err != nil {
+		return fmt.Errorf("couldn't mount /sys: %v", err)
+	}
+	return nil
+}
@@ -15,75 +15,123 @@
 package chroot
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
-	"strings"
 	"syscall"
 
-	"github.com/spf13/cobra"
+	"github.com/containers/build/engine"
 )
 
-func init() {
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagCmd, "cmd", "", "The command to run")
-	cmdACBuildChroot.PersistentFlags().StringSliceVar(&flagArgs, "args", nil, "arguments for the command")
-	cmdACBuildChroot.PersistentFlags().StringSliceVar(&flagEnv, "env", nil, "environment for the command")
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagChroot, "chroot", "", "dir to chroot into")
-	cmdACBuildChroot.PersistentFlags().StringVar(&flagWorkingDir, "working-dir", "", "working directory for the command")
-}
+// runChild sets up the API filesystems in the chroot described by the
+// childSpec passed in on specFd, chroots into it and runs the command, exiting
+// with the command's exit code. The API filesystems are unmounted again before
+// exiting.
+func runChild() error {
+	runtime.LockOSThread()
 
-var (
-	flagCmd          string
-	flagArgs         []string
-	flagEnv          []string
-	flagChroot       string
-	flagWorkingDir   string
-	cmdACBuildChroot = &cobra.Command{
-		Use: "",
-		Run: runChroot,
+	var spec childSpec
+	specFile := os.NewFile(specFd, "spec")
+	err := json.NewDecoder(specFile).Decode(&spec)
+	specFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't read spec: %v", err)
+	}
+	if spec.Terminal {
+		engine.IgnoreKeyboardSignals()
 	}
-)
 
-func stderr(format string, a ...interface{}) {
-	out := fmt.Sprintf(format, a...)
-	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
+	code, err := runInChroot(spec)
+	if err != nil {
+		return err
+	}
+	os.Exit(code)
+	return nil
 }
 
-func errAndExit(format string, a ...interface{}) {
-	stderr(format, a...)
-	os.Exit(1)
-}
+// runInChroot runs the command in spec and returns its exit code.
+func runInChroot(spec childSpec) (code int, err error) {
+	err = engine.MountAPIFilesystems(spec.Chroot)
+	defer func() {
+		err1 := engine.UnmountAPIFilesystems(spec.Chroot)
+		if err == nil {
+			err = err1
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
 
-func runChroot(cmd *cobra.Command, args []string) {
-	runtime.LockOSThread()
-	err := syscall.Chroot(flagChroot)
+	// Hold on to the host's root, so that we can get back to it to unmount
+	// everything once the command is done.
+	hostRoot, err := os.Open("/")
+	if err != nil {
+		return 0, err
+	}
+	defer hostRoot.Close()
+
+	err = syscall.Chroot(spec.Chroot)
 	if err != nil {
-		errAndExit("couldn't chroot: %v", err)
+		return 0, fmt.Errorf("couldn't chroot: %v", err)
 	}
+	defer func() {
+		err1 := leaveChroot(hostRoot)
+		if err == nil {
+			err = err1
+		}
+	}()
 	err = os.Chdir("/")
 	if err != nil {
-		errAndExit("couldn't cd: %v", err)
+		return 0, fmt.Errorf("couldn't cd: %v", err)
 	}
 
-	if flagWorkingDir != "" {
-		err = os.Chdir(flagWorkingDir)
+	if spec.WorkingDir != "" {
+		err = os.Chdir(spec.WorkingDir)
 		if err != nil {
-			errAndExit("couldn't cd: %v", err)
+			return 0, fmt.Errorf("couldn't cd: %v", err)
 		}
 	}
 
-	execCmd := exec.Command(flagCmd, flagArgs...)
-	execCmd.Env = flagEnv
+	execCmd := exec.Command(spec.Command, spec.Args...)
+	execCmd.Env = spec.Env
 	execCmd.Stdin = os.Stdin
 	execCmd.Stdout = os.Stdout
 	execCmd.Stderr = os.Stderr
-	err = execCmd.Run()
+	execCmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    spec.UID,
+			Gid:    spec.GID,
+			Groups: spec.Groups,
+		},
+		// Don't leave the command running if we're killed
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if spec.Cgroup {
+		syscall.CloseOnExec(cgroupFd)
+		execCmd.SysProcAttr.UseCgroupFD = true
+		execCmd.SysProcAttr.CgroupFD = cgroupFd
+	}
+	err = engine.ToExitError(execCmd.Run())
+	if exitErr, ok := err.(*engine.ExitError); ok {
+		return exitErr.Code, nil
+	}
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
-			os.Exit(code)
-		}
-		errAndExit("%v", err)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// leaveChroot changes the root directory back to hostRoot.
+func leaveChroot(hostRoot *os.File) error {
+	err := hostRoot.Chdir()
+	if err != nil {
+		return err
+	}
+	err = syscall.Chroot(".")
+	if err != nil {
+		return fmt.Errorf("couldn't leave chroot: %v", err)
 	}
+	return os.Chdir("/")
 }
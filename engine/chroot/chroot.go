@@ -15,74 +15,118 @@
 package chroot
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/containers/build/engine"
-	"github.com/coreos/rkt/pkg/fileutil"
 	"github.com/coreos/rkt/pkg/multicall"
 )
 
 type Engine struct{}
 
+// childSpec is handed from Engine.Run to the acbuild-chroot helper over an
+// inherited file descriptor.
+type childSpec struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Env        []string `json:"env"`
+	Chroot     string   `json:"chroot"`
+	WorkingDir string   `json:"workingDir"`
+	UID        uint32   `json:"uid"`
+	GID        uint32   `json:"gid"`
+	Groups     []uint32 `json:"groups"`
+	Terminal   bool     `json:"terminal"`
+	// Cgroup is whether the command is to be started in the cgroup that's
+	// open on cgroupFd.
+	Cgroup bool `json:"cgroup"`
+}
+
+// specFd is the file descriptor the child reads its childSpec from. It is the
+// first entry in exec.Cmd.ExtraFiles.
+const specFd = 3
+
+// cgroupFd is the file descriptor of the cgroup the child starts the command
+// in, if childSpec.Cgroup is set. It is the second entry in
+// exec.Cmd.ExtraFiles.
+const cgroupFd = 4
+
+var entrypoint multicall.Entrypoint
+
 func init() {
-	multicall.Add("acbuild-chroot", cmdACBuildChroot.Execute)
+	entrypoint = multicall.Add("acbuild-chroot", runChild)
 }
 
-func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string) error {
-	resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
-	_, err := os.Stat(resolvConfFile)
-	switch {
-	case os.IsNotExist(err):
-		err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
-		if err != nil {
-			return err
-		}
-		err = fileutil.CopyRegularFile("/etc/resolv.conf", resolvConfFile)
-		if err != nil {
-			return err
-		}
-		defer os.RemoveAll(resolvConfFile)
-	case err != nil:
+func (e Engine) Run(ctx context.Context, opts engine.Options) error {
+	chroot, err := filepath.Abs(opts.Chroot)
+	if err != nil {
 		return err
 	}
-	var serializedArgs string
-	for _, arg := range args {
-		if serializedArgs != "" {
-			serializedArgs += ","
-		}
-		serializedArgs += arg
+
+	removeMountpoints, err := engine.CreateAPIMountpoints(chroot)
+	if err != nil {
+		return err
 	}
-	var serializedEnv string
-	for name, value := range environment {
-		if serializedEnv != "" {
-			serializedEnv += ","
-		}
-		serializedEnv += name + "=" + value
+	defer removeMountpoints()
+
+	path := "PATH=" + strings.Join(engine.Pathlist, ":")
+	spec := childSpec{
+		Command:    opts.Command,
+		Args:       opts.Args,
+		Chroot:     chroot,
+		WorkingDir: opts.WorkingDir,
+		UID:        opts.UID,
+		GID:        opts.GID,
+		Groups:     opts.Groups,
+		Terminal:   opts.Terminal,
 	}
-	path := "PATH="
-	for _, p := range engine.Pathlist {
-		if path != "PATH=" {
-			path += ":"
-		}
-		path += p
+	for name, value := range opts.Environment {
+		spec.Env = append(spec.Env, name+"="+value)
 	}
-	chrootArgs := []string{
-		"--cmd", command,
-		"--chroot", chroot,
-		"--working-dir", workingDir,
+	if _, ok := opts.Environment["PATH"]; !ok {
+		spec.Env = append(spec.Env, path)
 	}
-	if len(serializedArgs) > 0 {
-		chrootArgs = append(chrootArgs, "--args", serializedArgs)
+
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		return err
 	}
-	if len(serializedEnv) > 0 {
-		chrootArgs = append(chrootArgs, "--env", serializedEnv)
+	defer specReader.Close()
+	defer specWriter.Close()
+
+	cmd := entrypoint.Cmd()
+	cmd.ExtraFiles = []*os.File{specReader}
+	if opts.Cgroup != "" {
+		// Only the command goes into the cgroup, not the child itself
+		cgroup, err := os.Open(opts.Cgroup)
+		if err != nil {
+			return fmt.Errorf("error opening cgroup: %v", err)
+		}
+		defer cgroup.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, cgroup)
+		spec.Cgroup = true
 	}
-	cmd := exec.Command("acbuild-chroot", chrootArgs...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
 	cmd.Env = []string{path}
-	return cmd.Run()
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	specReader.Close()
+
+	err = json.NewEncoder(specWriter).Encode(spec)
+	specWriter.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	return engine.Wait(ctx, cmd)
 }
@@ -14,18 +14,218 @@
 
 package engine
 
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
 var Pathlist = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin",
 	"/usr/bin", "/sbin", "/bin"}
 
+// DefaultCapabilities is the capability set given to a command when the image
+// has no capability isolators, as defined by the appc spec.
+var DefaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SETUID",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETFCAP",
+	"CAP_SYS_CHROOT",
+}
+
+// Options describes a command to be executed by an Engine.
+type Options struct {
+	// Command is the path to the binary (post-chroot) to exec.
+	Command string
+	// Args is the arguments to pass to the binary.
+	Args []string
+	// Environment is the set of environment variables to set for the binary.
+	Environment map[string]string
+	// Chroot is the path on the host where the container's root filesystem
+	// exists.
+	Chroot string
+	// WorkingDir is the path inside the container that should be the current
+	// working directory for the binary. If it is "", the default should be
+	// "/".
+	WorkingDir string
+
+	// UID and GID are the user and group to run the binary as.
+	UID uint32
+	GID uint32
+	// Groups are the supplementary groups of the binary.
+	Groups []uint32
+
+	// Capabilities are the names of the capabilities the binary should have,
+	// such as CAP_CHOWN, if the image restricts them. If nil, the engine's
+	// default applies. Engines that can't restrict capabilities ignore this.
+	Capabilities []string
+	// NoNewPrivileges is whether the binary should be prevented from gaining
+	// privileges, such as through setuid binaries.
+	NoNewPrivileges bool
+
+	// Mounts have already been made in Chroot, but engines that mount
+	// filesystems of their own in the container, such as a tmpfs on /run,
+	// have to mount them again on top of those so that they aren't hidden.
+	Mounts []Mount
+
+	// Cgroup is the path of a cgroup v2 directory, such as
+	// /sys/fs/cgroup/acbuild-run-1, that the binary has to be run in for
+	// resource limits to apply to it, or "" if there are none. Engines should
+	// keep themselves out of it where they can, as whatever is in it counts
+	// against the limits.
+	Cgroup string
+
+	// Terminal is whether the binary is being used interactively from the
+	// terminal Stdin is connected to. Engines should make sure that signals
+	// from the keyboard, such as SIGINT, only affect the binary, and set up a
+	// terminal for it if they need to.
+	Terminal bool
+
+	// Stdin, Stdout and Stderr are connected to the binary. If any of them
+	// are nil, the binary's corresponding file descriptor is connected to
+	// /dev/null.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Mount is a directory or file from the host that acbuild makes available in
+// the container while the command runs.
+type Mount struct {
+	// Source is the path on the host, outside of the container.
+	Source string
+	// Destination is the path inside the container.
+	Destination string
+	// ReadOnly is whether the command can't change what's mounted.
+	ReadOnly bool
+}
+
 // Engine is an interface which is accepted by lib.Run, and used to perform the
 // actual execution of a binary inside the container.
 type Engine interface {
-	// Run executes a command inside a container. command is the path to the
-	// binary (post-chroot) to exec, args is the arguments to pass to the
-	// binary, environment is the set of environment variables to set for the
-	// binary, chroot is the path on the host where the container's root
-	// filesystem exists, and workingDir specifies the path inside the
-	// container that should be the current working directory for the binary.
-	// If workingDir is "", the default should be "/".
-	Run(command string, args []string, environment map[string]string, chroot, workingDir string) error
+	// Run executes the command described by opts inside a container. If ctx
+	// is cancelled before the command exits, the command is killed. If the
+	// command exits with a non-zero status, an *ExitError is returned.
+	Run(ctx context.Context, opts Options) error
+}
+
+// Unprivileged can be implemented by engines that don't need acbuild to be
+// root to run a command. lib.ACBuild.Run requires root for all other engines.
+type Unprivileged interface {
+	Unprivileged() bool
+}
+
+// ExitError is returned by Engine.Run when the command ran, but didn't exit
+// successfully.
+type ExitError struct {
+	// Code is the exit status of the command. If it was killed by a signal,
+	// this is 128 plus the signal number, as in the shell.
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("non-zero exit code: %d", e.Code)
+}
+
+// Wait waits for the started command cmd to exit, killing it if ctx is
+// cancelled first. Unsuccessful exits are returned as an *ExitError.
+func Wait(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ToExitError(err)
+}
+
+// ToExitError converts an *exec.ExitError into an *ExitError. Any other error
+// is returned unchanged.
+func ToExitError(err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return err
+	}
+	if status.Signaled() {
+		return &ExitError{Code: 128 + int(status.Signal())}
+	}
+	return &ExitError{Code: status.ExitStatus()}
+}
+
+// IgnoreKeyboardSignals keeps the calling process running when SIGINT or
+// SIGQUIT is sent from the terminal, such as by pressing Ctrl-C. The binary
+// being run is in the same process group, so it gets the signals as well and
+// can decide what to do about them.
+func IgnoreKeyboardSignals() {
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGQUIT)
+}
+
+// StartInCgroup makes cmd start in the cgroup v2 directory at cgroup, so that
+// no process it starts can escape it, unless cgroup is "". The returned
+// function closes the cgroup again, and must be called once cmd has started.
+func StartInCgroup(cmd *exec.Cmd, cgroup string) (func(), error) {
+	if cgroup == "" {
+		return func() {}, nil
+	}
+	f, err := os.Open(cgroup)
+	if err != nil {
+		return nil, fmt.Errorf("error opening cgroup: %v", err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { f.Close() }, nil
+}
+
+// Cgroup2Mountpoint returns where the cgroup v2 hierarchy is mounted.
+func Cgroup2Mountpoint() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// The filesystem type follows the " - " separator.
+		parts := strings.SplitN(s.Text(), " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		if strings.HasPrefix(parts[1], "cgroup2 ") && len(fields) >= 5 {
+			return fields[4], nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("resource limits require cgroup v2, which isn't mounted")
 }
@@ -0,0 +1,227 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package external implements engines that are separate binaries, named
+// acbuild-engine-<name> and found in $PATH.
+//
+// An engine binary is executed with the command's stdin, stdout and stderr. It
+// reads a Request as JSON from file descriptor 3, runs the command, and then
+// writes a Result as JSON to file descriptor 4 before exiting.
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/containers/build/engine"
+)
+
+const (
+	// ProtocolVersion is the version of the Request and Result formats.
+	ProtocolVersion = 1
+
+	// BinaryPrefix is the prefix of the names of engine binaries.
+	BinaryPrefix = "acbuild-engine-"
+
+	// RequestFd is the file descriptor the engine reads its Request from.
+	RequestFd = 3
+	// ResultFd is the file descriptor the engine writes its Result to.
+	ResultFd = 4
+)
+
+// Request describes the command an external engine should run.
+type Request struct {
+	Version         int               `json:"version"`
+	Command         string            `json:"command"`
+	Args            []string          `json:"args"`
+	Env             map[string]string `json:"env"`
+	Rootfs          string            `json:"rootfs"`
+	WorkingDir      string            `json:"workingDir"`
+	UID             uint32            `json:"uid"`
+	GID             uint32            `json:"gid"`
+	Groups          []uint32          `json:"groups,omitempty"`
+	Capabilities    []string          `json:"capabilities,omitempty"`
+	NoNewPrivileges bool              `json:"noNewPrivileges,omitempty"`
+	Terminal        bool              `json:"terminal,omitempty"`
+	Mounts          []Mount           `json:"mounts,omitempty"`
+	Cgroup          string            `json:"cgroup,omitempty"`
+}
+
+// Mount is something acbuild has mounted in the rootfs before running the
+// engine, from Source on the host.
+type Mount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+}
+
+// Result is the outcome of running a Request.
+type Result struct {
+	Version int `json:"version"`
+	// ExitCode is the exit status of the command.
+	ExitCode int `json:"exitCode"`
+	// Error is set if the engine failed to run the command at all.
+	Error string `json:"error,omitempty"`
+}
+
+// Engine runs commands with an external engine binary.
+type Engine struct {
+	// Name is the name of the engine, without BinaryPrefix.
+	Name string
+	// Path is the path to the engine binary.
+	Path string
+}
+
+// Unprivileged returns true, as lib.ACBuild.Run can't tell whether the engine
+// needs root. The engine has to check for itself.
+func (e Engine) Unprivileged() bool {
+	return true
+}
+
+func (e Engine) Run(ctx context.Context, opts engine.Options) error {
+	rootfs, err := filepath.Abs(opts.Chroot)
+	if err != nil {
+		return err
+	}
+	req := Request{
+		Version:         ProtocolVersion,
+		Command:         opts.Command,
+		Args:            opts.Args,
+		Env:             opts.Environment,
+		Rootfs:          rootfs,
+		WorkingDir:      opts.WorkingDir,
+		UID:             opts.UID,
+		GID:             opts.GID,
+		Groups:          opts.Groups,
+		Capabilities:    opts.Capabilities,
+		NoNewPrivileges: opts.NoNewPrivileges,
+		Terminal:        opts.Terminal,
+		Cgroup:          opts.Cgroup,
+	}
+	for _, m := range opts.Mounts {
+		req.Mounts = append(req.Mounts, Mount(m))
+	}
+
+	reqReader, reqWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer reqReader.Close()
+	defer reqWriter.Close()
+	resReader, resWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer resReader.Close()
+	defer resWriter.Close()
+
+	cmd := exec.Command(e.Path)
+	cmd.ExtraFiles = []*os.File{reqReader, resWriter}
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	closeCgroup, err := engine.StartInCgroup(cmd, opts.Cgroup)
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	closeCgroup()
+	if err != nil {
+		return err
+	}
+	reqReader.Close()
+	resWriter.Close()
+
+	resCh := make(chan []byte, 1)
+	go func() {
+		blob, _ := ioutil.ReadAll(resReader)
+		resCh <- blob
+	}()
+
+	err = json.NewEncoder(reqWriter).Encode(req)
+	reqWriter.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	waitErr := engine.Wait(ctx, cmd)
+	if ctx.Err() != nil {
+		return waitErr
+	}
+	blob := <-resCh
+
+	if len(blob) == 0 {
+		if waitErr != nil {
+			return fmt.Errorf("engine %s failed without a result: %v", e.Name, waitErr)
+		}
+		return fmt.Errorf("engine %s exited without a result", e.Name)
+	}
+	var res Result
+	err = json.Unmarshal(blob, &res)
+	if err != nil {
+		return fmt.Errorf("engine %s returned an invalid result: %v", e.Name, err)
+	}
+	switch {
+	case res.Version != ProtocolVersion:
+		return fmt.Errorf("engine %s returned a result with unsupported version %d", e.Name, res.Version)
+	case res.Error != "":
+		return fmt.Errorf("engine %s: %s", e.Name, res.Error)
+	case res.ExitCode != 0:
+		return &engine.ExitError{Code: res.ExitCode}
+	}
+	return nil
+}
+
+// Lookup finds the binary of the engine with the given name in $PATH. If
+// there are several, the first one in $PATH is used.
+func Lookup(name string) (Engine, bool) {
+	if name == "" {
+		return Engine{}, false
+	}
+	p, err := exec.LookPath(BinaryPrefix + name)
+	if err != nil || !filepath.IsAbs(p) {
+		return Engine{}, false
+	}
+	return Engine{Name: name, Path: p}, true
+}
+
+// ReadRequest reads the Request passed to an engine binary.
+func ReadRequest() (*Request, error) {
+	f := os.NewFile(RequestFd, "request")
+	defer f.Close()
+	var req Request
+	err := json.NewDecoder(f).Decode(&req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read request: %v", err)
+	}
+	if req.Version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported request version %d", req.Version)
+	}
+	return &req, nil
+}
+
+// WriteResult writes the Result of an engine binary.
+func WriteResult(res Result) error {
+	f := os.NewFile(ResultFd, "result")
+	defer f.Close()
+	res.Version = ProtocolVersion
+	return json.NewEncoder(f).Encode(res)
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/containers/build/engine"
+)
+
+const hostname = "acbuild"
+
+// runChild is executed as PID 1 of the new namespaces. It sets up the
+// container's root filesystem, pivots into it, and runs the command described
+// by the childSpec passed in on specFd, exiting with the command's exit code.
+func runChild() error {
+	runtime.LockOSThread()
+
+	var spec childSpec
+	specFile := os.NewFile(specFd, "spec")
+	err := json.NewDecoder(specFile).Decode(&spec)
+	specFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't read spec: %v", err)
+	}
+	if spec.Terminal {
+		engine.IgnoreKeyboardSignals()
+	}
+
+	// Make sure none of the mounts we're about to make propagate back out to
+	// the host.
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("couldn't make / private: %v", err)
+	}
+
+	// pivot_root requires the new root to be a mountpoint.
+	err = syscall.Mount(spec.Chroot, spec.Chroot, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("couldn't bind mount rootfs: %v", err)
+	}
+
+	err = engine.MountAPIFilesystems(spec.Chroot)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Sethostname([]byte(hostname))
+	if err != nil {
+		return fmt.Errorf("couldn't set hostname: %v", err)
+	}
+
+	err = pivotRoot(spec.Chroot)
+	if err != nil {
+		return err
+	}
+
+	if spec.WorkingDir != "" {
+		err = os.Chdir(spec.WorkingDir)
+		if err != nil {
+			return fmt.Errorf("couldn't cd: %v", err)
+		}
+	}
+
+	execCmd := exec.Command(spec.Command, spec.Args...)
+	execCmd.Env = spec.Env
+	execCmd.Stdin = os.Stdin
+	execCmd.Stdout = os.Stdout
+	execCmd.Stderr = os.Stderr
+	execCmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    spec.UID,
+			Gid:    spec.GID,
+			Groups: spec.Groups,
+		},
+	}
+	if spec.Cgroup {
+		syscall.CloseOnExec(cgroupFd)
+		execCmd.SysProcAttr.UseCgroupFD = true
+		execCmd.SysProcAttr.CgroupFD = cgroupFd
+	}
+	err = engine.ToExitError(execCmd.Run())
+	if exitErr, ok := err.(*engine.ExitError); ok {
+		os.Exit(exitErr.Code)
+	}
+	return err
+}
+
+// pivotRoot makes root the root of the mount namespace, and detaches the old
+// root so the host's filesystem is no longer reachable.
+func pivotRoot(root string) error {
+	err := os.Chdir(root)
+	if err != nil {
+		return fmt.Errorf("couldn't cd: %v", err)
+	}
+	// Stacking the old root on top of the new one avoids needing a directory
+	// inside the image to put it in.
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("couldn't pivot_root: %v", err)
+	}
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("couldn't detach old root: %v", err)
+	}
+	return os.Chdir("/")
+}
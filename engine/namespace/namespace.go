@@ -0,0 +1,144 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containers/build/engine"
+	"github.com/coreos/rkt/pkg/multicall"
+)
+
+// Engine runs commands in fresh mount, PID, UTS and IPC namespaces, with a
+// private /proc, /dev and /sys set up inside the container. It has no
+// dependencies outside of the kernel.
+type Engine struct{}
+
+// childSpec is handed from Engine.Run to the acbuild-namespace helper over an
+// inherited file descriptor.
+type childSpec struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Env        []string `json:"env"`
+	Chroot     string   `json:"chroot"`
+	WorkingDir string   `json:"workingDir"`
+	UID        uint32   `json:"uid"`
+	GID        uint32   `json:"gid"`
+	Groups     []uint32 `json:"groups"`
+	Terminal   bool     `json:"terminal"`
+	// Cgroup is whether the command is to be started in the cgroup that's
+	// open on cgroupFd.
+	Cgroup bool `json:"cgroup"`
+}
+
+// specFd is the file descriptor the child reads its childSpec from. It is the
+// first entry in exec.Cmd.ExtraFiles.
+const specFd = 3
+
+// cgroupFd is the file descriptor of the cgroup the child starts the command
+// in, if childSpec.Cgroup is set. It is the second entry in
+// exec.Cmd.ExtraFiles.
+const cgroupFd = 4
+
+var entrypoint multicall.Entrypoint
+
+func init() {
+	entrypoint = multicall.Add("acbuild-namespace", runChild)
+}
+
+func (e Engine) Run(ctx context.Context, opts engine.Options) error {
+	chroot, err := filepath.Abs(opts.Chroot)
+	if err != nil {
+		return err
+	}
+
+	// The mountpoints for the API filesystems need to exist in the rootfs, but
+	// if we're the ones to create them they shouldn't be left behind in the
+	// image.
+	removeMountpoints, err := engine.CreateAPIMountpoints(chroot)
+	if err != nil {
+		return err
+	}
+	defer removeMountpoints()
+
+	path := "PATH=" + strings.Join(engine.Pathlist, ":")
+	spec := childSpec{
+		Command:    opts.Command,
+		Args:       opts.Args,
+		Chroot:     chroot,
+		WorkingDir: opts.WorkingDir,
+		UID:        opts.UID,
+		GID:        opts.GID,
+		Groups:     opts.Groups,
+		Terminal:   opts.Terminal,
+	}
+	for name, value := range opts.Environment {
+		spec.Env = append(spec.Env, name+"="+value)
+	}
+	if _, ok := opts.Environment["PATH"]; !ok {
+		spec.Env = append(spec.Env, path)
+	}
+
+	specReader, specWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer specReader.Close()
+	defer specWriter.Close()
+
+	cmd := entrypoint.Cmd()
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWNS |
+		syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWUTS |
+		syscall.CLONE_NEWIPC
+	cmd.ExtraFiles = []*os.File{specReader}
+	if opts.Cgroup != "" {
+		// Only the command goes into the cgroup, not the child itself
+		cgroup, err := os.Open(opts.Cgroup)
+		if err != nil {
+			return fmt.Errorf("error opening cgroup: %v", err)
+		}
+		defer cgroup.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, cgroup)
+		spec.Cgroup = true
+	}
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	cmd.Env = []string{path}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	specReader.Close()
+
+	err = json.NewEncoder(specWriter).Encode(spec)
+	specWriter.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	// Killing the child takes everything else in its PID namespace with it.
+	return engine.Wait(ctx, cmd)
+}
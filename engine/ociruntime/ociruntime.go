@@ -0,0 +1,266 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociruntime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containers/build/engine"
+)
+
+// DefaultRuntime is the OCI runtime used if neither Engine.Runtime nor
+// $ACBUILD_OCI_RUNTIME is set.
+const DefaultRuntime = "runc"
+
+// RuntimeEnvVar can be set to the OCI runtime binary to use.
+const RuntimeEnvVar = "ACBUILD_OCI_RUNTIME"
+
+const hostname = "acbuild"
+
+// Engine runs commands with an OCI runtime such as runc or crun, by generating
+// a runtime bundle around the container's root filesystem.
+type Engine struct {
+	// Runtime is the name or path of the OCI runtime binary. It must support
+	// the run, kill and delete commands as runc does.
+	Runtime string
+}
+
+func (e Engine) runtime() string {
+	switch {
+	case e.Runtime != "":
+		return e.Runtime
+	case os.Getenv(RuntimeEnvVar) != "":
+		return os.Getenv(RuntimeEnvVar)
+	}
+	return DefaultRuntime
+}
+
+func (e Engine) Run(ctx context.Context, opts engine.Options) error {
+	runtime, err := exec.LookPath(e.runtime())
+	if err != nil {
+		return fmt.Errorf("OCI runtime %q not found", e.runtime())
+	}
+
+	chroot, err := filepath.Abs(opts.Chroot)
+	if err != nil {
+		return err
+	}
+
+	// The runtime would create these itself, but then they'd be left behind
+	// in the image.
+	removeMountpoints, err := engine.CreateAPIMountpoints(chroot)
+	if err != nil {
+		return err
+	}
+	defer removeMountpoints()
+
+	bundle, err := ioutil.TempDir("", "acbuild-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundle)
+
+	id := fmt.Sprintf("acbuild-%d-%s", os.Getpid(), filepath.Base(bundle))
+	s := generateSpec(chroot, opts)
+	if opts.Cgroup != "" {
+		mountpoint, err := engine.Cgroup2Mountpoint()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(mountpoint, opts.Cgroup)
+		if err != nil {
+			return err
+		}
+		// The runtime removes the cgroup of the container when it's deleted,
+		// so it gets one below the cgroup with the limits, which has to be
+		// around afterwards to tell whether they were hit. The runtime itself
+		// stays out of it.
+		s.Linux.CgroupsPath = "/" + filepath.Join(rel, id)
+	}
+	blob, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(bundle, "config.json"), blob, 0644)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(runtime, "run", "--bundle", bundle, id)
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Killing the runtime could leave the container behind, so it's asked to
+	// kill the container instead.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			exec.Command(runtime, "kill", id, "KILL").Run()
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	exec.Command(runtime, "delete", "--force", id).Run()
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return engine.ToExitError(err)
+}
+
+// generateSpec translates opts into an OCI runtime spec for a container whose
+// root filesystem is at chroot.
+func generateSpec(chroot string, opts engine.Options) *spec {
+	var env []string
+	for name, value := range opts.Environment {
+		env = append(env, name+"="+value)
+	}
+	if _, ok := opts.Environment["PATH"]; !ok {
+		env = append(env, "PATH="+strings.Join(engine.Pathlist, ":"))
+	}
+	sort.Strings(env)
+
+	cwd := opts.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	caps := opts.Capabilities
+	if caps == nil {
+		caps = engine.DefaultCapabilities
+	}
+
+	// The runtime mounts its own filesystems in the container, so anything
+	// acbuild mounted is mounted again on top of those
+	mounts := []mount{
+		{
+			Destination: "/proc",
+			Type:        "proc",
+			Source:      "proc",
+		},
+		{
+			Destination: "/dev",
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "strictatime", "mode=755", "size=65536k"},
+		},
+		{
+			Destination: "/dev/pts",
+			Type:        "devpts",
+			Source:      "devpts",
+			Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"},
+		},
+		{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"},
+		},
+		{
+			Destination: "/dev/mqueue",
+			Type:        "mqueue",
+			Source:      "mqueue",
+			Options:     []string{"nosuid", "noexec", "nodev"},
+		},
+		{
+			Destination: "/sys",
+			Type:        "sysfs",
+			Source:      "sysfs",
+			Options:     []string{"nosuid", "noexec", "nodev", "ro"},
+		},
+	}
+	for _, m := range opts.Mounts {
+		options := []string{"rbind"}
+		if m.ReadOnly {
+			options = append(options, "ro")
+		}
+		mounts = append(mounts, mount{
+			Destination: m.Destination,
+			Type:        "bind",
+			Source:      m.Source,
+			Options:     options,
+		})
+	}
+
+	return &spec{
+		Version: specVersion,
+		Process: process{
+			User: user{
+				UID:            opts.UID,
+				GID:            opts.GID,
+				AdditionalGids: opts.Groups,
+			},
+			Args: append([]string{opts.Command}, opts.Args...),
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: &capabilities{
+				Bounding:  caps,
+				Effective: caps,
+				Permitted: caps,
+			},
+			Rlimits: []rlimit{
+				{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024},
+			},
+			NoNewPrivileges: opts.NoNewPrivileges,
+			Terminal:        opts.Terminal,
+		},
+		Root: root{
+			Path: chroot,
+		},
+		Hostname: hostname,
+		Mounts:   mounts,
+		Linux: linux{
+			// The network namespace is left out, as acbuild sets that up
+			// itself.
+			Namespaces: []namespace{
+				{Type: "pid"},
+				{Type: "ipc"},
+				{Type: "uts"},
+				{Type: "mount"},
+			},
+			MaskedPaths: []string{
+				"/proc/kcore",
+				"/proc/latency_stats",
+				"/proc/timer_list",
+				"/proc/timer_stats",
+				"/proc/sched_debug",
+				"/sys/firmware",
+			},
+			ReadonlyPaths: []string{
+				"/proc/asound",
+				"/proc/bus",
+				"/proc/fs",
+				"/proc/irq",
+				"/proc/sys",
+				"/proc/sysrq-trigger",
+			},
+		},
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ociruntime
+
+// The types in this file are the subset of the OCI runtime spec's config.json
+// that acbuild generates. See
+// https://github.com/opencontainers/runtime-spec/blob/master/config.md
+
+const specVersion = "1.0.0"
+
+type spec struct {
+	Version  string  `json:"ociVersion"`
+	Process  process `json:"process"`
+	Root     root    `json:"root"`
+	Hostname string  `json:"hostname,omitempty"`
+	Mounts   []mount `json:"mounts,omitempty"`
+	Linux    linux   `json:"linux"`
+}
+
+type process struct {
+	Terminal        bool          `json:"terminal,omitempty"`
+	User            user          `json:"user"`
+	Args            []string      `json:"args"`
+	Env             []string      `json:"env,omitempty"`
+	Cwd             string        `json:"cwd"`
+	Capabilities    *capabilities `json:"capabilities,omitempty"`
+	Rlimits         []rlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool          `json:"noNewPrivileges,omitempty"`
+}
+
+type user struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type capabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+type rlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type linux struct {
+	CgroupsPath   string      `json:"cgroupsPath,omitempty"`
+	Namespaces    []namespace `json:"namespaces,omitempty"`
+	MaskedPaths   []string    `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string    `json:"readonlyPaths,omitempty"`
+}
+
+type namespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stub is a reference implementation of an external engine. Instead
+// of running commands it records the requests it gets, which makes it useful
+// for testing run without root. It's built into acbuild, and is available as
+// an engine named stub when acbuild is linked to as acbuild-engine-stub
+// somewhere in $PATH.
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containers/build/engine/external"
+	"github.com/coreos/rkt/pkg/multicall"
+)
+
+const (
+	// LogEnvVar is the file each request is appended to as a line of JSON.
+	LogEnvVar = "ACBUILD_ENGINE_STUB_LOG"
+	// ExitCodeEnvVar is the exit code to report for every command.
+	ExitCodeEnvVar = "ACBUILD_ENGINE_STUB_EXIT_CODE"
+)
+
+func init() {
+	multicall.Add(external.BinaryPrefix+"stub", run)
+}
+
+func run() error {
+	req, err := external.ReadRequest()
+	if err != nil {
+		return err
+	}
+
+	res := external.Result{}
+	if code := os.Getenv(ExitCodeEnvVar); code != "" {
+		res.ExitCode, err = strconv.Atoi(code)
+		if err != nil {
+			res.Error = fmt.Sprintf("invalid $%s: %v", ExitCodeEnvVar, err)
+		}
+	}
+	if logPath := os.Getenv(LogEnvVar); logPath != "" && res.Error == "" {
+		err := logRequest(logPath, req)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+	return external.WriteResult(res)
+}
+
+func logRequest(logPath string, req *external.Request) error {
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(req)
+}
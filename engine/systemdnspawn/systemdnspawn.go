@@ -15,19 +15,25 @@
 package systemdnspawn
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/containers/build/engine"
 )
 
 type Engine struct{}
 
-func (e Engine) Run(command string, args []string, environment map[string]string, chroot, workingDir string) error {
+// Run executes the command with systemd-nspawn. systemd-nspawn looks the user up
+// in the container itself and always uses its primary group and supplementary
+// groups from there, so opts.GID and opts.Groups are only honored where they
+// agree with the container's /etc/passwd and /etc/group.
+func (e Engine) Run(ctx context.Context, opts engine.Options) error {
+	chroot := opts.Chroot
 	nspawncmd := []string{"systemd-nspawn", "-D", chroot}
 
 	systemdVersion, err := getSystemdVersion()
@@ -38,39 +44,39 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	if systemdVersion >= 209 {
 		nspawncmd = append(nspawncmd, "--quiet", "--register=no")
 	}
-	if workingDir != "" {
+	if opts.Cgroup != "" {
+		// systemd-nspawn is started in the cgroup, and would otherwise move
+		// the container out of it into a scope of its own
+		nspawncmd = append(nspawncmd, "--keep-unit")
+	}
+	if opts.WorkingDir != "" {
 		if systemdVersion < 229 {
 			return fmt.Errorf("the working dir can only be set on systems with systemd-nspawn >= 229")
 		}
-		nspawncmd = append(nspawncmd, "--chdir", workingDir)
+		nspawncmd = append(nspawncmd, "--chdir", opts.WorkingDir)
 	}
-	if systemdVersion >= 230 {
-		machineIdFile := path.Join(chroot, "/etc/machine-id")
-		_, err := os.Stat(machineIdFile)
-		switch {
-		case os.IsNotExist(err):
-			err := os.MkdirAll(path.Dir(machineIdFile), 0755)
-			if err != nil {
-				return err
-			}
-			f, err := os.Create(machineIdFile)
-			if err != nil {
-				return err
-			}
-			f.Close()
-			defer os.RemoveAll(path.Join(chroot, machineIdFile))
-		case err != nil:
-			return err
-		}
+	if opts.UID != 0 {
+		nspawncmd = append(nspawncmd, "--user", strconv.FormatUint(uint64(opts.UID), 10))
 	}
-
-	for name, value := range environment {
+	for name, value := range opts.Environment {
 		nspawncmd = append(nspawncmd, "--setenv", name+"="+value)
 	}
+	// systemd-nspawn mounts a tmpfs on /run and /tmp, which hides anything
+	// mounted below them in the rootfs
+	for _, m := range opts.Mounts {
+		if strings.ContainsRune(m.Source, ':') || strings.ContainsRune(m.Destination, ':') {
+			return fmt.Errorf("can't mount %q at %q with systemd-nspawn, as it has a colon in it", m.Source, m.Destination)
+		}
+		flag := "--bind="
+		if m.ReadOnly {
+			flag = "--bind-ro="
+		}
+		nspawncmd = append(nspawncmd, flag+m.Source+":"+m.Destination)
+	}
 
 	nspawncmd = append(nspawncmd, "--setenv", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 
-	abscmd, err := findCmdInPath(engine.Pathlist, command, chroot)
+	abscmd, err := findCmdInPath(engine.Pathlist, opts.Command, chroot)
 	if err != nil {
 		return err
 	}
@@ -88,26 +94,27 @@ func (e Engine) Run(command string, args []string, environment map[string]string
 	}
 
 	nspawncmd = append(nspawncmd, abscmd)
-	nspawncmd = append(nspawncmd, args...)
+	nspawncmd = append(nspawncmd, opts.Args...)
 
 	execCmd := exec.Command(nspawncmd[0], nspawncmd[1:]...)
-	execCmd.Stdin = os.Stdin
-	execCmd.Stdout = os.Stdout
-	execCmd.Stderr = os.Stderr
+	execCmd.Stdin = opts.Stdin
+	execCmd.Stdout = opts.Stdout
+	execCmd.Stderr = opts.Stderr
 	execCmd.Env = []string{"SYSTEMD_LOG_LEVEL=err"}
+	closeCgroup, err := engine.StartInCgroup(execCmd, opts.Cgroup)
+	if err != nil {
+		return err
+	}
 
-	err = execCmd.Run()
+	err = execCmd.Start()
+	closeCgroup()
 	if err == exec.ErrNotFound {
 		return fmt.Errorf("systemd-nspawn is required but not found")
 	}
-	if err == nil {
-		return nil
-	}
-	if exitErr, ok := err.(*exec.ExitError); ok {
-		code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
-		return fmt.Errorf("non-zero exit code: %d", code)
+	if err != nil {
+		return err
 	}
-	return err
+	return engine.Wait(ctx, execCmd)
 }
 
 func getSystemdVersion() (int, error) {
@@ -0,0 +1,57 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appc
+
+import (
+	"path"
+	"sort"
+)
+
+// AddPathWhitelist adds the given absolute paths to the manifest's path
+// whitelist, keeping it sorted.
+func (m *Manifest) AddPathWhitelist(paths ...string) error {
+	return m.SetPathWhitelist(append(m.manifest.PathWhitelist, paths...))
+}
+
+// RemovePathWhitelist removes the given path from the manifest's path
+// whitelist.
+func (m *Manifest) RemovePathWhitelist(p string) error {
+	p = path.Clean(p)
+	pwl := m.manifest.PathWhitelist
+	for i, wp := range pwl {
+		if wp == p {
+			m.manifest.PathWhitelist = append(pwl[:i], pwl[i+1:]...)
+			return m.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// SetPathWhitelist replaces the manifest's path whitelist with the given
+// absolute paths. An empty whitelist means that every file of the image and
+// its dependencies is used.
+func (m *Manifest) SetPathWhitelist(paths []string) error {
+	set := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		set[path.Clean(p)] = struct{}{}
+	}
+	var pwl []string
+	for p := range set {
+		pwl = append(pwl, p)
+	}
+	sort.Strings(pwl)
+	m.manifest.PathWhitelist = pwl
+	return m.save()
+}
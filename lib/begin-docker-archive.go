@@ -0,0 +1,301 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/util"
+
+	docker2aci "github.com/appc/docker2aci/lib"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerArchiveManifestFile is the file in the archives `docker save` makes
+// that lists the images in it.
+const dockerArchiveManifestFile = "manifest.json"
+
+// dockerArchiveImage is an image in the manifest file of a docker archive. The
+// paths are relative to the root of the archive.
+type dockerArchiveImage struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// isDockerArchive returns whether the directory at dir holds an extracted
+// docker archive.
+func isDockerArchive(dir string) bool {
+	_, err := os.Stat(path.Join(dir, dockerArchiveManifestFile))
+	return err == nil
+}
+
+// beginFromDockerArchive turns the docker archive extracted to the build's
+// image path into an OCI image layout. Each of the image's layers is kept as
+// a layer of its own, with the same digest and diffID. If there's more than
+// one image in the archive, the one with the given ref and platform is used,
+// or the first one if neither is given.
+func (a *ACBuild) beginFromDockerArchive(ref string, platform *ociImage.Platform) error {
+	archivePath := path.Join(a.ContextPath, "docker-archive")
+	err := os.Rename(a.CurrentImagePath, archivePath)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(archivePath)
+	err = os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
+	if err != nil {
+		return err
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(archivePath, dockerArchiveManifestFile))
+	if err != nil {
+		return err
+	}
+	var images []dockerArchiveImage
+	err = json.Unmarshal(blob, &images)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", dockerArchiveManifestFile, err)
+	}
+	img, configBlob, err := selectDockerArchiveImage(archivePath, images, ref, platform)
+	if err != nil {
+		return err
+	}
+	var config ociImage.Image
+	err = json.Unmarshal(configBlob, &config)
+	if err != nil {
+		return fmt.Errorf("error reading image config: %v", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(img.Layers) {
+		return fmt.Errorf("image config has %d diffIDs for %d layers", len(config.RootFS.DiffIDs), len(img.Layers))
+	}
+	configDesc, err := a.writeBlob(configBlob)
+	if err != nil {
+		return err
+	}
+	configDesc.MediaType = ociImage.MediaTypeImageConfig
+
+	man := ociImage.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: OCISchemaVersion,
+			MediaType:     ociImage.MediaTypeImageManifest,
+		},
+		Config: configDesc,
+	}
+	// docker links the copies of layers that are in the archive more than
+	// once to the first one, which has been moved away by the time the
+	// others are reached
+	stored := make(map[string]ociImage.Descriptor)
+	storedDiffIDs := make(map[string]string)
+	for i, l := range img.Layers {
+		layerPath, err := util.ResolveInRoot(archivePath, l)
+		if err != nil {
+			return err
+		}
+		layer, ok := stored[layerPath]
+		if ok && storedDiffIDs[layerPath] != config.RootFS.DiffIDs[i] {
+			return fmt.Errorf("layer %s is in the image twice, with diffIDs %s and %s", l, storedDiffIDs[layerPath], config.RootFS.DiffIDs[i])
+		}
+		if !ok {
+			layer, err = a.storeDockerArchiveLayer(layerPath, config.RootFS.DiffIDs[i])
+			if err != nil {
+				return err
+			}
+			stored[layerPath] = layer
+			storedDiffIDs[layerPath] = config.RootFS.DiffIDs[i]
+		}
+		man.Layers = append(man.Layers, layer)
+	}
+
+	var size int
+	manDesc := ociImage.Descriptor{MediaType: ociImage.MediaTypeImageManifest}
+	manDesc.Digest, size, err = a.marshalHashAndWrite(man)
+	if err != nil {
+		return err
+	}
+	manDesc.Size = int64(size)
+
+	refName := oci.DefaultRefName
+	if t := img.repoTag(ref); t != "" {
+		refName = dockerTag(t)
+	} else if len(img.RepoTags) > 0 {
+		refName = dockerTag(img.RepoTags[0])
+	}
+	return a.writeUpstreamIndex(manDesc, man, refName)
+}
+
+// repoTag returns the "repo:tag" the image is tagged with that matches ref,
+// which is either a full "repo:tag" or just the tag, or "" if there's none.
+func (img dockerArchiveImage) repoTag(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	for _, t := range img.RepoTags {
+		if t == ref || (!strings.ContainsAny(ref, ":/") && dockerTag(t) == ref) {
+			return t
+		}
+	}
+	return ""
+}
+
+// selectDockerArchiveImage returns the image in the docker archive at
+// archivePath with the given ref and platform, along with its config. If
+// neither is given, the first image is used, otherwise there must be exactly
+// one image matching them.
+func selectDockerArchiveImage(archivePath string, images []dockerArchiveImage, ref string, platform *ociImage.Platform) (dockerArchiveImage, []byte, error) {
+	var matches []dockerArchiveImage
+	var configs [][]byte
+	var found []string
+	for _, img := range images {
+		configPath, err := util.ResolveInRoot(archivePath, img.Config)
+		if err != nil {
+			return img, nil, err
+		}
+		configBlob, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return img, nil, err
+		}
+		var config ociImage.Image
+		err = json.Unmarshal(configBlob, &config)
+		if err != nil {
+			return img, nil, fmt.Errorf("error reading image config: %v", err)
+		}
+		p := &ociImage.Platform{OS: config.OS, Architecture: config.Architecture}
+		found = append(found, fmt.Sprintf("%q (%s)", strings.Join(img.RepoTags, ", "), oci.PlatformString(p)))
+
+		if ref != "" && img.repoTag(ref) == "" {
+			continue
+		}
+		if platform != nil && !oci.MatchesPlatform(p, platform) {
+			continue
+		}
+		matches = append(matches, img)
+		configs = append(configs, configBlob)
+	}
+
+	switch {
+	case len(images) == 0:
+		return dockerArchiveImage{}, nil, fmt.Errorf("no images found in docker archive")
+	case len(matches) == 0:
+		return dockerArchiveImage{}, nil, fmt.Errorf("no image with %s in docker archive, it has %s", oci.DescribeSelection(ref, platform), strings.Join(found, ", "))
+	case len(matches) > 1 && (ref != "" || platform != nil):
+		return dockerArchiveImage{}, nil, fmt.Errorf("%d images with %s in docker archive, choose one of %s", len(matches), oci.DescribeSelection(ref, platform), strings.Join(found, ", "))
+	}
+	return matches[0], configs[0], nil
+}
+
+// beginFromDockerArchiveAppC begins an appc build from the docker archive at
+// start, which is also extracted at the build's image path, by squashing the
+// image into an ACI with docker2aci. ref is the "repo:tag" of the image to use
+// if there's more than one. docker2aci only reads the repositories file that
+// docker save used to write alongside the manifest file.
+func (a *ACBuild) beginFromDockerArchiveAppC(start, ref string) error {
+	_, err := os.Stat(path.Join(a.CurrentImagePath, "repositories"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("docker archives without a repositories file are only supported in oci builds")
+	}
+	if err != nil {
+		return err
+	}
+	err = util.RmAndMkdir(a.CurrentImagePath)
+	if err != nil {
+		return err
+	}
+	return a.beginFromDocker2ACI(func(commonConfig docker2aci.CommonConfig) ([]string, error) {
+		return docker2aci.ConvertSavedFile(start, docker2aci.FileConfig{
+			CommonConfig: commonConfig,
+			DockerURL:    ref,
+		})
+	})
+}
+
+// storeDockerArchiveLayer moves the layer at layerPath from a docker archive
+// into the build's image layout, and returns a descriptor for it. The layer is
+// checked against its diffID from the image config. docker saves layers as
+// plain tar files, but gzipped ones are accepted as well. layerPath must have
+// its symlinks resolved inside the archive already, as archives can have
+// symlinks to anywhere on the host, and each layer must only be stored once.
+func (a *ACBuild) storeDockerArchiveLayer(layerPath, diffID string) (ociImage.Descriptor, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return ociImage.Descriptor{}, err
+	}
+	defer f.Close()
+
+	digester := sha256.New()
+	br := bufio.NewReader(io.TeeReader(f, digester))
+	mediaType := oci.MediaTypeImageLayerUncompressed
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return ociImage.Descriptor{}, err
+		}
+		defer gr.Close()
+		mediaType = ociImage.MediaTypeImageLayer
+		r = gr
+	}
+	diffIDer := sha256.New()
+	_, err = io.Copy(diffIDer, r)
+	if err == nil {
+		// Whatever is past the end of the gzip stream is still part of
+		// the blob
+		_, err = io.Copy(ioutil.Discard, br)
+	}
+	if err != nil {
+		return ociImage.Descriptor{}, fmt.Errorf("error reading layer %s: %v", path.Base(path.Dir(layerPath)), err)
+	}
+	if got := "sha256:" + hex.EncodeToString(diffIDer.Sum(nil)); got != diffID {
+		return ociImage.Descriptor{}, fmt.Errorf("layer %s has diffID %s, expected %s", path.Base(path.Dir(layerPath)), got, diffID)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return ociImage.Descriptor{}, err
+	}
+	desc := ociImage.Descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(digester.Sum(nil)),
+		Size:      info.Size(),
+	}
+	target := a.blobPath(desc.Digest)
+	if _, err := os.Stat(target); err == nil {
+		// The archive had the same layer twice
+		return desc, nil
+	}
+	return desc, os.Rename(layerPath, target)
+}
+
+// dockerTag returns the tag in the docker image reference ref, such as "3.5"
+// in "alpine:3.5", or the default ref name if it has none.
+func dockerTag(ref string) string {
+	i := strings.LastIndex(ref, ":")
+	if i == -1 || strings.ContainsRune(ref[i:], '/') {
+		return oci.DefaultRefName
+	}
+	return ref[i+1:]
+}
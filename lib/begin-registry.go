@@ -0,0 +1,253 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/registry/docker"
+	"github.com/containers/build/util"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// baseRepositoryFile is the file in the build context with the registry and
+// repository of the upstream image the build began from, if it came from a
+// registry. Pushing the image to another repository on the same registry
+// mounts the base layers from it.
+const baseRepositoryFile = "base-repository"
+
+// registryManifestTypes are the media types of the manifests and manifest lists
+// begin accepts from registries.
+var registryManifestTypes = []string{
+	ociImage.MediaTypeImageManifest,
+	oci.MediaTypeImageIndex,
+	docker.MediaTypeManifest,
+	docker.MediaTypeManifestList,
+}
+
+// beginFromRegistry fetches the image start refers to from a registry into the
+// build's OCI image layout, keeping all of its layers. If start refers to a
+// manifest list, the image for platform is used, or the one for the platform
+// acbuild is running on if it's nil.
+// docker images are converted to the OCI format, which has the same layers and
+// config in it.
+func (a *ACBuild) beginFromRegistry(start string, insecure bool, platform *ociImage.Platform) error {
+	ref, err := docker.ParseReference(start)
+	if err != nil {
+		return err
+	}
+	client := docker.NewClient(insecure)
+
+	blob, mediaType, _, err := client.GetManifest(ref, registryManifestTypes...)
+	if err != nil {
+		return err
+	}
+	if mediaType == oci.MediaTypeImageIndex || mediaType == docker.MediaTypeManifestList {
+		ref.Digest, err = pickPlatformManifest(blob, ref, platform)
+		if err != nil {
+			return err
+		}
+		blob, mediaType, _, err = client.GetManifest(ref, registryManifestTypes...)
+		if err != nil {
+			return err
+		}
+	}
+	if mediaType != ociImage.MediaTypeImageManifest && mediaType != docker.MediaTypeManifest {
+		return fmt.Errorf("%s has a manifest of unsupported type %q", ref, mediaType)
+	}
+
+	var man ociImage.Manifest
+	err = json.Unmarshal(blob, &man)
+	if err != nil {
+		return fmt.Errorf("error reading manifest of %s: %v", ref, err)
+	}
+
+	err = os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
+	if err != nil {
+		return err
+	}
+
+	converted := mediaType != ociImage.MediaTypeImageManifest
+	if man.Config.MediaType == docker.MediaTypeConfig {
+		man.Config.MediaType = ociImage.MediaTypeImageConfig
+		converted = true
+	}
+	err = a.fetchBlob(client, ref, man.Config)
+	if err != nil {
+		return err
+	}
+	for i, layer := range man.Layers {
+		switch {
+		case layer.MediaType == docker.MediaTypeLayer:
+			man.Layers[i].MediaType = ociImage.MediaTypeImageLayer
+			converted = true
+		case layer.MediaType == docker.MediaTypeForeignLayer,
+			layer.MediaType == ociImage.MediaTypeImageLayerNonDistributable:
+			return fmt.Errorf("%s has non-distributable layers, which are unsupported", ref)
+		case !strings.HasPrefix(layer.MediaType, "application/vnd.oci.image.layer."):
+			return fmt.Errorf("%s has a layer of unsupported type %q", ref, layer.MediaType)
+		}
+		if a.Debug {
+			fmt.Fprintf(os.Stderr, "Fetching layer %d of %d: %s\n", i+1, len(man.Layers), layer.Digest)
+		}
+		err = a.fetchBlob(client, ref, layer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the manifest as it was in the registry when possible, so that it
+	// keeps its digest
+	var manDesc ociImage.Descriptor
+	if converted {
+		man.MediaType = ociImage.MediaTypeImageManifest
+		var size int
+		manDesc.Digest, size, err = a.marshalHashAndWrite(man)
+		manDesc.Size = int64(size)
+	} else {
+		manDesc, err = a.writeBlob(blob)
+	}
+	if err != nil {
+		return err
+	}
+	manDesc.MediaType = ociImage.MediaTypeImageManifest
+
+	refName := ref.Tag
+	if refName == "" {
+		refName = oci.DefaultRefName
+	}
+	err = a.writeUpstreamIndex(manDesc, man, refName)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(a.ContextPath, baseRepositoryFile), []byte(ref.Registry+"/"+ref.Repository), 0644)
+}
+
+// writeUpstreamIndex finishes beginning from an upstream image, whose blobs
+// are already in the build's image layout, by writing an index with its
+// manifest, described by manDesc, under the given ref. The image's layers are
+// recorded as base layers, which are kept as they are.
+func (a *ACBuild) writeUpstreamIndex(manDesc ociImage.Descriptor, man ociImage.Manifest, refName string) error {
+	configBlob, err := ioutil.ReadFile(a.blobPath(man.Config.Digest))
+	if err != nil {
+		return err
+	}
+	var config ociImage.Image
+	err = json.Unmarshal(configBlob, &config)
+	if err != nil {
+		return fmt.Errorf("error reading image config: %v", err)
+	}
+
+	idx := &oci.Index{
+		Manifests: []oci.IndexDescriptor{{
+			Descriptor: manDesc,
+			Platform: &ociImage.Platform{
+				Architecture: config.Architecture,
+				OS:           config.OS,
+			},
+			Annotations: map[string]string{oci.AnnotationRefName: refName},
+		}},
+	}
+	err = oci.WriteIndex(a.CurrentImagePath, idx)
+	if err != nil {
+		return err
+	}
+	return a.setBaseLayers(layerDigests(man))
+}
+
+// layerDigests returns the digests of the layers in man.
+func layerDigests(man ociImage.Manifest) []string {
+	var digests []string
+	for _, layer := range man.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests
+}
+
+// pickPlatformManifest returns the digest of the manifest for platform in the
+// manifest list blob, or for the platform acbuild is running on if it's nil.
+func pickPlatformManifest(blob []byte, ref docker.Reference, platform *ociImage.Platform) (string, error) {
+	var list oci.Index
+	err := json.Unmarshal(blob, &list)
+	if err != nil {
+		return "", fmt.Errorf("error reading manifest list of %s: %v", ref, err)
+	}
+	if platform == nil {
+		platform = oci.CurrentPlatform()
+	}
+	for _, m := range list.Manifests {
+		if oci.MatchesPlatform(m.Platform, platform) {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("%s has no image for %s", ref, oci.PlatformString(platform))
+}
+
+// blobPath returns where the blob with the given digest is in the build's
+// image layout.
+func (a *ACBuild) blobPath(digest string) string {
+	return layoutBlobPath(a.CurrentImagePath, digest)
+}
+
+// fetchBlob fetches the blob desc describes from the repository of ref into
+// the build's image layout, unless it's already there.
+func (a *ACBuild) fetchBlob(client *docker.Client, ref docker.Reference, desc ociImage.Descriptor) error {
+	if _, _, err := util.SplitOCILayerID(desc.Digest); err != nil {
+		return fmt.Errorf("invalid blob digest %q in manifest of %s", desc.Digest, ref)
+	}
+	target := a.blobPath(desc.Digest)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(path.Dir(target), "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	n, err := client.GetBlob(ref, desc.Digest, tmpFile)
+	if err1 := tmpFile.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && n != desc.Size {
+		return fmt.Errorf("blob %s from %s has size %d, expected %d", desc.Digest, ref, n, desc.Size)
+	}
+	return os.Rename(tmpFile.Name(), target)
+}
+
+// writeBlob writes blob to the build's image layout, returning a descriptor
+// for it without a media type.
+func (a *ACBuild) writeBlob(blob []byte) (ociImage.Descriptor, error) {
+	hash := util.HashBlob(blob)
+	desc := ociImage.Descriptor{
+		Digest: "sha256:" + hash,
+		Size:   int64(len(blob)),
+	}
+	return desc, ioutil.WriteFile(path.Join(a.CurrentImagePath, "blobs", "sha256", hash), blob, 0644)
+}
@@ -15,7 +15,6 @@
 package lib
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -49,12 +48,42 @@ var (
 	placeholdername = "acbuild-unnamed"
 )
 
+// ociPrefix marks images in registries to begin OCI builds from, like the
+// docker:// prefix does.
+const ociPrefix = "oci://"
+
+// BeginOptions choose the image to begin from, when what the build begins
+// from has more than one.
+type BeginOptions struct {
+	// Ref is the ref name of the image in an OCI image layout, or the tag of
+	// the image in a docker archive, either as "repo:tag" or just the tag.
+	Ref string
+	// Platform is the platform of the image, as os/arch or os/arch/variant.
+	// Multi-platform images are used for the platform acbuild runs on if
+	// it's empty.
+	Platform string
+}
+
 // Begin will start a new build, storing the untarred image the build operates
 // on at a.CurrentImagePath. If start is the empty string, the build will begin
 // with an empty image, otherwise the image stored at start will be used at the
 // starting point. The mode parameter specifies whether this is starting with an
-// AppC or OCI image.
-func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error) {
+// AppC or OCI image, and opts choose the image if start holds several.
+func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode, opts BeginOptions) (err error) {
+	var platform *ociImage.Platform
+	if opts.Platform != "" {
+		if mode != BuildModeOCI {
+			return fmt.Errorf("choosing images by platform is only supported in oci builds")
+		}
+		platform, err = oci.ParsePlatform(opts.Platform)
+		if err != nil {
+			return err
+		}
+	}
+	if start == "" && (opts.Ref != "" || platform != nil) {
+		return fmt.Errorf("a ref or platform can only be given when beginning from an image")
+	}
+
 	_, err = os.Stat(a.ContextPath)
 	switch {
 	case os.IsNotExist(err):
@@ -75,8 +104,7 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 	}
 
 	if os.Geteuid() != 0 {
-		fmt.Fprint(os.Stderr, `please run this as superuser to avoid 
-				       filesystem permissions issues`)
+		fmt.Fprintf(os.Stderr, "warning: not running as root or in a user namespace, file ownership in the image won't be preserved (a user namespace needs a subordinate ID range in /etc/subuid and /etc/subgid, and the newuidmap and newgidmap helpers)\n")
 	}
 
 	defer func() {
@@ -126,14 +154,21 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 			case finfo.IsDir():
 				return a.beginFromLocalDirectory(start)
 			default:
-				return a.beginFromLocalImage(start, mode)
+				return a.beginFromLocalImage(start, mode, opts.Ref, platform)
 			}
 		} else {
-			if mode == BuildModeOCI {
-				// TODO: fix this!
-				return fmt.Errorf("cannot start from remote OCI images currently")
+			if opts.Ref != "" {
+				return fmt.Errorf("the tag of remote images is part of their name, and can't be given as a ref")
 			}
 			dockerPrefix := "docker://"
+			if mode == BuildModeOCI {
+				for _, prefix := range []string{dockerPrefix, ociPrefix} {
+					if strings.HasPrefix(start, prefix) {
+						return a.beginFromRegistry(strings.TrimPrefix(start, prefix), insecure, platform)
+					}
+				}
+				return fmt.Errorf("remote OCI images must be given as %s or %s references", dockerPrefix, ociPrefix)
+			}
 			if strings.HasPrefix(start, dockerPrefix) {
 				start = strings.TrimPrefix(start, dockerPrefix)
 				return a.beginFromRemoteDockerImage(start, insecure)
@@ -150,7 +185,7 @@ func (a *ACBuild) Begin(start string, insecure bool, mode BuildMode) (err error)
 	return fmt.Errorf("unknown build mode: %s", mode)
 }
 
-func (a *ACBuild) beginFromLocalImage(start string, mode BuildMode) error {
+func (a *ACBuild) beginFromLocalImage(start string, mode BuildMode, ref string, platform *ociImage.Platform) error {
 	finfo, err := os.Stat(start)
 	if err != nil {
 		return err
@@ -166,12 +201,33 @@ func (a *ACBuild) beginFromLocalImage(start string, mode BuildMode) error {
 	var thingsToCheck []string
 	switch mode {
 	case BuildModeOCI:
-		thingsToCheck = []string{
-			path.Join(a.CurrentImagePath, "oci-layout"),
-			path.Join(a.CurrentImagePath, "refs"),
-			path.Join(a.CurrentImagePath, "blobs"),
+		if !oci.IsLayout(a.CurrentImagePath) {
+			if isDockerArchive(a.CurrentImagePath) {
+				return a.beginFromDockerArchive(ref, platform)
+			}
+			if ref != "" || platform != nil {
+				return fmt.Errorf("%s is neither an image layout nor a docker archive, so there are no images in it to choose from", start)
+			}
+			fmt.Fprintf(os.Stderr, "%s or %s is missing, assuming build is beginning with a tar of a rootfs\n", oci.LayoutFile, oci.IndexFile)
+			return a.startedFromTar(mode)
+		}
+		err = oci.SelectManifest(a.CurrentImagePath, ref, platform)
+		if err != nil {
+			return err
 		}
+		// Pre-1.0 images are converted to the current layout right away
+		img, err := oci.LoadImage(a.CurrentImagePath)
+		if err != nil {
+			return err
+		}
+		return img.Migrate()
 	case BuildModeAppC:
+		if isDockerArchive(a.CurrentImagePath) {
+			return a.beginFromDockerArchiveAppC(start, ref)
+		}
+		if ref != "" {
+			return fmt.Errorf("%s isn't a docker archive, so there are no images in it to choose from", start)
+		}
 		thingsToCheck = []string{
 			path.Join(a.CurrentImagePath, aci.ManifestFile),
 			path.Join(a.CurrentImagePath, aci.RootfsDir),
@@ -246,17 +302,7 @@ func (a *ACBuild) beginFromLocalDirectory(start string) error {
 }
 
 func (a *ACBuild) beginWithEmptyOCI() error {
-	for _, f := range []string{"blobs/sha256", "refs"} {
-		err := os.MkdirAll(path.Join(a.CurrentImagePath, f), 0755)
-		if err != nil {
-			return err
-		}
-	}
-	ociLayoutBlob, err := json.Marshal(OCILayoutValue)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(path.Join(a.CurrentImagePath, "oci-layout"), ociLayoutBlob, 0755)
+	err := os.MkdirAll(path.Join(a.CurrentImagePath, "blobs", "sha256"), 0755)
 	if err != nil {
 		return err
 	}
@@ -290,17 +336,21 @@ func (a *ACBuild) writeSkeletonRefAndManifest() error {
 		return err
 	}
 
-	ref := ociImage.Descriptor{
-		MediaType: ociImage.MediaTypeImageManifest,
-		Digest:    manHash,
-		Size:      int64(manSize),
-	}
-	refBlob, err := json.Marshal(ref)
-	if err != nil {
-		return err
+	idx := &oci.Index{
+		Manifests: []oci.IndexDescriptor{{
+			Descriptor: ociImage.Descriptor{
+				MediaType: ociImage.MediaTypeImageManifest,
+				Digest:    manHash,
+				Size:      int64(manSize),
+			},
+			Platform: &ociImage.Platform{
+				Architecture: img.Architecture,
+				OS:           img.OS,
+			},
+			Annotations: map[string]string{oci.AnnotationRefName: oci.DefaultRefName},
+		}},
 	}
-
-	err = ioutil.WriteFile(path.Join(a.CurrentImagePath, "refs", "latest"), refBlob, 0644)
+	err = oci.WriteIndex(a.CurrentImagePath, idx)
 	if err != nil {
 		return err
 	}
@@ -455,7 +505,25 @@ func (a *ACBuild) beginFromRemoteImage(start string, insecure bool) error {
 	return util.ExtractImage(path.Join(tmpDepStoreTarPath, files[0].Name()), a.CurrentImagePath, nil)
 }
 
-func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err error) {
+func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) error {
+	insecureConf := common.InsecureConfig{
+		SkipVerify: insecure,
+		AllowHTTP:  insecure,
+	}
+	return a.beginFromDocker2ACI(func(commonConfig docker2aci.CommonConfig) ([]string, error) {
+		config := docker2aci.RemoteConfig{
+			CommonConfig: commonConfig,
+			Username:     "",
+			Password:     "",
+			Insecure:     insecureConf,
+		}
+		return docker2aci.ConvertRemoteRepo(start, config)
+	})
+}
+
+// beginFromDocker2ACI begins the build with the squashed ACI convert makes
+// with docker2aci using the given config.
+func (a *ACBuild) beginFromDocker2ACI(convert func(docker2aci.CommonConfig) ([]string, error)) (err error) {
 	outputDir, err := ioutil.TempDir("", "acbuild")
 	if err != nil {
 		return err
@@ -468,23 +536,12 @@ func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err e
 	}
 	defer os.RemoveAll(tempDir)
 
-	insecureConf := common.InsecureConfig{
-		SkipVerify: insecure,
-		AllowHTTP:  insecure,
-	}
-
-	config := docker2aci.RemoteConfig{
-		CommonConfig: docker2aci.CommonConfig{
-			Squash:      true,
-			OutputDir:   outputDir,
-			TmpDir:      tempDir,
-			Compression: common.GzipCompression,
-		},
-		Username: "",
-		Password: "",
-		Insecure: insecureConf,
-	}
-	renderedACIs, err := docker2aci.ConvertRemoteRepo(start, config)
+	renderedACIs, err := convert(docker2aci.CommonConfig{
+		Squash:      true,
+		OutputDir:   outputDir,
+		TmpDir:      tempDir,
+		Compression: common.GzipCompression,
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,572 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/aci"
+
+	"github.com/containers/build/lib/appc"
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/util"
+	"github.com/containers/build/util/fsdiffer"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// cacheVersion is part of every cache key, and is to be bumped whenever the
+// meaning of what's stored in the cache changes.
+const cacheVersion = 2
+
+// rootfsStateFile is the file in the build context of an appc build with the
+// key of the step whose result the rootfs is, which identifies its contents
+// for the key of the next step without hashing the whole rootfs again. It's
+// removed whenever the rootfs is changed some other way.
+const rootfsStateFile = "rootfs-state"
+
+// cacheEntry is the stored result of a build step.
+type cacheEntry struct {
+	// Layer is the top layer of the image after the step, in OCI builds.
+	// NewLayer is whether the step added it, rather than replaced the top
+	// layer.
+	Layer    *cacheLayer `json:"layer,omitempty"`
+	NewLayer bool        `json:"newLayer,omitempty"`
+	// Diff is the digest of a tarball of the files the step added or changed
+	// in the rootfs, and Deleted lists the paths it removed, in appc builds.
+	Diff    string   `json:"diff,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+	// PathWhitelist is the image's path whitelist after the step, in appc
+	// builds.
+	PathWhitelist []string `json:"pathWhitelist,omitempty"`
+}
+
+type cacheLayer struct {
+	Digest string `json:"digest"`
+	DiffID string `json:"diffID"`
+	Size   int64  `json:"size"`
+	// MediaType is empty for gzipped layers, which were the only ones
+	// before layers could be compressed differently.
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// cachedStep calls f to perform the build step described by step, unless the
+// build cache in a.CacheDir already has the result of that step for the
+// current state of the image, in which case the result is applied instead.
+// step must marshal to JSON, and contain everything that affects the outcome
+// of f other than the image's filesystem.
+//
+// The cache is bypassed if a.CacheDir is empty. Errors storing a result in the
+// cache are reported, but don't fail the step.
+func (a *ACBuild) cachedStep(step interface{}, f func() error) error {
+	if a.CacheDir == "" {
+		err := a.forgetRootfsState()
+		if err != nil {
+			return err
+		}
+		return f()
+	}
+
+	key, err := a.cacheKey(step)
+	if err != nil {
+		return err
+	}
+	// Until the step is done, the rootfs is in neither state
+	err = a.forgetRootfsState()
+	if err != nil {
+		return err
+	}
+
+	entry, err := a.loadCacheEntry(key)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		err = a.applyCacheEntry(entry)
+		if err != nil {
+			return fmt.Errorf("error using cached result: %v", err)
+		}
+		a.reportCache(true)
+		return a.setRootfsState(key)
+	}
+
+	var differ *fsdiffer.TemporalFSDiffer
+	layerCount := 0
+	switch a.Mode {
+	case BuildModeAppC:
+		differ, err = fsdiffer.NewTemporalFSDiffer(path.Join(a.CurrentImagePath, aci.RootfsDir))
+		if err != nil {
+			return err
+		}
+	case BuildModeOCI:
+		if ociMan, ok := a.man.(*oci.Image); ok {
+			layerCount = len(ociMan.GetLayerDigests())
+		}
+	}
+
+	err = f()
+	if err != nil {
+		return err
+	}
+	a.reportCache(false)
+
+	err = a.storeCacheEntry(key, differ, layerCount)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error adding result to the build cache: %v\n", err)
+		return nil
+	}
+	return a.setRootfsState(key)
+}
+
+// setRootfsState records that the rootfs of an appc build is the result of
+// the step with the given key.
+func (a *ACBuild) setRootfsState(key string) error {
+	if a.Mode != BuildModeAppC {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(a.ContextPath, rootfsStateFile), []byte(key+"\n"), 0644)
+}
+
+// forgetRootfsState is called before the rootfs of an appc build is changed,
+// so that the next step hashes it again.
+func (a *ACBuild) forgetRootfsState() error {
+	err := os.Remove(path.Join(a.ContextPath, rootfsStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// rootfsState returns what identifies the contents of the rootfs of an appc
+// build: the key of the step whose result it is if that's known, or else a
+// hash of the rootfs.
+func (a *ACBuild) rootfsState() (string, error) {
+	blob, err := ioutil.ReadFile(path.Join(a.ContextPath, rootfsStateFile))
+	if err == nil {
+		return strings.TrimSpace(string(blob)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	return hashTree(path.Join(a.CurrentImagePath, aci.RootfsDir))
+}
+
+func (a *ACBuild) reportCache(hit bool) {
+	if a.CacheReport != nil {
+		a.CacheReport(hit)
+	}
+}
+
+// cacheKey returns the key the result of step is stored under, given the
+// current state of the image.
+func (a *ACBuild) cacheKey(step interface{}) (string, error) {
+	var parent interface{}
+	switch a.Mode {
+	case BuildModeOCI:
+		switch ociMan := a.man.(type) {
+		case *oci.Image:
+			parent = ociMan.GetLayerDigests()
+		default:
+			return "", fmt.Errorf("internal error: mismatched manifest type and build mode???")
+		}
+	case BuildModeAppC:
+		man, err := util.GetManifest(a.CurrentImagePath)
+		if err != nil {
+			return "", err
+		}
+		rootfsHash, err := a.rootfsState()
+		if err != nil {
+			return "", err
+		}
+		parent = struct {
+			Rootfs        string      `json:"rootfs"`
+			Dependencies  interface{} `json:"dependencies"`
+			PathWhitelist []string    `json:"pathWhitelist"`
+		}{rootfsHash, man.Dependencies, man.PathWhitelist}
+	default:
+		return "", fmt.Errorf("unknown build mode: %s", a.Mode)
+	}
+
+	// Steps in OCI builds write layers compressed the way they're asked to,
+	// which the key covers unless it's the default, so that the keys of
+	// existing results stay the same
+	var compression string
+	if a.Mode == BuildModeOCI && (a.Compression != util.CompressionGzip || a.CompressionLevel != util.DefaultCompressionLevel) {
+		compression = fmt.Sprintf("%s-%d", a.Compression, a.CompressionLevel)
+	}
+	// Whether a step starts a new layer depends on the maximum layer size,
+	// and a cached result starts one again if it did
+	var maxLayerSize int64
+	if a.Mode == BuildModeOCI {
+		maxLayerSize = a.MaxLayerSize
+	}
+
+	blob, err := json.Marshal(struct {
+		Version      int         `json:"version"`
+		Mode         BuildMode   `json:"mode"`
+		Compression  string      `json:"compression,omitempty"`
+		MaxLayerSize int64       `json:"maxLayerSize,omitempty"`
+		Parent       interface{} `json:"parent"`
+		Step         interface{} `json:"step"`
+	}{cacheVersion, a.Mode, compression, maxLayerSize, parent, step})
+	if err != nil {
+		return "", err
+	}
+	return util.HashBlob(blob), nil
+}
+
+func (a *ACBuild) cacheEntryPath(key string) string {
+	return path.Join(a.CacheDir, "steps", key+".json")
+}
+
+func (a *ACBuild) cacheBlobPath(digest string) string {
+	return path.Join(a.CacheDir, "blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// loadCacheEntry returns the entry stored under key, or nil if there is none
+// or its blobs have gone missing.
+func (a *ACBuild) loadCacheEntry(key string) (*cacheEntry, error) {
+	blob, err := ioutil.ReadFile(a.cacheEntryPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	err = json.Unmarshal(blob, &entry)
+	if err != nil {
+		// Treat corrupted entries as missing, so they're overwritten
+		return nil, nil
+	}
+
+	var digest string
+	switch {
+	case a.Mode == BuildModeOCI && entry.Layer != nil:
+		digest = entry.Layer.Digest
+	case a.Mode == BuildModeAppC && entry.Diff != "":
+		digest = entry.Diff
+	default:
+		return nil, nil
+	}
+	_, err = os.Stat(a.cacheBlobPath(digest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// applyCacheEntry changes the image the same way as the step whose result
+// entry is.
+func (a *ACBuild) applyCacheEntry(entry *cacheEntry) error {
+	switch a.Mode {
+	case BuildModeOCI:
+		ociMan, ok := a.man.(*oci.Image)
+		if !ok {
+			return fmt.Errorf("internal error: mismatched manifest type and build mode???")
+		}
+		algo, hash, err := util.SplitOCILayerID(entry.Layer.Digest)
+		if err != nil {
+			return err
+		}
+		blobPath := path.Join(a.CurrentImagePath, "blobs", algo, hash)
+		err = os.MkdirAll(path.Dir(blobPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = linkOrCopyFile(a.cacheBlobPath(entry.Layer.Digest), blobPath)
+		if err != nil {
+			return err
+		}
+		_, diffID, err := util.SplitOCILayerID(entry.Layer.DiffID)
+		if err != nil {
+			return err
+		}
+		mediaType := entry.Layer.MediaType
+		if mediaType == "" {
+			mediaType = ociImage.MediaTypeImageLayer
+		}
+		if entry.NewLayer {
+			return ociMan.NewTopLayer(algo, hash, diffID, entry.Layer.Size, mediaType)
+		}
+		oldTopLayer, err := ociMan.UpdateTopLayer(algo, hash, diffID, entry.Layer.Size, mediaType)
+		if err != nil {
+			return err
+		}
+		if oldTopLayer != "" && oldTopLayer != entry.Layer.Digest {
+			err = os.Remove(path.Join(a.CurrentImagePath, "blobs", strings.Replace(oldTopLayer, ":", "/", -1)))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error removing old top layer, hash %s: %v", oldTopLayer, err)
+			}
+		}
+		return nil
+	case BuildModeAppC:
+		appcMan, ok := a.man.(*appc.Manifest)
+		if !ok {
+			return fmt.Errorf("internal error: mismatched manifest type and build mode???")
+		}
+		rootfs := path.Join(a.CurrentImagePath, aci.RootfsDir)
+		for _, p := range entry.Deleted {
+			err := os.RemoveAll(path.Join(rootfs, p))
+			if err != nil {
+				return err
+			}
+		}
+		err := util.ExtractImage(a.cacheBlobPath(entry.Diff), rootfs, nil)
+		if err != nil {
+			return err
+		}
+		return appcMan.SetPathWhitelist(entry.PathWhitelist)
+	}
+	return fmt.Errorf("unknown build mode: %s", a.Mode)
+}
+
+// storeCacheEntry saves the result of the step that was just performed under
+// key. In appc builds, differ has the state of the rootfs from before the step,
+// and in OCI builds layerCount is how many layers the image had before it.
+func (a *ACBuild) storeCacheEntry(key string, differ *fsdiffer.TemporalFSDiffer, layerCount int) error {
+	var entry cacheEntry
+	switch a.Mode {
+	case BuildModeOCI:
+		ociMan, ok := a.man.(*oci.Image)
+		if !ok {
+			return fmt.Errorf("internal error: mismatched manifest type and build mode???")
+		}
+		layers := ociMan.GetManifest().Layers
+		diffIDs := ociMan.GetDiffIDs()
+		if len(layers) == 0 || len(diffIDs) != len(layers) {
+			return fmt.Errorf("image has no top layer")
+		}
+		top := layers[len(layers)-1]
+		entry.Layer = &cacheLayer{
+			Digest: top.Digest,
+			DiffID: diffIDs[len(diffIDs)-1],
+			Size:   top.Size,
+		}
+		if top.MediaType != ociImage.MediaTypeImageLayer {
+			entry.Layer.MediaType = top.MediaType
+		}
+		// An image without layers gets one either way
+		entry.NewLayer = layerCount > 0 && len(layers) > layerCount
+		err := a.storeCacheBlob(top.Digest, path.Join(a.CurrentImagePath, "blobs", strings.Replace(top.Digest, ":", "/", -1)))
+		if err != nil {
+			return err
+		}
+	case BuildModeAppC:
+		changes, err := differ.Diff()
+		if err != nil {
+			return err
+		}
+		digest, tmpPath, err := a.writeRootfsDiff(changes)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpPath)
+		err = a.storeCacheBlob(digest, tmpPath)
+		if err != nil {
+			return err
+		}
+		entry.Diff = digest
+		for _, c := range changes {
+			if c.ChangeType == fsdiffer.Deleted {
+				entry.Deleted = append(entry.Deleted, c.Path)
+			}
+		}
+		sort.Strings(entry.Deleted)
+		man, err := util.GetManifest(a.CurrentImagePath)
+		if err != nil {
+			return err
+		}
+		entry.PathWhitelist = man.PathWhitelist
+	default:
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	}
+
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.cacheEntryPath(key), blob)
+}
+
+// storeCacheBlob copies the file at src into the cache as the blob with the
+// given digest, unless it's already there.
+func (a *ACBuild) storeCacheBlob(digest, src string) error {
+	dst := a.cacheBlobPath(digest)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	err = linkOrCopyFile(src, tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// writeRootfsDiff writes a gzipped tarball of everything that was added or
+// modified in the rootfs according to changes to a temporary file, and returns
+// its digest and path.
+func (a *ACBuild) writeRootfsDiff(changes fsdiffer.FSChanges) (digest, tmpPath string, err error) {
+	rootfs := path.Join(a.CurrentImagePath, aci.RootfsDir)
+
+	var paths []string
+	for _, c := range changes {
+		if c.ChangeType != fsdiffer.Deleted && c.Path != "." {
+			paths = append(paths, c.Path)
+		}
+	}
+	// Parent directories have to come before what's in them
+	sort.Strings(paths)
+
+	tmpFile, err := ioutil.TempFile(a.ContextPath, "acbuild-cache-diff")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		tmpFile.Close()
+		if err != nil {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	hasher := sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(tmpFile, hasher))
+	tarWriter := tar.NewWriter(gzipWriter)
+	walker := util.PathWalker(tarWriter, rootfs)
+	for _, p := range paths {
+		fullPath := path.Join(rootfs, p)
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return "", "", err
+		}
+		err = walker(fullPath, info, nil)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return "", "", err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return "", "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), tmpFile.Name(), nil
+}
+
+// hashTree returns a digest of the contents of the directory tree at root,
+// covering the names, types, permissions, ownership and contents of everything
+// in it, but not timestamps. root may also be a single file.
+func hashTree(root string) (string, error) {
+	hasher := sha256.New()
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		var uid, gid uint32
+		var rdev uint64
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid, rdev = st.Uid, st.Gid, uint64(st.Rdev)
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(hasher, "%q %o %d %d %d %q %d\n", rel, info.Mode(), uid, gid, rdev, link, info.Size())
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(hasher, f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// linkOrCopyFile hard links src to dst, or copies it if they're on different
+// filesystems.
+func linkOrCopyFile(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// writeFileAtomic writes blob to p, such that anyone reading p sees either
+// all of blob or nothing.
+func writeFileAtomic(p string, blob []byte) error {
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", p, os.Getpid())
+	err = ioutil.WriteFile(tmp, blob, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
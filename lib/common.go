@@ -16,7 +16,6 @@ package lib
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -37,12 +36,6 @@ const OCISchemaVersion = 2
 
 const defaultWorkPath = ".acbuild"
 
-type OCILayout struct {
-	imageLayoutVersion string `json:"imageLayoutVersion"`
-}
-
-var OCILayoutValue = OCILayout{"1.0.0"}
-
 // BuildMode represents which image spec is being followed during a build, AppC
 // or OCI
 type BuildMode string
@@ -67,11 +60,32 @@ type ACBuild struct {
 	DepStoreExpandedPath string
 	OverlayTargetPath    string
 	OverlayWorkPath      string
+	OverlayDiscardPath   string
 	BuildModePath        string
 	OCIExpandedBlobsPath string
+	MountCachePath       string
+	SecretsPath          string
 	Debug                bool
 	Mode                 BuildMode
 
+	// CacheDir is the directory the results of run and copy steps are cached
+	// in, so that they don't need to be performed again when building the
+	// same thing. The cache isn't used if CacheDir is empty.
+	CacheDir string
+	// CacheReport, if set, is called after each step that could have been
+	// cached, with whether its result came from the cache.
+	CacheReport func(hit bool)
+	// MaxLayerSize is the size in bytes of the compressed top layer of an OCI
+	// image above which run and copy put their changes in a new layer, rather
+	// than write the whole top layer out again. 0 means never to start a new
+	// layer. It defaults to DefaultMaxLayerSize.
+	MaxLayerSize int64
+	// Compression is what the ACIs Write writes and the layers of OCI images
+	// are compressed with, at CompressionLevel, which is
+	// util.DefaultCompressionLevel for the compression's default level.
+	Compression      util.Compression
+	CompressionLevel int
+
 	man      Manifest
 	lockFile *os.File
 }
@@ -87,10 +101,16 @@ func NewACBuild(cwd string, debug bool, buildMode BuildMode) (*ACBuild, error) {
 		DepStoreExpandedPath: path.Join(cwd, defaultWorkPath, "depstore-expanded"),
 		OverlayTargetPath:    path.Join(cwd, defaultWorkPath, "target"),
 		OverlayWorkPath:      path.Join(cwd, defaultWorkPath, "work"),
+		OverlayDiscardPath:   path.Join(cwd, defaultWorkPath, "discard"),
 		BuildModePath:        path.Join(cwd, defaultWorkPath, "buildMode"),
 		OCIExpandedBlobsPath: path.Join(cwd, defaultWorkPath, "ociblobs"),
+		MountCachePath:       path.Join(cwd, defaultWorkPath, "mount-cache"),
+		SecretsPath:          path.Join(cwd, defaultWorkPath, "secrets"),
 		Debug:                debug,
 		Mode:                 buildMode,
+		MaxLayerSize:         DefaultMaxLayerSize,
+		Compression:          util.CompressionGzip,
+		CompressionLevel:     util.DefaultCompressionLevel,
 	}
 	// This might fail, and that's ok (maybe the build hasn't started yet)
 	a.loadManifest()
@@ -202,28 +222,34 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 	}()
 	combinedWriter := io.MultiWriter(layerDigestWriter, tmpFile)
 
-	gzipWriter := gzip.NewWriter(combinedWriter)
+	compressWriter, err := util.NewCompressWriter(combinedWriter, a.Compression, a.CompressionLevel)
+	if err != nil {
+		return err
+	}
 	defer func() {
 		if !finishedWriting {
-			gzipWriter.Close()
+			compressWriter.Close()
 		}
 	}()
 
 	diffIdWriter := sha256.New()
-	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, gzipWriter))
+	tarWriter := tar.NewWriter(io.MultiWriter(diffIdWriter, compressWriter))
 	defer func() {
 		if !finishedWriting {
 			tarWriter.Close()
 		}
 	}()
 
-	err = filepath.Walk(targetPath, util.PathWalker(tarWriter, targetPath))
+	err = filepath.Walk(targetPath, util.OCILayerWalker(tarWriter, targetPath))
 	if err != nil {
 		return err
 	}
 
 	tarWriter.Close()
-	gzipWriter.Close()
+	err = compressWriter.Close()
+	if err != nil {
+		return err
+	}
 	tmpFile.Close()
 
 	finfo, err := os.Stat(tmpFile.Name())
@@ -260,14 +286,14 @@ func (a *ACBuild) rehashAndStoreOCIBlob(targetPath string, newLayer bool) error
 	case *oci.Image:
 		if newLayer {
 			// add a new top layer to the config/manifest
-			err = ociMan.NewTopLayer("sha256", layerDigest, diffId, fsize)
+			err = ociMan.NewTopLayer("sha256", layerDigest, diffId, fsize, layerMediaType(a.Compression))
 			if err != nil {
 				return err
 			}
 		} else {
 			// update the top layer hash in the config/manifest, and remove the old
 			// top layer
-			oldTopLayerHash, err = ociMan.UpdateTopLayer("sha256", layerDigest, diffId, fsize)
+			oldTopLayerHash, err = ociMan.UpdateTopLayer("sha256", layerDigest, diffId, fsize, layerMediaType(a.Compression))
 			if err != nil {
 				return err
 			}
@@ -39,13 +39,42 @@ func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
 		}
 	}()
 
-	switch a.Mode {
-	case BuildModeAppC:
-		return a.copyToDirAppC(froms, to)
-	case BuildModeOCI:
-		return a.copyToDirOCI(froms, to)
+	step, err := newCopyStep(froms, to, true)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("unknown build mode: %s", a.Mode)
+	return a.cachedStep(step, func() error {
+		switch a.Mode {
+		case BuildModeAppC:
+			return a.copyToDirAppC(froms, to)
+		case BuildModeOCI:
+			return a.copyToDirOCI(froms, to)
+		}
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	})
+}
+
+// copyStep is what identifies a copy in the build cache, along with the state
+// of the image it's copied into.
+type copyStep struct {
+	// Sources are the hashes of the files being copied, as from hashTree.
+	Sources []string `json:"copy"`
+	Names   []string `json:"names"`
+	To      string   `json:"to"`
+	ToDir   bool     `json:"toDir"`
+}
+
+func newCopyStep(froms []string, to string, toDir bool) (*copyStep, error) {
+	step := &copyStep{To: to, ToDir: toDir}
+	for _, from := range froms {
+		hash, err := hashTree(from)
+		if err != nil {
+			return nil, err
+		}
+		step.Sources = append(step.Sources, hash)
+		step.Names = append(step.Names, path.Base(from))
+	}
+	return step, nil
 }
 
 func (a *ACBuild) copyToDirAppC(froms []string, to string) error {
@@ -110,16 +139,21 @@ func (a *ACBuild) expandTopOCILayer() (string, error) {
 }
 
 func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
-	currentLayer, err := a.expandTopOCILayer()
+	topLayer, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
 	}
+	change, err := a.beginLayerChange(topLayer, true)
+	if err != nil {
+		return err
+	}
+	currentLayer := change.path
 	targetPath := path.Join(currentLayer, to)
 
 	targetInfo, err := os.Stat(targetPath)
 	switch {
-	case os.IsNotExist(err):
-		err := os.MkdirAll(targetPath, 0755)
+	case os.IsNotExist(err), err == nil && util.IsOverlayWhiteout(targetInfo):
+		err := a.mkdirAllInLayer(currentLayer, to)
 		if err != nil {
 			return err
 		}
@@ -132,13 +166,13 @@ func (a *ACBuild) copyToDirOCI(froms []string, to string) error {
 	for _, from := range froms {
 		_, file := path.Split(from)
 		tmptarget := path.Join(targetPath, file)
-		err := fileutil.CopyTree(from, tmptarget, user.NewBlankUidRange())
+		err := copyIntoLayer(from, tmptarget)
 		if err != nil {
 			return err
 		}
 	}
 
-	return a.rehashAndStoreOCIBlob(currentLayer, false)
+	return a.finishLayerChange(change)
 }
 
 // CopyToTarget will copy a single file/directory from the from string to the
@@ -153,13 +187,19 @@ func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
 		}
 	}()
 
-	switch a.Mode {
-	case BuildModeAppC:
-		return a.copyToTargetAppC(from, to)
-	case BuildModeOCI:
-		return a.copyToTargetOCI(from, to)
+	step, err := newCopyStep([]string{from}, to, false)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("unknown build mode: %s", a.Mode)
+	return a.cachedStep(step, func() error {
+		switch a.Mode {
+		case BuildModeAppC:
+			return a.copyToTargetAppC(from, to)
+		case BuildModeOCI:
+			return a.copyToTargetOCI(from, to)
+		}
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	})
 }
 
 func (a *ACBuild) copyToTargetAppC(from string, to string) error {
@@ -177,15 +217,38 @@ func (a *ACBuild) copyToTargetAppC(from string, to string) error {
 }
 
 func (a *ACBuild) copyToTargetOCI(from string, to string) error {
-	targetPath, err := a.expandTopOCILayer()
+	topLayer, err := a.expandTopOCILayer()
 	if err != nil {
 		return err
 	}
+	change, err := a.beginLayerChange(topLayer, true)
+	if err != nil {
+		return err
+	}
+	targetPath := change.path
 	target := path.Join(targetPath, to)
 
-	dir, _ := path.Split(target)
-	if dir != "" {
-		err := os.MkdirAll(dir, 0755)
+	err = a.mkdirAllInLayer(targetPath, path.Dir(path.Clean("/"+to)))
+	if err != nil {
+		return err
+	}
+
+	err = copyIntoLayer(from, target)
+	if err != nil {
+		return err
+	}
+
+	return a.finishLayerChange(change)
+}
+
+// copyIntoLayer copies from to target in an expanded OCI layer. If the layer
+// records target as deleted, the copy replaces the whiteout, and if it's a
+// directory it hides what the layers below had in the deleted one.
+func copyIntoLayer(from, target string) error {
+	info, err := os.Lstat(target)
+	deleted := err == nil && util.IsOverlayWhiteout(info)
+	if deleted {
+		err = os.Remove(target)
 		if err != nil {
 			return err
 		}
@@ -196,6 +259,8 @@ func (a *ACBuild) copyToTargetOCI(from string, to string) error {
 		return err
 	}
 
-	return a.rehashAndStoreOCIBlob(targetPath, false)
-
+	if info, err := os.Lstat(target); deleted && err == nil && info.IsDir() {
+		return util.SetOverlayOpaque(target)
+	}
+	return nil
 }
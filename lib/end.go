@@ -37,7 +37,9 @@ func (a *ACBuild) End() error {
 		return err
 	}
 
-	err = util.MaybeUnmount(a.OverlayTargetPath)
+	// Make sure nothing is left mounted in the build context, otherwise
+	// removing it could reach into directories from the host.
+	err = util.UnmountAll(a.ContextPath)
 	if err != nil {
 		return err
 	}
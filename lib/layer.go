@@ -16,8 +16,18 @@ package lib
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
 
+	"github.com/containers/build/lib/oci"
 	"github.com/containers/build/util"
+	"github.com/containers/build/util/fsdiffer"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func (a *ACBuild) NewLayer() (err error) {
@@ -40,3 +50,331 @@ func (a *ACBuild) NewLayer() (err error) {
 	}
 	return a.rehashAndStoreOCIBlob(newLayer, true)
 }
+
+// layerMediaType returns the media type of OCI layers compressed with c.
+func layerMediaType(c util.Compression) string {
+	switch c {
+	case util.CompressionZstd:
+		return oci.MediaTypeImageLayerZstd
+	case util.CompressionXz:
+		return oci.MediaTypeImageLayerXz
+	case util.CompressionNone:
+		return oci.MediaTypeImageLayerUncompressed
+	}
+	return ociImage.MediaTypeImageLayer
+}
+
+// DefaultMaxLayerSize is the default for ACBuild.MaxLayerSize. Writing out a
+// layer of this size compressed takes a few seconds.
+const DefaultMaxLayerSize = 256 << 20
+
+// baseLayersFile is the file in the build context listing the digests of the
+// layers of an upstream image the build began from. These are shared with the
+// other images built on it, so build steps never change them, and start a new
+// layer on top of them instead.
+const baseLayersFile = "base-layers"
+
+// setBaseLayers records that the layers with the given digests come from the
+// upstream image the build began from.
+func (a *ACBuild) setBaseLayers(digests []string) error {
+	return ioutil.WriteFile(path.Join(a.ContextPath, baseLayersFile), []byte(strings.Join(digests, "\n")+"\n"), 0644)
+}
+
+// isBaseLayer returns whether the layer with the given digest comes from the
+// upstream image the build began from.
+func (a *ACBuild) isBaseLayer(digest string) (bool, error) {
+	blob, err := ioutil.ReadFile(path.Join(a.ContextPath, baseLayersFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, d := range strings.Split(string(blob), "\n") {
+		if d == digest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// layerChange is a change being made to an OCI image's layers by a build step.
+type layerChange struct {
+	// path is the expanded layer the step is to make its changes in.
+	path string
+	// newLayer is whether the layer at path is to be added on top of the
+	// image, rather than replace its top layer.
+	newLayer bool
+	// differ has the state of the layer at path from before the step, or is
+	// nil if the layer is to be saved regardless.
+	differ *fsdiffer.TemporalFSDiffer
+}
+
+// beginLayerChange prepares for a build step changing the OCI image whose
+// expanded top layer is at topLayer. Usually the step makes its changes to the
+// top layer, but if that's bigger than a.MaxLayerSize and mayStartNew is set, a
+// new empty layer is started for them instead, so that the big layer doesn't
+// need to be written out again. The same goes for layers of the upstream image
+// the build began from, whatever their size, as long as mayStartNew is set.
+// The step has to be finished with finishLayerChange.
+func (a *ACBuild) beginLayerChange(topLayer string, mayStartNew bool) (*layerChange, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return nil, fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+	c := &layerChange{path: topLayer}
+	layers := ociMan.GetManifest().Layers
+	if len(layers) == 0 {
+		// There's no layer to compare against, so the image needs one
+		// whatever the step does.
+		return c, nil
+	}
+
+	top := layers[len(layers)-1]
+	base, err := a.isBaseLayer(top.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if base && !mayStartNew {
+		fmt.Fprintf(os.Stderr, "warning: can't start a new layer without root, the top layer of the upstream image will be changed and no longer be shared with it\n")
+	}
+	if mayStartNew && (base || (a.MaxLayerSize > 0 && top.Size > a.MaxLayerSize)) {
+		newLayer, err := util.OCINewExpandedLayer(a.OCIExpandedBlobsPath)
+		if err != nil {
+			return nil, err
+		}
+		c.path = newLayer
+		c.newLayer = true
+	}
+
+	differ, err := fsdiffer.NewTemporalFSDiffer(c.path)
+	if err != nil {
+		return nil, err
+	}
+	// A chmod changes the layer as much as a write does
+	differ.CheckMetadata = true
+	c.differ = differ
+	return c, nil
+}
+
+// finishLayerChange saves the layer the step begun by beginLayerChange made its
+// changes in to the image. If the step didn't change anything, nothing needs to
+// be saved, and a layer started for it is thrown away.
+func (a *ACBuild) finishLayerChange(c *layerChange) error {
+	if c.differ != nil {
+		changes, err := c.differ.Diff()
+		if err != nil {
+			return err
+		}
+		changes, err = a.pruneCopiedUpDirs(c.path, changes)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			if c.newLayer {
+				return os.RemoveAll(c.path)
+			}
+			return nil
+		}
+	}
+	return a.rehashAndStoreOCIBlob(c.path, c.newLayer)
+}
+
+// pruneCopiedUpDirs removes the directories that changes says were added to the
+// expanded layer at layerPath if they're empty, and the layers below have the
+// same directory with the same mode and ownership. Overlayfs copies directories
+// up to the top layer when anything is created in them, even if it's removed
+// again, like the mountpoints run creates, and these copies don't change the
+// image. The changes that are left are returned.
+func (a *ACBuild) pruneCopiedUpDirs(layerPath string, changes fsdiffer.FSChanges) (fsdiffer.FSChanges, error) {
+	var added []string
+	for _, c := range changes {
+		if c.ChangeType == fsdiffer.Added {
+			added = append(added, c.Path)
+		}
+	}
+	if len(added) == 0 {
+		return changes, nil
+	}
+	// Children before their parents, which may be empty once they're gone
+	sort.Sort(sort.Reverse(sort.StringSlice(added)))
+
+	var lowers []string
+	pruned := make(map[string]bool)
+	for _, p := range added {
+		target := path.Join(layerPath, p)
+		info, err := os.Lstat(target)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() || util.IsOverlayOpaque(target) {
+			continue
+		}
+		entries, err := ioutil.ReadDir(target)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+
+		if lowers == nil {
+			lowers, err = a.ociLowerLayerPaths(layerPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var lowerInfo os.FileInfo
+		for _, lower := range lowers {
+			if li, err := os.Lstat(path.Join(lower, p)); err == nil {
+				lowerInfo = li
+				break
+			}
+		}
+		if lowerInfo == nil || !lowerInfo.IsDir() || lowerInfo.Mode() != info.Mode() {
+			continue
+		}
+		st, ok1 := info.Sys().(*syscall.Stat_t)
+		lowerSt, ok2 := lowerInfo.Sys().(*syscall.Stat_t)
+		if !ok1 || !ok2 || st.Uid != lowerSt.Uid || st.Gid != lowerSt.Gid {
+			continue
+		}
+
+		err = os.Remove(target)
+		if err != nil {
+			return nil, err
+		}
+		pruned[p] = true
+	}
+
+	var left fsdiffer.FSChanges
+	for _, c := range changes {
+		if !pruned[c.Path] {
+			left = append(left, c)
+		}
+	}
+	return left, nil
+}
+
+// ociLowerLayerPaths returns the paths of the expanded layers of the OCI image,
+// from the top down, except for the one at exclude. The layers are extracted
+// first if need be.
+func (a *ACBuild) ociLowerLayerPaths(exclude string) ([]string, error) {
+	layerPaths, err := a.generateOverlayPathsOCI()
+	if err != nil {
+		return nil, err
+	}
+	var lowers []string
+	for i := len(layerPaths) - 1; i >= 0; i-- {
+		if layerPaths[i] != exclude {
+			lowers = append(lowers, layerPaths[i])
+		}
+	}
+	return lowers, nil
+}
+
+// mkdirAllInLayer creates the directory dir in the expanded OCI layer at
+// layerPath, along with any missing parents. Directories that the image's other
+// layers already have are created with the same permissions, ownership and
+// modification time, so that the layer doesn't change them. Others are created
+// with mode 0755, and if the layer records them as deleted they hide what the
+// other layers have in them.
+func (a *ACBuild) mkdirAllInLayer(layerPath, dir string) error {
+	var missing []string
+	// Directories the layer records as deleted, which have to replace the
+	// whiteouts and hide what the lower layers still have in them.
+	deleted := make(map[string]bool)
+	for d := path.Clean("/" + dir); d != "/"; d = path.Dir(d) {
+		info, err := os.Lstat(path.Join(layerPath, d))
+		if err == nil && util.IsOverlayWhiteout(info) {
+			deleted[d] = true
+			missing = append(missing, d)
+			continue
+		}
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", d)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	lowers, err := a.ociLowerLayerPaths(layerPath)
+	if err != nil {
+		return err
+	}
+	infos := make(map[string]os.FileInfo)
+	for i := len(missing) - 1; i >= 0; i-- {
+		d := missing[i]
+		target := path.Join(layerPath, d)
+		if deleted[d] {
+			err = os.Remove(target)
+			if err != nil {
+				return err
+			}
+			err = os.Mkdir(target, 0755)
+			if err != nil {
+				return err
+			}
+			err = util.SetOverlayOpaque(target)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var info os.FileInfo
+		for _, lower := range lowers {
+			lowerInfo, err := os.Lstat(path.Join(lower, d))
+			if err == nil {
+				if lowerInfo.IsDir() {
+					info = lowerInfo
+				}
+				break
+			}
+		}
+
+		if info == nil {
+			err = os.Mkdir(target, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.Mkdir(target, 0700)
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			err = os.Lchown(target, int(st.Uid), int(st.Gid))
+			if err != nil {
+				return err
+			}
+		}
+		// Chmod after chown, which can clear the setgid bit
+		err = os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		if err != nil {
+			return err
+		}
+		infos[target] = info
+	}
+	// Creating a directory changes its parent's modification time, so
+	// restore them once they're all there.
+	for _, d := range missing {
+		target := path.Join(layerPath, d)
+		if info, ok := infos[target]; ok {
+			err = os.Chtimes(target, info.ModTime(), info.ModTime())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -278,6 +278,51 @@ func (a *ACBuild) RemoveDependency(imageName string) (err error) {
 	}
 	return fmt.Errorf("dependencies only supported in appc builds")
 }
+func (a *ACBuild) AddPathWhitelist(paths ...string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+	switch m := a.man.(type) {
+	case *appc.Manifest:
+		return m.AddPathWhitelist(paths...)
+	}
+	return fmt.Errorf("path whitelists only supported in appc builds")
+}
+func (a *ACBuild) RemovePathWhitelist(path string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+	switch m := a.man.(type) {
+	case *appc.Manifest:
+		return m.RemovePathWhitelist(path)
+	}
+	return fmt.Errorf("path whitelists only supported in appc builds")
+}
+func (a *ACBuild) ClearPathWhitelist() (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+	switch m := a.man.(type) {
+	case *appc.Manifest:
+		return m.SetPathWhitelist(nil)
+	}
+	return fmt.Errorf("path whitelists only supported in appc builds")
+}
 func (a *ACBuild) AddIsolator(name string, value []byte) (err error) {
 	if err = a.lock(); err != nil {
 		return err
@@ -0,0 +1,173 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The vendored image-spec predates the 1.0 image layout, in which an
+// index.json file lists the image's manifests in place of the refs directory,
+// so the parts of it acbuild needs are defined here.
+const (
+	// IndexFile is the name of the image index in an image layout.
+	IndexFile = "index.json"
+	// LayoutFile is the name of the file marking a directory as an image
+	// layout.
+	LayoutFile = "oci-layout"
+	// LayoutVersion is the version of the image layout acbuild writes.
+	LayoutVersion = "1.0.0"
+	// legacyRefsDir holds a descriptor file for each of the manifests in a
+	// pre-1.0 image layout, named after its ref.
+	legacyRefsDir = "refs"
+
+	// MediaTypeImageIndex is the media type of an image index.
+	MediaTypeImageIndex = "application/vnd.oci.image.index.v1+json"
+	// AnnotationRefName is the annotation on a manifest in the index that
+	// holds its ref, such as "latest".
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+
+	// DefaultRefName is the ref of images that don't have one.
+	DefaultRefName = "latest"
+
+	// MediaTypeImageLayerUncompressed is the media type of layers that are
+	// plain tar files, which the vendored image-spec doesn't have either.
+	MediaTypeImageLayerUncompressed = "application/vnd.oci.image.layer.v1.tar"
+	// MediaTypeImageLayerZstd is the media type of zstd compressed layers.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+	// MediaTypeImageLayerXz is the media type acbuild gives xz compressed
+	// layers. The image-spec doesn't define one, so other tools may not
+	// accept them.
+	MediaTypeImageLayerXz = "application/vnd.oci.image.layer.v1.tar+xz"
+)
+
+// Index is an image index, as found in the index.json file of an image layout.
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []IndexDescriptor `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// IndexDescriptor is a descriptor of a manifest in an image index.
+type IndexDescriptor struct {
+	ociImage.Descriptor
+	Platform    *ociImage.Platform `json:"platform,omitempty"`
+	Annotations map[string]string  `json:"annotations,omitempty"`
+}
+
+// RefName returns the ref of the manifest d describes, or "" if it has none.
+func (d IndexDescriptor) RefName() string {
+	return d.Annotations[AnnotationRefName]
+}
+
+// ReadIndex returns the index of the image layout at ociPath. Pre-1.0 layouts
+// without an index.json file have one made up from their refs directory.
+func ReadIndex(ociPath string) (*Index, error) {
+	blob, err := ioutil.ReadFile(path.Join(ociPath, IndexFile))
+	if os.IsNotExist(err) {
+		return readLegacyRefs(ociPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", IndexFile, err)
+	}
+	return &idx, nil
+}
+
+func readLegacyRefs(ociPath string) (*Index, error) {
+	refDir := path.Join(ociPath, legacyRefsDir)
+	refFileInfos, err := ioutil.ReadDir(refDir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("image has neither an %s file nor a %s directory", IndexFile, legacyRefsDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageIndex,
+	}
+	for _, info := range refFileInfos {
+		refBlob, err := ioutil.ReadFile(path.Join(refDir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var d IndexDescriptor
+		err = json.Unmarshal(refBlob, &d.Descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if d.MediaType == "" {
+			d.MediaType = ociImage.MediaTypeImageManifest
+		}
+		d.Annotations = map[string]string{AnnotationRefName: info.Name()}
+		idx.Manifests = append(idx.Manifests, d)
+	}
+	return idx, nil
+}
+
+// WriteIndex writes idx to the image layout at ociPath, along with the
+// oci-layout file. The refs directory of a pre-1.0 layout is removed, as
+// its contents are now in the index.
+func WriteIndex(ociPath string, idx *Index) error {
+	layoutBlob, err := json.Marshal(ociImage.ImageLayout{Version: LayoutVersion})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(ociPath, LayoutFile), layoutBlob, 0644)
+	if err != nil {
+		return err
+	}
+
+	idx.SchemaVersion = 2
+	idx.MediaType = MediaTypeImageIndex
+	blob, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(ociPath, IndexFile), blob, 0644)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(ociPath, legacyRefsDir))
+}
+
+// IsLayout returns whether the directory at dir holds an image layout, of
+// either the 1.0 or the pre-1.0 kind.
+func IsLayout(dir string) bool {
+	for _, f := range []string{LayoutFile, "blobs"} {
+		if _, err := os.Stat(path.Join(dir, f)); err != nil {
+			return false
+		}
+	}
+	for _, f := range []string{IndexFile, legacyRefsDir} {
+		if _, err := os.Stat(path.Join(dir, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
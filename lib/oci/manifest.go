@@ -41,44 +41,41 @@ type Image struct {
 	config   ociImage.Image
 	manifest ociImage.Manifest
 	ref      ociImage.Descriptor
+	// index is the image's index, and entry is the position of ref in it.
+	index *Index
+	entry int
 }
 
 func LoadImage(ociPath string) (*Image, error) {
 	i := &Image{
 		ociPath: ociPath,
-		refName: "latest",
+		refName: DefaultRefName,
 	}
 
-	refDir := path.Join(ociPath, "refs")
 	blobDir := path.Join(ociPath, "blobs")
 
-	// Look for refs
-	refFileInfos, err := ioutil.ReadDir(refDir)
+	idx, err := ReadIndex(ociPath)
 	if err != nil {
 		return nil, err
 	}
-	if len(refFileInfos) == 0 {
-		return nil, fmt.Errorf("no refs found in image")
-	}
-	// We need to pick a ref, if there's more than one we don't know which one
-	// the user wishes to modify. Let's just pick the first one.
-	i.refName = path.Base(refFileInfos[0].Name())
-
-	// Open the ref file, read it, unmarshal it, and parse the manifest's
-	// hash
-	refFile, err := os.OpenFile(path.Join(refDir, i.refName), os.O_RDWR, 0644)
-	if err != nil {
-		return nil, err
+	// We need to pick a manifest, if there's more than one we don't know which
+	// one the user wishes to modify. Let's just pick the first one.
+	i.entry = -1
+	for n, d := range idx.Manifests {
+		if d.MediaType == ociImage.MediaTypeImageManifest {
+			i.entry = n
+			break
+		}
 	}
-	defer refFile.Close()
-	refBlob, err := ioutil.ReadAll(refFile)
-	if err != nil {
-		return nil, err
+	if i.entry == -1 {
+		return nil, fmt.Errorf("no image manifests found in image")
 	}
-	err = json.Unmarshal(refBlob, &i.ref)
-	if err != nil {
-		return nil, err
+	i.index = idx
+	i.ref = idx.Manifests[i.entry].Descriptor
+	if name := idx.Manifests[i.entry].RefName(); name != "" {
+		i.refName = name
 	}
+
 	manifestHashAlgo, manifestHash, err := splitHash(i.ref.Digest)
 	if err != nil {
 		return nil, err
@@ -157,34 +154,41 @@ func (i *Image) save() error {
 		return err
 	}
 	// Save the new manifest
+	if i.manifest.MediaType == "" {
+		i.manifest.MediaType = ociImage.MediaTypeImageManifest
+	}
 	manifestHashAlgo, manifestHash, manifestSize, err := util.MarshalHashAndWrite(i.ociPath, i.manifest)
 	if err != nil {
 		return err
 	}
+	i.ref.MediaType = ociImage.MediaTypeImageManifest
 	i.ref.Digest = manifestHashAlgo + ":" + manifestHash
 	i.ref.Size = int64(manifestSize)
 
-	// Remove any old refs
-	err = os.RemoveAll(path.Join(i.ociPath, "refs"))
-	if err != nil {
-		return err
-	}
-	err = os.Mkdir(path.Join(i.ociPath, "refs"), 0755)
-	if err != nil {
-		return err
-	}
+	return i.saveIndex()
+}
 
-	// Write the ref
-	refBlob, err := json.Marshal(i.ref)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(path.Join(i.ociPath, "refs", i.refName), refBlob, 0644)
-	if err != nil {
-		return err
-	}
+// Migrate writes the image out in the image-spec 1.0 layout, which converts
+// images that use the pre-1.0 refs directory.
+func (i *Image) Migrate() error {
+	return i.saveIndex()
+}
 
-	return nil
+func (i *Image) saveIndex() error {
+	d := &i.index.Manifests[i.entry]
+	d.Descriptor = i.ref
+	if d.Annotations == nil {
+		d.Annotations = make(map[string]string)
+	}
+	d.Annotations[AnnotationRefName] = i.refName
+	// Only what the config says is kept up to date, so anything else about
+	// the platform, like its variant, is preserved
+	if d.Platform == nil {
+		d.Platform = &ociImage.Platform{}
+	}
+	d.Platform.Architecture = i.config.Architecture
+	d.Platform.OS = i.config.OS
+	return WriteIndex(i.ociPath, i.index)
 }
 
 func (i *Image) GetConfig() ociImage.Image {
@@ -199,6 +203,11 @@ func (i *Image) GetRef() ociImage.Descriptor {
 	return i.ref
 }
 
+// GetRefName returns the ref the image's manifest has in the index.
+func (i *Image) GetRefName() string {
+	return i.refName
+}
+
 func (i *Image) GetDiffIDs() []string {
 	return i.config.RootFS.DiffIDs
 }
@@ -240,7 +249,7 @@ func (i *Image) Print(w io.Writer, prettyPrint, printConfig bool) error {
 	return nil
 }
 
-func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int64) (string, error) {
+func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int64, mediaType string) (string, error) {
 	var oldLayerDigest string
 	layerDigest = digestAlgo + ":" + layerDigest
 	diffId = digestAlgo + ":" + diffId
@@ -254,7 +263,7 @@ func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int6
 	}
 
 	layerDescriptor := ociImage.Descriptor{
-		MediaType: ociImage.MediaTypeImageLayer,
+		MediaType: mediaType,
 		Digest:    layerDigest,
 		Size:      size,
 	}
@@ -270,7 +279,7 @@ func (i *Image) UpdateTopLayer(digestAlgo, layerDigest, diffId string, size int6
 	return oldLayerDigest, i.save()
 }
 
-func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId string, size int64) error {
+func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId string, size int64, mediaType string) error {
 	layerDigest = digestAlgo + ":" + layerDigest
 	diffId = digestAlgo + ":" + diffId
 	if len(i.config.RootFS.DiffIDs) == 0 {
@@ -284,7 +293,7 @@ func (i *Image) NewTopLayer(digestAlgo, layerDigest, diffId string, size int64)
 
 	layerDescriptor :=
 		ociImage.Descriptor{
-			MediaType: ociImage.MediaTypeImageLayer,
+			MediaType: mediaType,
 			Digest:    layerDigest,
 			Size:      size,
 		}
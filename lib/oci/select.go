@@ -0,0 +1,208 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strings"
+
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ParsePlatform parses a platform given as os/arch or os/arch/variant, such
+// as "linux/arm64" or "linux/arm/v7".
+func ParsePlatform(s string) (*ociImage.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", s)
+	}
+	p := &ociImage.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// CurrentPlatform returns the platform acbuild is running on.
+func CurrentPlatform() *ociImage.Platform {
+	return &ociImage.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// PlatformString returns p in the form ParsePlatform accepts.
+func PlatformString(p *ociImage.Platform) string {
+	if p == nil {
+		return "unknown platform"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// MatchesPlatform returns whether p is the platform want. The variant is only
+// compared if want has one.
+func MatchesPlatform(p, want *ociImage.Platform) bool {
+	if p == nil || p.OS != want.OS || p.Architecture != want.Architecture {
+		return false
+	}
+	return want.Variant == "" || p.Variant == want.Variant
+}
+
+// SelectManifest reduces the index of the image layout at ociPath to the
+// manifest of the image with the given ref name and platform, either of which
+// may be empty to match any. Indexes the index refers to, such as the ones
+// for multi-platform images, are looked into for the manifest, using the
+// platform acbuild runs on if platform is nil. If neither ref nor platform are
+// given, the first manifest is used, otherwise an error is returned unless
+// exactly one manifest matches.
+func SelectManifest(ociPath, ref string, platform *ociImage.Platform) error {
+	idx, err := ReadIndex(ociPath)
+	if err != nil {
+		return err
+	}
+
+	var candidates []IndexDescriptor
+	for _, d := range idx.Manifests {
+		if ref != "" && d.RefName() != ref {
+			continue
+		}
+		switch d.MediaType {
+		case ociImage.MediaTypeImageManifest:
+			if d.Platform == nil {
+				d.Platform, err = manifestPlatform(ociPath, d.Descriptor)
+				if err != nil {
+					return err
+				}
+			}
+			candidates = append(candidates, d)
+		case MediaTypeImageIndex, ociImage.MediaTypeImageManifestList:
+			nested, err := readNestedIndex(ociPath, d.Descriptor)
+			if err != nil {
+				return err
+			}
+			want := platform
+			if want == nil {
+				want = CurrentPlatform()
+			}
+			for _, n := range nested.Manifests {
+				if n.MediaType == ociImage.MediaTypeImageManifest && MatchesPlatform(n.Platform, want) {
+					n.Annotations = d.Annotations
+					candidates = append(candidates, n)
+				}
+			}
+		}
+	}
+
+	var matches []IndexDescriptor
+	for _, d := range candidates {
+		if platform == nil || MatchesPlatform(d.Platform, platform) {
+			matches = append(matches, d)
+		}
+	}
+	switch {
+	case len(matches) == 0 && ref == "" && platform == nil:
+		return fmt.Errorf("no image for %s in the image layout, it has %s", PlatformString(CurrentPlatform()), describeImages(ociPath, idx))
+	case len(matches) == 0:
+		return fmt.Errorf("no image with %s in the image layout, it has %s", DescribeSelection(ref, platform), describeImages(ociPath, idx))
+	case len(matches) > 1 && (ref != "" || platform != nil):
+		return fmt.Errorf("%d images with %s in the image layout, choose one of %s", len(matches), DescribeSelection(ref, platform), describeImages(ociPath, idx))
+	}
+	idx.Manifests = matches[:1]
+	return WriteIndex(ociPath, idx)
+}
+
+// DescribeSelection describes the ref and platform an image was chosen by,
+// for error messages.
+func DescribeSelection(ref string, platform *ociImage.Platform) string {
+	var parts []string
+	if ref != "" {
+		parts = append(parts, fmt.Sprintf("ref %q", ref))
+	}
+	if platform != nil {
+		parts = append(parts, "platform "+PlatformString(platform))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// describeImages lists the refs and platforms of the manifests in idx, for
+// error messages.
+func describeImages(ociPath string, idx *Index) string {
+	var images []string
+	for _, d := range idx.Manifests {
+		p := d.Platform
+		if p == nil && d.MediaType == ociImage.MediaTypeImageManifest {
+			p, _ = manifestPlatform(ociPath, d.Descriptor)
+		}
+		desc := PlatformString(p)
+		if p == nil && d.MediaType != ociImage.MediaTypeImageManifest {
+			desc = "multiple platforms"
+		}
+		images = append(images, fmt.Sprintf("%q (%s)", d.RefName(), desc))
+	}
+	if len(images) == 0 {
+		return "none"
+	}
+	return strings.Join(images, ", ")
+}
+
+func readBlob(ociPath string, d ociImage.Descriptor) ([]byte, error) {
+	algo, hash, err := splitHash(d.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path.Join(ociPath, "blobs", algo, hash))
+}
+
+func readNestedIndex(ociPath string, d ociImage.Descriptor) (*Index, error) {
+	blob, err := readBlob(ociPath, d)
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index %s: %v", d.Digest, err)
+	}
+	return &idx, nil
+}
+
+// manifestPlatform returns the platform of the image whose manifest d
+// describes, from its config.
+func manifestPlatform(ociPath string, d ociImage.Descriptor) (*ociImage.Platform, error) {
+	blob, err := readBlob(ociPath, d)
+	if err != nil {
+		return nil, err
+	}
+	var man ociImage.Manifest
+	err = json.Unmarshal(blob, &man)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", d.Digest, err)
+	}
+	blob, err = readBlob(ociPath, man.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config ociImage.Image
+	err = json.Unmarshal(blob, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %v", man.Config.Digest, err)
+	}
+	return &ociImage.Platform{OS: config.OS, Architecture: config.Architecture}, nil
+}
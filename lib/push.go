@@ -0,0 +1,348 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/registry/docker"
+	"github.com/containers/build/util"
+
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociImage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PushOptions holds the settings for pushing an image to a registry.
+type PushOptions struct {
+	// Insecure allows pushing over plain HTTP or to registries with
+	// certificates that can't be verified.
+	Insecure bool
+	// CredentialsFile is a file in the format of docker's config.json with
+	// the credentials for the registry. Registries are accessed anonymously
+	// if it's empty.
+	CredentialsFile string
+	// ChunkSize is the size of the chunks large blobs are uploaded in, or 0
+	// for the default.
+	ChunkSize int64
+	// MountFrom is another repository on the registry that the image's blobs
+	// are mounted from, rather than uploaded, if it has them.
+	MountFrom string
+}
+
+// Push uploads the image from the current build to the registry and
+// repository target refers to, under its tag, and returns the digest of the
+// image's manifest. Blobs the repository already has are skipped. appc builds
+// have their image converted to an OCI image with a single layer first.
+func (a *ACBuild) Push(target string, opts PushOptions) (dgst string, err error) {
+	if err = a.lock(); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	ref, err := docker.ParseReference(target)
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return "", fmt.Errorf("can't push to %s, images are pushed to a tag", target)
+	}
+	client := docker.NewClient(opts.Insecure)
+	client.ChunkSize = opts.ChunkSize
+	if opts.CredentialsFile != "" {
+		client.Credentials, err = docker.LoadCredentials(opts.CredentialsFile)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var img *oci.Image
+	ociPath := a.CurrentImagePath
+	switch a.Mode {
+	case BuildModeAppC:
+		ociPath = path.Join(a.ContextPath, "push-oci")
+		defer os.RemoveAll(ociPath)
+		img, err = a.appcToOCI(ociPath)
+		if err != nil {
+			return "", fmt.Errorf("error converting image to OCI: %v", err)
+		}
+	case BuildModeOCI:
+		var ok bool
+		img, ok = a.man.(*oci.Image)
+		if !ok {
+			return "", fmt.Errorf("internal error: mismatched manifest type and build mode???")
+		}
+	}
+
+	baseRepo, err := a.baseRepository(ref.Registry)
+	if err != nil {
+		return "", err
+	}
+	man := img.GetManifest()
+	blobs := append([]ociImage.Descriptor{man.Config}, man.Layers...)
+	for _, desc := range blobs {
+		from := opts.MountFrom
+		if baseRepo != "" {
+			base, err := a.isBaseLayer(desc.Digest)
+			if err != nil {
+				return "", err
+			}
+			if base {
+				from = baseRepo
+			}
+		}
+		err := a.pushBlob(client, ref, ociPath, desc, from)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	manBlob, err := ioutil.ReadFile(layoutBlobPath(ociPath, img.GetRef().Digest))
+	if err != nil {
+		return "", err
+	}
+	return client.PutManifest(ref, ociImage.MediaTypeImageManifest, manBlob)
+}
+
+// pushBlob pushes the blob desc describes from the image layout at ociPath to
+// the repository of ref, mounting it from the repository from if that's set.
+func (a *ACBuild) pushBlob(client *docker.Client, ref docker.Reference, ociPath string, desc ociImage.Descriptor, from string) error {
+	f, err := os.Open(layoutBlobPath(ociPath, desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	how, err := client.PushBlob(ref, desc.Digest, desc.Size, f, from)
+	if err != nil {
+		return err
+	}
+	if a.Debug {
+		fmt.Fprintf(os.Stderr, "Pushing blob %s: %s\n", desc.Digest, how)
+	}
+	return nil
+}
+
+// baseRepository returns the repository of the upstream image the build began
+// from, if it came from registry, or "" otherwise.
+func (a *ACBuild) baseRepository(registry string) (string, error) {
+	blob, err := ioutil.ReadFile(path.Join(a.ContextPath, baseRepositoryFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	base := strings.TrimSpace(string(blob))
+	if !strings.HasPrefix(base, registry+"/") {
+		return "", nil
+	}
+	return strings.TrimPrefix(base, registry+"/"), nil
+}
+
+// layoutBlobPath returns where the blob with the given digest is in the image
+// layout at ociPath.
+func layoutBlobPath(ociPath, digest string) string {
+	algo, hash, err := util.SplitOCILayerID(digest)
+	if err != nil {
+		return path.Join(ociPath, "blobs", digest)
+	}
+	return path.Join(ociPath, "blobs", algo, hash)
+}
+
+// appcToOCI writes the ACI of the build out as an OCI image layout at ociPath,
+// with the ACI's rootfs as the image's only layer, and the parts of its app
+// the OCI image config has room for in the config.
+func (a *ACBuild) appcToOCI(ociPath string) (*oci.Image, error) {
+	man, err := util.GetManifest(a.CurrentImagePath)
+	if err != nil {
+		return nil, err
+	}
+	err = util.RmAndMkdir(ociPath)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(path.Join(ociPath, "blobs", "sha256"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, diffID, err := writeRootfsLayer(ociPath, path.Join(a.CurrentImagePath, aci.RootfsDir), a.Compression, a.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	config := appcToOCIConfig(man)
+	config.RootFS = ociImage.RootFS{
+		Type:    "layers",
+		DiffIDs: []string{diffID},
+	}
+	configAlgo, configHash, configSize, err := util.MarshalHashAndWrite(ociPath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ociMan := ociImage.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: OCISchemaVersion,
+			MediaType:     ociImage.MediaTypeImageManifest,
+		},
+		Config: ociImage.Descriptor{
+			MediaType: ociImage.MediaTypeImageConfig,
+			Digest:    configAlgo + ":" + configHash,
+			Size:      int64(configSize),
+		},
+		Layers: []ociImage.Descriptor{layer},
+	}
+	manAlgo, manHash, manSize, err := util.MarshalHashAndWrite(ociPath, ociMan)
+	if err != nil {
+		return nil, err
+	}
+	err = oci.WriteIndex(ociPath, &oci.Index{
+		Manifests: []oci.IndexDescriptor{{
+			Descriptor: ociImage.Descriptor{
+				MediaType: ociImage.MediaTypeImageManifest,
+				Digest:    manAlgo + ":" + manHash,
+				Size:      int64(manSize),
+			},
+			Annotations: map[string]string{oci.AnnotationRefName: oci.DefaultRefName},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oci.LoadImage(ociPath)
+}
+
+// writeRootfsLayer writes the directory at rootfs as a layer compressed with c
+// at level into the image layout at ociPath, and returns a descriptor for it
+// along with its diffID.
+func writeRootfsLayer(ociPath, rootfs string, c util.Compression, level int) (ociImage.Descriptor, string, error) {
+	tmpFile, err := ioutil.TempFile(path.Join(ociPath, "blobs", "sha256"), "layer-")
+	if err != nil {
+		return ociImage.Descriptor{}, "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	digester := sha256.New()
+	diffIDer := sha256.New()
+	cw, err := util.NewCompressWriter(io.MultiWriter(tmpFile, digester), c, level)
+	if err != nil {
+		return ociImage.Descriptor{}, "", err
+	}
+	tw := tar.NewWriter(io.MultiWriter(cw, diffIDer))
+	err = filepath.Walk(rootfs, util.PathWalker(tw, rootfs))
+	if err == nil {
+		err = tw.Close()
+	}
+	if err1 := cw.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return ociImage.Descriptor{}, "", err
+	}
+	info, err := tmpFile.Stat()
+	if err != nil {
+		return ociImage.Descriptor{}, "", err
+	}
+
+	hash := hex.EncodeToString(digester.Sum(nil))
+	err = os.Rename(tmpFile.Name(), path.Join(ociPath, "blobs", "sha256", hash))
+	if err != nil {
+		return ociImage.Descriptor{}, "", err
+	}
+	desc := ociImage.Descriptor{
+		MediaType: layerMediaType(c),
+		Digest:    "sha256:" + hash,
+		Size:      info.Size(),
+	}
+	return desc, "sha256:" + hex.EncodeToString(diffIDer.Sum(nil)), nil
+}
+
+// appcArchs maps the appc names of architectures that differ from the Go ones
+// OCI images use to them.
+var appcArchs = map[string]string{
+	"i386":    "386",
+	"aarch64": "arm64",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"armv7b":  "armbe",
+}
+
+// appcToOCIConfig returns an OCI image config for the ACI with the manifest
+// man, without its rootfs.
+func appcToOCIConfig(man *schema.ImageManifest) ociImage.Image {
+	config := ociImage.Image{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+	if osName, ok := man.Labels.Get("os"); ok {
+		config.OS = osName
+	}
+	if arch, ok := man.Labels.Get("arch"); ok {
+		config.Architecture = arch
+		if goArch, ok := appcArchs[arch]; ok {
+			config.Architecture = goArch
+		}
+	}
+
+	app := man.App
+	if app == nil {
+		return config
+	}
+	if len(app.Exec) > 0 {
+		config.Config.Entrypoint = app.Exec[:1]
+	}
+	if len(app.Exec) > 1 {
+		config.Config.Cmd = app.Exec[1:]
+	}
+	config.Config.User = app.User
+	if app.Group != "" {
+		config.Config.User += ":" + app.Group
+	}
+	for _, env := range app.Environment {
+		config.Config.Env = append(config.Config.Env, env.Name+"="+env.Value)
+	}
+	config.Config.WorkingDir = app.WorkingDirectory
+	for _, p := range app.Ports {
+		if config.Config.ExposedPorts == nil {
+			config.Config.ExposedPorts = make(map[string]struct{})
+		}
+		config.Config.ExposedPorts[fmt.Sprintf("%d/%s", p.Port, p.Protocol)] = struct{}{}
+	}
+	for _, mp := range app.MountPoints {
+		if config.Config.Volumes == nil {
+			config.Config.Volumes = make(map[string]struct{})
+		}
+		config.Config.Volumes[mp.Path] = struct{}{}
+	}
+	return config
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/containers/build/util"
+)
+
+// HostFilePolicy controls what happens to a file from the host when running a
+// command.
+type HostFilePolicy string
+
+const (
+	// HostFileInject makes a copy of the host's file available in the
+	// container for the duration of the run only. Changes the command makes to
+	// it are thrown away, and the image keeps whatever it had at that path.
+	HostFileInject = HostFilePolicy("inject")
+	// HostFilePersist copies the host's file into the image, replacing what
+	// was there before.
+	HostFilePersist = HostFilePolicy("persist")
+	// HostFileSkip leaves the image's file alone.
+	HostFileSkip = HostFilePolicy("skip")
+)
+
+// HostFiles maps the names of the host files that can be made available to a
+// run to their paths, which are the same on the host and in the container.
+var HostFiles = map[string]string{
+	"resolv.conf": "/etc/resolv.conf",
+	"hosts":       "/etc/hosts",
+	"hostname":    "/etc/hostname",
+	"localtime":   "/etc/localtime",
+	"machine-id":  "/etc/machine-id",
+}
+
+// DefaultHostFilePolicy is the policy for host files that RunOptions.HostFiles
+// doesn't mention.
+const DefaultHostFilePolicy = HostFileInject
+
+// HostFileNames returns the names of the host files in HostFiles, sorted.
+func HostFileNames() []string {
+	var names []string
+	for name := range HostFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mountHostFiles applies the given policies to the host files in HostFiles
+// for the container root at chrootDir, and returns a function to undo
+// everything that isn't meant to persist. Injected files are copied to a
+// temporary directory on the host and bind mounted from there, so the command
+// can't change the host's files, and the image never sees them. Files missing
+// on the host are injected as empty files.
+//
+// Bind mounting requires root, so if we aren't root injecting is the same as
+// skipping.
+func (a *ACBuild) mountHostFiles(chrootDir string, policies map[string]HostFilePolicy) (unmount func() error, err error) {
+	for name, policy := range policies {
+		if _, ok := HostFiles[name]; !ok {
+			return nil, fmt.Errorf("unknown host file %q", name)
+		}
+		switch policy {
+		case HostFileInject, HostFilePersist, HostFileSkip:
+		default:
+			return nil, fmt.Errorf("unknown policy %q for host file %q", policy, name)
+		}
+	}
+
+	var mounted, created []string
+	var tmpDir string
+	unmount = func() error {
+		var firstErr error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			err := syscall.Unmount(mounted[i], 0)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error unmounting %s: %v", mounted[i], err)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+		return firstErr
+	}
+	defer func() {
+		if err != nil {
+			unmount()
+		}
+	}()
+
+	for _, name := range HostFileNames() {
+		filePath := HostFiles[name]
+		policy, ok := policies[name]
+		if !ok {
+			policy = DefaultHostFilePolicy
+		}
+		if policy == HostFileInject && os.Geteuid() != 0 {
+			policy = HostFileSkip
+		}
+
+		switch policy {
+		case HostFileInject:
+			if tmpDir == "" {
+				tmpDir, err = ioutil.TempDir("", "acbuild-hostfiles")
+				if err != nil {
+					return nil, err
+				}
+			}
+			source := filepath.Join(tmpDir, name)
+			err = copyHostFile(filePath, source)
+			if err != nil {
+				return nil, err
+			}
+
+			target, err := util.ResolveInRoot(chrootDir, filePath)
+			if err != nil {
+				return nil, err
+			}
+			if info, err := os.Stat(target); err == nil && info.IsDir() {
+				// Not something we know what to do with
+				continue
+			}
+			newPaths, err := makeMountpoint(target, false)
+			created = append(created, newPaths...)
+			if err != nil {
+				return nil, err
+			}
+			err = syscall.Mount(source, target, "", syscall.MS_BIND, "")
+			if err != nil {
+				return nil, fmt.Errorf("error mounting %s: %v", filePath, err)
+			}
+			mounted = append(mounted, target)
+		case HostFilePersist:
+			// Replace the file itself rather than whatever it links to, which
+			// could be shared with other paths in the image.
+			dir, err := util.ResolveInRoot(chrootDir, filepath.Dir(filePath))
+			if err != nil {
+				return nil, err
+			}
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				return nil, err
+			}
+			target := filepath.Join(dir, filepath.Base(filePath))
+			err = os.Remove(target)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			err = copyHostFile(filePath, target)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return unmount, nil
+}
+
+// copyHostFile copies the contents of the file at src on the host to a new file
+// at dst, following symlinks. If src doesn't exist dst is left empty.
+func copyHostFile(src, dst string) error {
+	blob, err := ioutil.ReadFile(src)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(dst, blob, 0644)
+}
@@ -0,0 +1,293 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containers/build/engine"
+)
+
+var (
+	// ErrRunTimeout is returned by Run when the command was killed for
+	// running longer than RunLimits.Timeout.
+	ErrRunTimeout = fmt.Errorf("command was killed after reaching its time limit")
+	// ErrRunMemoryLimit is returned by Run when the command failed after
+	// processes in it were killed for exceeding RunLimits.Memory.
+	ErrRunMemoryLimit = fmt.Errorf("command failed after reaching its memory limit")
+	// ErrRunPidsLimit is returned by Run when the command failed after it
+	// tried to exceed RunLimits.Pids.
+	ErrRunPidsLimit = fmt.Errorf("command failed after reaching its process limit")
+)
+
+// cpuPeriod is the period in microseconds that the CPU quota is applied to.
+const cpuPeriod = 100000
+
+// RunLimits are the resources a command can use. A zero value for any of them
+// means no limit.
+type RunLimits struct {
+	// Memory is the maximum amount of memory in bytes. Swap isn't used.
+	Memory int64
+	// CPUs is the number of CPUs worth of time the command can use.
+	CPUs float64
+	// Pids is the maximum number of processes and threads.
+	Pids int64
+	// Timeout is how long the command can run before it is killed.
+	Timeout time.Duration
+}
+
+func (l RunLimits) isSet() bool {
+	return l.Memory != 0 || l.CPUs != 0 || l.Pids != 0 || l.Timeout != 0
+}
+
+func (l RunLimits) controllers() []string {
+	var controllers []string
+	if l.Memory != 0 {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPUs != 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if l.Pids != 0 {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// runCgroup is a transient cgroup v2 that the engine runs a command in, so
+// that every process it starts is accounted to it. acbuild itself stays out of
+// it, so that neither its threads nor its memory count against the limits.
+type runCgroup struct {
+	path string
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	timedOut bool
+}
+
+// withLimits calls f with the path of a cgroup with the limits applied, which
+// f is to run the command in, or "" if there are no limits. If any process is
+// left over in the cgroup once f returns, it is killed.
+func withLimits(limits RunLimits, f func(cgroup string) error) error {
+	if !limits.isSet() {
+		return f("")
+	}
+	if limits.Memory < 0 || limits.CPUs < 0 || limits.Pids < 0 || limits.Timeout < 0 {
+		return fmt.Errorf("resource limits can't be negative")
+	}
+
+	cg, err := newRunCgroup(limits)
+	if err != nil {
+		return err
+	}
+	if limits.Timeout != 0 {
+		cg.timer = time.AfterFunc(limits.Timeout, cg.timeout)
+	}
+
+	runErr := f(cg.path)
+
+	if cg.timer != nil {
+		cg.timer.Stop()
+	}
+	cg.killAll()
+	defer cg.remove()
+
+	cg.mu.Lock()
+	timedOut := cg.timedOut
+	cg.mu.Unlock()
+	switch {
+	case timedOut:
+		return ErrRunTimeout
+	case runErr == nil:
+		return nil
+	case cg.eventCount("memory.events", "oom_kill") > 0:
+		return ErrRunMemoryLimit
+	case cg.eventCount("pids.events", "max") > 0:
+		return ErrRunPidsLimit
+	}
+	return runErr
+}
+
+// newRunCgroup creates a cgroup with the given limits, next to the one acbuild
+// is running in.
+func newRunCgroup(limits RunLimits) (*runCgroup, error) {
+	mountpoint, err := engine.Cgroup2Mountpoint()
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentCgroup2()
+	if err != nil {
+		return nil, err
+	}
+
+	// Processes can only be in leaf cgroups, so the new cgroup can't go
+	// under the current one unless that's the root.
+	parent := current
+	if current != "/" {
+		parent = path.Dir(current)
+	}
+	parentPath := path.Join(mountpoint, parent)
+	for _, c := range limits.controllers() {
+		err := enableController(parentPath, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cg := &runCgroup{
+		path: path.Join(parentPath, fmt.Sprintf("acbuild-run-%d", os.Getpid())),
+	}
+	err = os.Mkdir(cg.path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("error creating cgroup: %v", err)
+	}
+
+	settings := make(map[string]string)
+	if limits.Memory != 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.Memory, 10)
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.CPUs != 0 {
+		quota := int64(limits.CPUs * cpuPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+		settings["cpu.max"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+	if limits.Pids != 0 {
+		settings["pids.max"] = strconv.FormatInt(limits.Pids, 10)
+	}
+	for file, value := range settings {
+		err := ioutil.WriteFile(path.Join(cg.path, file), []byte(value), 0644)
+		if file == "memory.swap.max" && os.IsNotExist(err) {
+			// The kernel was built without swap accounting
+			continue
+		}
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("error setting %s: %v", file, err)
+		}
+	}
+	return cg, nil
+}
+
+func (cg *runCgroup) timeout() {
+	cg.mu.Lock()
+	cg.timedOut = true
+	cg.mu.Unlock()
+	cg.killAll()
+}
+
+// killAll kills every process in the cgroup, until there are none left.
+func (cg *runCgroup) killAll() {
+	for i := 0; i < 100; i++ {
+		pids, err := cg.pids()
+		if err != nil || len(pids) == 0 {
+			return
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (cg *runCgroup) pids() ([]int, error) {
+	blob, err := ioutil.ReadFile(path.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(blob)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// eventCount returns the value of key in one of the cgroup's flat keyed
+// events files, or 0 if it can't be read.
+func (cg *runCgroup) eventCount(file, key string) int64 {
+	f, err := os.Open(path.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+func (cg *runCgroup) remove() {
+	// Killed processes can take a moment to be removed from the cgroup.
+	for i := 0; i < 100; i++ {
+		err := os.Remove(cg.path)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// currentCgroup2 returns the path of acbuild's cgroup in the v2 hierarchy.
+func currentCgroup2() (string, error) {
+	blob, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(blob), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("couldn't find cgroup v2 membership in /proc/self/cgroup")
+}
+
+// enableController makes the given controller available to the children of
+// the cgroup at cgroupPath.
+func enableController(cgroupPath, controller string) error {
+	blob, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	for _, c := range strings.Fields(string(blob)) {
+		if c == controller {
+			return nil
+		}
+	}
+	err = ioutil.WriteFile(path.Join(cgroupPath, "cgroup.subtree_control"), []byte("+"+controller), 0644)
+	if err != nil {
+		return fmt.Errorf("the %s cgroup controller can't be enabled for resource limits: %v", controller, err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/util"
+)
+
+// RunMountType is the kind of a mount made available to a single run.
+type RunMountType string
+
+const (
+	// RunMountBind mounts a directory or file from the host.
+	RunMountBind = RunMountType("bind")
+	// RunMountCache mounts a directory that is kept in the build context and
+	// shared between runs, but never becomes part of the image.
+	RunMountCache = RunMountType("cache")
+)
+
+var validCacheID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// RunMount describes something to be mounted into the container for the
+// duration of a single run.
+type RunMount struct {
+	Type RunMountType
+	// Source is the path on the host, for bind mounts.
+	Source string
+	// ID identifies the directory to use, for cache mounts. Runs that use the
+	// same ID see the same directory.
+	ID string
+	// Destination is the path inside of the container.
+	Destination string
+	ReadOnly    bool
+}
+
+// mountRunMounts mounts the given mounts into the container root at
+// chrootDir, and returns them for the engine along with a function to undo
+// this. Any mountpoints that had to
+// be created are removed again by the returned function, so that nothing from
+// the mounts ends up in the image.
+func (a *ACBuild) mountRunMounts(chrootDir string, mounts []RunMount) (engineMounts []engine.Mount, unmount func() error, err error) {
+	var mounted, created []string
+	unmount = func() error {
+		var firstErr error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			err := syscall.Unmount(mounted[i], 0)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error unmounting %s: %v", mounted[i], err)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			// This will fail if the command put something there, in which
+			// case it's meant to stay.
+			os.Remove(created[i])
+		}
+		return firstErr
+	}
+	defer func() {
+		if err != nil {
+			unmount()
+		}
+	}()
+
+	for _, m := range mounts {
+		var source string
+		switch m.Type {
+		case RunMountBind:
+			if m.Source == "" {
+				return nil, nil, fmt.Errorf("bind mount for %q has no source", m.Destination)
+			}
+			source, err = filepath.Abs(m.Source)
+			if err != nil {
+				return nil, nil, err
+			}
+		case RunMountCache:
+			if !validCacheID.MatchString(m.ID) {
+				return nil, nil, fmt.Errorf("invalid cache mount ID %q", m.ID)
+			}
+			source = path.Join(a.MountCachePath, m.ID)
+			err = os.MkdirAll(source, 0755)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown mount type %q", m.Type)
+		}
+		if !path.IsAbs(m.Destination) {
+			return nil, nil, fmt.Errorf("mount destination %q must be an absolute path", m.Destination)
+		}
+
+		sourceInfo, err := os.Stat(source)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		target, err := util.ResolveInRoot(chrootDir, m.Destination)
+		if err != nil {
+			return nil, nil, err
+		}
+		newPaths, err := makeMountpoint(target, sourceInfo.IsDir())
+		created = append(created, newPaths...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("error mounting %s: %v", m.Destination, err)
+		}
+		mounted = append(mounted, target)
+		engineMounts = append(engineMounts, engine.Mount{Source: source, Destination: path.Clean(m.Destination), ReadOnly: m.ReadOnly})
+
+		if m.ReadOnly {
+			err = syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+			if err != nil {
+				return nil, nil, fmt.Errorf("error making %s read-only: %v", m.Destination, err)
+			}
+		}
+	}
+	return engineMounts, unmount, nil
+}
+
+// makeMountpoint creates a directory or an empty file at target, along with
+// any missing parent directories, and returns everything it created from the
+// top down.
+func makeMountpoint(target string, isDir bool) ([]string, error) {
+	var missing []string
+	for p := target; ; p = filepath.Dir(p) {
+		_, err := os.Lstat(p)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append([]string{p}, missing...)
+	}
+
+	for i, p := range missing {
+		var err error
+		if i == len(missing)-1 && !isDir {
+			var f *os.File
+			f, err = os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err == nil {
+				f.Close()
+			}
+		} else {
+			err = os.Mkdir(p, 0755)
+		}
+		if err != nil {
+			return missing[:i], err
+		}
+	}
+	return missing, nil
+}
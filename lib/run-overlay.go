@@ -0,0 +1,417 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+	"github.com/coreos/rkt/pkg/user"
+
+	"github.com/containers/build/util"
+	"github.com/containers/build/util/fsdiffer"
+)
+
+// OverlayDriver is how the layers of an image are combined into the root
+// filesystem a command is run in.
+type OverlayDriver string
+
+const (
+	// OverlayAuto uses the kernel's overlayfs if it can, and otherwise
+	// fuse-overlayfs if it's installed, falling back to OverlayCopy.
+	OverlayAuto = OverlayDriver("auto")
+	// OverlayKernel mounts the layers with the kernel's overlayfs.
+	OverlayKernel = OverlayDriver("kernel")
+	// OverlayFuse mounts the layers with the fuse-overlayfs binary.
+	OverlayFuse = OverlayDriver("fuse-overlayfs")
+	// OverlayCopy copies the layers into a scratch directory, and afterwards
+	// copies what the command changed there into the top layer. It works
+	// anywhere, but is slow for large images.
+	OverlayCopy = OverlayDriver("copy")
+)
+
+// overlayfsMagic is the filesystem type statfs reports for overlayfs.
+const overlayfsMagic = 0x794c7630
+
+// mountLayers makes the layers in lowers, bottom first, available along with
+// the layer at upper on top of them as a single filesystem, and returns where
+// it is. The returned function unmounts it again, saving the changes made to
+// it in upper if save is true. It only does anything the first time it's
+// called.
+func (a *ACBuild) mountLayers(driver OverlayDriver, lowers []string, upper string) (string, func(save bool) error, error) {
+	switch driver {
+	case "", OverlayAuto:
+		driver = pickOverlayDriver(upper)
+		if a.Debug {
+			fmt.Fprintf(os.Stderr, "Using the %s overlay driver\n", driver)
+		}
+	}
+
+	var unmount func(save bool) error
+	switch driver {
+	case OverlayKernel:
+		err := mountKernelOverlay(a.OverlayTargetPath, lowers, upper, a.OverlayWorkPath)
+		if err != nil {
+			return "", nil, err
+		}
+		unmount = func(bool) error {
+			return syscall.Unmount(a.OverlayTargetPath, 0)
+		}
+	case OverlayFuse:
+		err := mountFuseOverlay(a.OverlayTargetPath, lowers, upper, a.OverlayWorkPath)
+		if err != nil {
+			return "", nil, err
+		}
+		unmount = func(bool) error {
+			err := unmountFuse(a.OverlayTargetPath)
+			if err != nil {
+				return err
+			}
+			// fuse-overlayfs falls back to OCI style whiteouts when it can't
+			// create overlayfs ones
+			return util.ConvertOCIWhiteouts(upper)
+		}
+	case OverlayCopy:
+		differ, err := mergeLayers(a.OverlayTargetPath, append(append([]string{}, lowers...), upper))
+		if err != nil {
+			os.RemoveAll(a.OverlayTargetPath)
+			return "", nil, err
+		}
+		unmount = func(save bool) error {
+			if save {
+				err := saveMergedChanges(a.OverlayTargetPath, lowers, upper, differ)
+				if err != nil {
+					return err
+				}
+			}
+			return util.RmAndMkdir(a.OverlayTargetPath)
+		}
+	default:
+		return "", nil, fmt.Errorf("unknown overlay driver %q", driver)
+	}
+
+	done := false
+	return a.OverlayTargetPath, func(save bool) error {
+		if done {
+			return nil
+		}
+		done = true
+		return unmount(save)
+	}, nil
+}
+
+// pickOverlayDriver returns the driver OverlayAuto uses for a top layer at
+// upper.
+func pickOverlayDriver(upper string) OverlayDriver {
+	var st syscall.Statfs_t
+	nested := syscall.Statfs(upper, &st) == nil && st.Type == overlayfsMagic
+	if !nested && (supportsOverlay() || (exec.Command("modprobe", "overlay").Run() == nil && supportsOverlay())) {
+		return OverlayKernel
+	}
+	if _, err := exec.LookPath("fuse-overlayfs"); err == nil {
+		return OverlayFuse
+	}
+	return OverlayCopy
+}
+
+func mountKernelOverlay(target string, lowers []string, upper, work string) error {
+	if os.Geteuid() != 0 {
+		return errRunNeedsRoot
+	}
+	if !supportsOverlay() {
+		err := exec.Command("modprobe", "overlay").Run()
+		if err != nil {
+			if _, ok := err.(*exec.ExitError); ok {
+				return fmt.Errorf("overlayfs is not supported on your system")
+			}
+			return err
+		}
+		if !supportsOverlay() {
+			return fmt.Errorf(
+				"overlayfs support required for using run with dependencies")
+		}
+	}
+
+	options := overlayOptions(lowers, upper, work)
+	if util.InUserNamespace() {
+		// trusted.* xattrs can't be set from inside of a user namespace
+		options += ",userxattr"
+	}
+	return syscall.Mount("overlay", target, "overlay", 0, options)
+}
+
+func mountFuseOverlay(target string, lowers []string, upper, work string) error {
+	cmd := exec.Command("fuse-overlayfs", "-o", overlayOptions(lowers, upper, work), target)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fuse-overlayfs: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unmountFuse unmounts the FUSE filesystem at target, with fusermount if we
+// aren't allowed to do it directly.
+func unmountFuse(target string) error {
+	err := syscall.Unmount(target, 0)
+	if err == nil {
+		return nil
+	}
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		if _, lerr := exec.LookPath(bin); lerr == nil {
+			out, err := exec.Command(bin, "-u", target).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s: %v: %s", bin, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// overlayOptions returns the mount options for an overlay of the given layers.
+// Overlayfs wants the lower layers top first.
+func overlayOptions(lowers []string, upper, work string) string {
+	lowerdirs := make([]string, len(lowers))
+	for i, l := range lowers {
+		lowerdirs[len(lowers)-1-i] = l
+	}
+	return "lowerdir=" + strings.Join(lowerdirs, ":") +
+		",upperdir=" + upper +
+		",workdir=" + work
+}
+
+// mergeLayers copies the given layers, bottom first, into the directory at
+// merged the way overlayfs would show them, and returns a differ for finding
+// what's changed in it later.
+func mergeLayers(merged string, layers []string) (*fsdiffer.TemporalFSDiffer, error) {
+	err := util.RmAndMkdir(merged)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		err := mergeLayer(merged, layer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	differ, err := fsdiffer.NewTemporalFSDiffer(merged)
+	if err != nil {
+		return nil, err
+	}
+	differ.CheckMetadata = true
+	return differ, nil
+}
+
+// mergeLayer copies the layer at layer on top of what's in merged, applying
+// its whiteouts and opaque directories.
+func mergeLayer(merged, layer string) error {
+	var dirs []string
+	err := walkRelative(layer, func(rel string, info os.FileInfo) error {
+		src := path.Join(layer, rel)
+		target := path.Join(merged, rel)
+		dir, name := path.Split(target)
+
+		switch {
+		case name == util.OCIOpaqueWhiteout:
+			// Already handled along with the directory
+			return nil
+		case strings.HasPrefix(name, util.OCIWhiteoutPrefix) && !info.IsDir():
+			return os.RemoveAll(path.Join(dir, strings.TrimPrefix(name, util.OCIWhiteoutPrefix)))
+		case util.IsOverlayWhiteout(info):
+			return os.RemoveAll(target)
+		case !info.IsDir():
+			err := os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			return fileutil.CopyTree(src, target, user.NewBlankUidRange())
+		}
+
+		targetInfo, err := os.Lstat(target)
+		switch {
+		case err == nil && targetInfo.IsDir() && !isOpaqueDir(src):
+		case err == nil || !os.IsNotExist(err):
+			err := os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			fallthrough
+		default:
+			err := os.Mkdir(target, 0700)
+			if err != nil {
+				return err
+			}
+		}
+		err = copyDirMetadata(target, info)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copying into the directories changed their times
+	for _, rel := range dirs {
+		info, err := os.Lstat(path.Join(layer, rel))
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(path.Join(merged, rel), info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOpaqueDir returns whether the directory at dir in a layer hides what the
+// layers below have in it, in either the overlayfs or the OCI way.
+func isOpaqueDir(dir string) bool {
+	if util.IsOverlayOpaque(dir) {
+		return true
+	}
+	_, err := os.Lstat(path.Join(dir, util.OCIOpaqueWhiteout))
+	return err == nil
+}
+
+// copyDirMetadata gives the directory at target the permissions and ownership
+// of the one with the given info.
+func copyDirMetadata(target string, info os.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		err := os.Lchown(target, int(st.Uid), int(st.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
+
+// saveMergedChanges copies what changed in merged since differ was created
+// into the top layer at upper, recording deletions of what the layers in
+// lowers have as whiteouts, the way overlayfs would have.
+func saveMergedChanges(merged string, lowers []string, upper string, differ *fsdiffer.TemporalFSDiffer) error {
+	changes, err := differ.Diff()
+	if err != nil {
+		return err
+	}
+	// Parents come before what's in them
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	inLowers := func(rel string) bool {
+		for _, l := range lowers {
+			if _, err := os.Lstat(path.Join(l, rel)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	var deletedDirs []string
+	for _, c := range changes {
+		if c.Path == "." {
+			continue
+		}
+		rel := "/" + filepath.ToSlash(c.Path)
+		underDeleted := false
+		for _, d := range deletedDirs {
+			if strings.HasPrefix(rel, d+"/") {
+				underDeleted = true
+				break
+			}
+		}
+		if underDeleted {
+			continue
+		}
+
+		target := path.Join(upper, rel)
+		if c.ChangeType == fsdiffer.Deleted {
+			deletedDirs = append(deletedDirs, rel)
+			err := os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			if !inLowers(rel) {
+				continue
+			}
+			_, err = mkdirAllLike(upper, merged, path.Dir(rel))
+			if err != nil {
+				return err
+			}
+			err = util.MakeOverlayWhiteout(target)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Lstat(path.Join(merged, rel))
+		if err != nil {
+			return err
+		}
+		_, err = mkdirAllLike(upper, merged, path.Dir(rel))
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			err := os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			err = fileutil.CopyTree(path.Join(merged, rel), target, user.NewBlankUidRange())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		targetInfo, err := os.Lstat(target)
+		if err == nil && targetInfo.IsDir() {
+			err = copyDirMetadata(target, info)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = os.RemoveAll(target)
+		if err != nil {
+			return err
+		}
+		_, err = mkdirAllLike(upper, merged, rel)
+		if err != nil {
+			return err
+		}
+		if c.ChangeType == fsdiffer.Added && inLowers(rel) {
+			// It replaces something that was deleted, so none of what the
+			// lower layers have in it is to be seen
+			err = util.SetOverlayOpaque(target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containers/build/engine"
+	"github.com/containers/build/util"
+)
+
+// SecretsDir is the directory inside of the container that secrets are made
+// available in, each as a file named after its ID.
+const SecretsDir = "/run/secrets"
+
+// RunSecret is a file from the host that is made available to a single run
+// without ever being written to the image.
+type RunSecret struct {
+	// ID is the name of the file the secret is available as in SecretsDir.
+	ID string
+	// Source is the path on the host to read the secret from.
+	Source string
+}
+
+// mountRunSecrets mounts a tmpfs at a.SecretsPath and copies the given secrets
+// into it, readable only by user, and bind mounts it at SecretsDir inside of
+// the container root at chrootDir. It returns the mount for the engine, and a
+// function to undo this. The secrets only ever exist in memory, and are gone
+// once the tmpfs has been unmounted.
+func (a *ACBuild) mountRunSecrets(chrootDir string, secrets []RunSecret, user *runUser) (mount *engine.Mount, unmount func() error, err error) {
+	if len(secrets) == 0 {
+		return nil, func() error { return nil }, nil
+	}
+
+	var mounted []string
+	var created []string
+	unmount = func() error {
+		var firstErr error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			err := syscall.Unmount(mounted[i], syscall.MNT_DETACH)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("error unmounting %s: %v", mounted[i], err)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+		os.Remove(a.SecretsPath)
+		return firstErr
+	}
+	defer func() {
+		if err != nil {
+			unmount()
+		}
+	}()
+
+	seen := make(map[string]bool)
+	for _, s := range secrets {
+		if !validCacheID.MatchString(s.ID) {
+			return nil, nil, fmt.Errorf("invalid secret ID %q", s.ID)
+		}
+		if seen[s.ID] {
+			return nil, nil, fmt.Errorf("secret %q given more than once", s.ID)
+		}
+		seen[s.ID] = true
+	}
+
+	// The secrets are kept outside of the container root as well, for engines
+	// that mount their own tmpfs on /run to mount them from
+	err = os.MkdirAll(a.SecretsPath, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	err = syscall.Mount("tmpfs", a.SecretsPath, "tmpfs", flags, "mode=0755,size=1m")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error mounting %s: %v", SecretsDir, err)
+	}
+	mounted = append(mounted, a.SecretsPath)
+
+	for _, s := range secrets {
+		blob, err := ioutil.ReadFile(s.Source)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading secret %q: %v", s.ID, err)
+		}
+		secretPath := filepath.Join(a.SecretsPath, s.ID)
+		err = ioutil.WriteFile(secretPath, blob, 0400)
+		if err == nil {
+			err = os.Chown(secretPath, int(user.uid), int(user.gid))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error writing secret %q: %v", s.ID, err)
+		}
+	}
+
+	err = syscall.Mount("", a.SecretsPath, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making %s read-only: %v", SecretsDir, err)
+	}
+
+	target, err := util.ResolveInRoot(chrootDir, SecretsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	created, err = makeMountpoint(target, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = syscall.Mount(a.SecretsPath, target, "", syscall.MS_BIND, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error mounting %s: %v", SecretsDir, err)
+	}
+	mounted = append(mounted, target)
+	err = syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error making %s read-only: %v", SecretsDir, err)
+	}
+	return &engine.Mount{Source: a.SecretsPath, Destination: SecretsDir, ReadOnly: true}, unmount, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/build/util"
+)
+
+// runUser is a user resolved against the image's /etc/passwd and /etc/group.
+type runUser struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+}
+
+// resolveRunUser looks up the user and group to run a command as inside of the
+// root filesystem at chrootDir. Both can be given either as names or as
+// numeric IDs. Numeric IDs don't need to exist in the image. If group is
+// empty, the user's primary group is used, and the user's supplementary groups
+// are taken from /etc/group.
+func resolveRunUser(chrootDir, user, group string) (*runUser, error) {
+	ru := &runUser{home: "/"}
+	if user == "" {
+		user = "0"
+	}
+
+	passwd, err := readColonFile(chrootDir, "/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readColonFile(chrootDir, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	var username string
+	entry := findColonEntry(passwd, user)
+	switch {
+	case entry != nil && len(entry) >= 6:
+		username = entry[0]
+		ru.uid, err = parseID(entry[2])
+		if err == nil {
+			ru.gid, err = parseID(entry[3])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid /etc/passwd entry for %q: %v", user, err)
+		}
+		ru.home = entry[5]
+	default:
+		ru.uid, err = parseID(user)
+		if err != nil {
+			return nil, fmt.Errorf("user %q not found in the image's /etc/passwd", user)
+		}
+	}
+
+	if group != "" {
+		entry := findColonEntry(groups, group)
+		if entry != nil && len(entry) >= 3 {
+			ru.gid, err = parseID(entry[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid /etc/group entry for %q: %v", group, err)
+			}
+		} else {
+			ru.gid, err = parseID(group)
+			if err != nil {
+				return nil, fmt.Errorf("group %q not found in the image's /etc/group", group)
+			}
+		}
+		return ru, nil
+	}
+
+	if username == "" {
+		return ru, nil
+	}
+	for _, entry := range groups {
+		if len(entry) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(entry[3], ",") {
+			if member != username {
+				continue
+			}
+			gid, err := parseID(entry[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid /etc/group entry for %q: %v", entry[0], err)
+			}
+			if gid != ru.gid {
+				ru.groups = append(ru.groups, gid)
+			}
+		}
+	}
+	return ru, nil
+}
+
+// readColonFile reads a colon separated file like /etc/passwd from inside of
+// the root filesystem at root. A missing file has no entries.
+func readColonFile(root, p string) ([][]string, error) {
+	resolved, err := util.ResolveInRoot(root, p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(resolved)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, s.Err()
+}
+
+// findColonEntry returns the entry whose name is nameOrID, or failing that the
+// first entry whose ID is nameOrID.
+func findColonEntry(entries [][]string, nameOrID string) []string {
+	for _, entry := range entries {
+		if entry[0] == nameOrID {
+			return entry
+		}
+	}
+	for _, entry := range entries {
+		if len(entry) >= 3 && entry[2] == nameOrID {
+			return entry
+		}
+	}
+	return nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id), nil
+}
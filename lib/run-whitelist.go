@@ -0,0 +1,262 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containers/build/lib/appc"
+	"github.com/containers/build/util"
+)
+
+// In appc builds with dependencies, run mounts an overlay of the dependencies
+// with the image's rootfs on top. appc has no way of recording that the image
+// deletes something from a dependency other than leaving it out of the path
+// whitelist, so the overlayfs whiteouts for deletions are turned into the
+// whitelist after every run, and back into whiteouts before the next one.
+
+// whitelistSet returns the paths in pwl along with all of their parent
+// directories, which have to be kept for the paths to be, or nil if pwl is
+// empty.
+func whitelistSet(pwl []string) map[string]bool {
+	if len(pwl) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, p := range pwl {
+		for p = path.Clean(p); p != "/" && !set[p]; p = path.Dir(p) {
+			set[p] = true
+		}
+	}
+	return set
+}
+
+// walkRelative walks the tree at root like filepath.Walk, but calls f with the
+// absolute path the file has inside of root, skipping root itself.
+func walkRelative(root string, f func(rel string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return f("/"+rel, info)
+	})
+}
+
+// hideUnlistedDepPaths creates whiteouts in the overlay's upper directory for
+// whatever the dependencies at deps have that the path whitelist leaves out,
+// so that it stays deleted while running a command. own is the image's rootfs,
+// which is usually also the upper directory. The directories that had to be
+// created in upper to hold whiteouts are returned, parents first.
+func (a *ACBuild) hideUnlistedDepPaths(upper, own string, deps []string) ([]string, error) {
+	m, ok := a.man.(*appc.Manifest)
+	if !ok {
+		return nil, fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+	kept := whitelistSet(m.Get().PathWhitelist)
+	if kept == nil {
+		return nil, nil
+	}
+
+	var created []string
+	for _, dep := range deps {
+		err := walkRelative(dep, func(rel string, info os.FileInfo) error {
+			if kept[rel] {
+				return nil
+			}
+			skip := error(nil)
+			if info.IsDir() {
+				skip = filepath.SkipDir
+			}
+
+			if ownInfo, err := os.Lstat(path.Join(own, rel)); err == nil {
+				if ownInfo.IsDir() && info.IsDir() {
+					// What's in it may still need hiding
+					return nil
+				}
+				// The image's own file is used anyway
+				return skip
+			}
+			target := path.Join(upper, rel)
+			if _, err := os.Lstat(target); err == nil {
+				return skip
+			}
+
+			newDirs, err := mkdirAllLike(upper, dep, path.Dir(rel))
+			created = append(created, newDirs...)
+			if err != nil {
+				return err
+			}
+			err = util.MakeOverlayWhiteout(target)
+			if err != nil {
+				return err
+			}
+			return skip
+		})
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// mkdirAllLike creates the directory dir under root, along with any missing
+// parents, with the same permissions and ownership as the directories at the
+// same paths under like. The directories that were created are returned,
+// parents first.
+func mkdirAllLike(root, like, dir string) ([]string, error) {
+	var missing []string
+	for d := dir; d != "/"; d = path.Dir(d) {
+		if _, err := os.Lstat(path.Join(root, d)); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		target := path.Join(root, missing[i])
+		info, err := os.Lstat(path.Join(like, missing[i]))
+		if err != nil {
+			return created, err
+		}
+		err = os.Mkdir(target, 0700)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, target)
+		err = copyDirMetadata(target, info)
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// updatePathWhitelist strips the overlayfs whiteouts and opaque directories
+// that running a command left in the image's rootfs at own, and records what
+// they deleted from the dependencies at deps in the path whitelist instead.
+// created are the directories hideUnlistedDepPaths created, which are removed
+// again if they're still empty.
+//
+// Once something is deleted, the whitelist lists everything in the image and
+// its dependencies that's left, as appc requires.
+func (a *ACBuild) updatePathWhitelist(own string, deps []string, created []string) error {
+	m, ok := a.man.(*appc.Manifest)
+	if !ok {
+		return fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+
+	var whiteouts, opaques []string
+	err := walkRelative(own, func(rel string, info os.FileInfo) error {
+		switch {
+		case util.IsOverlayWhiteout(info):
+			whiteouts = append(whiteouts, rel)
+		case info.IsDir() && util.IsOverlayOpaque(path.Join(own, rel)):
+			opaques = append(opaques, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]bool)
+	for _, rel := range whiteouts {
+		err := os.Remove(path.Join(own, rel))
+		if err != nil {
+			return err
+		}
+		deleted[rel] = true
+	}
+	opaque := make(map[string]bool)
+	for _, rel := range opaques {
+		err := util.ClearOverlayOpaque(path.Join(own, rel))
+		if err != nil {
+			return err
+		}
+		opaque[rel] = true
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if entries, err := ioutil.ReadDir(created[i]); err == nil && len(entries) == 0 {
+			os.Remove(created[i])
+		}
+	}
+
+	oldPwl := m.Get().PathWhitelist
+	if len(deleted) == 0 && len(opaque) == 0 && len(oldPwl) == 0 {
+		return nil
+	}
+	kept := whitelistSet(oldPwl)
+
+	var pwl []string
+	err = walkRelative(own, func(rel string, info os.FileInfo) error {
+		pwl = append(pwl, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		err := walkRelative(dep, func(rel string, info os.FileInfo) error {
+			skip := error(nil)
+			if info.IsDir() {
+				skip = filepath.SkipDir
+			}
+			if deleted[rel] || (kept != nil && !kept[rel]) {
+				return skip
+			}
+			pwl = append(pwl, rel)
+			if opaque[rel] {
+				// Only the image's own files are left in it
+				return skip
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return m.SetPathWhitelist(pwl)
+}
+
+// addRootfsToPathWhitelist returns pwl with everything in the rootfs at rootfs
+// added to it if it's not empty, as the image's own files are left out of it
+// otherwise.
+func addRootfsToPathWhitelist(rootfs string, pwl []string) ([]string, error) {
+	if len(pwl) == 0 {
+		return pwl, nil
+	}
+	listed := make(map[string]bool)
+	for _, p := range pwl {
+		listed[path.Clean(p)] = true
+	}
+	err := walkRelative(rootfs, func(rel string, info os.FileInfo) error {
+		if !listed[rel] {
+			pwl = append(pwl, rel)
+		}
+		return nil
+	})
+	return pwl, err
+}
@@ -16,14 +16,13 @@ package lib
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path"
-	"path/filepath"
+	"runtime"
 	"strings"
-	"syscall"
 
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/schema/types"
@@ -34,6 +33,62 @@ import (
 	"github.com/containers/build/util"
 )
 
+var errRunNeedsRoot = fmt.Errorf("the run subcommand must be run as root, or by a user with a subordinate ID range in /etc/subuid and /etc/subgid")
+
+// NetworkMode controls which network a command is run with.
+type NetworkMode string
+
+const (
+	// NetworkHost runs the command with the network of the host.
+	NetworkHost = NetworkMode("host")
+	// NetworkNone runs the command in its own network namespace, with only a
+	// loopback interface.
+	NetworkNone = NetworkMode("none")
+)
+
+// RunOptions holds the optional settings for a single run.
+type RunOptions struct {
+	// Mounts are made available inside the container while the command runs,
+	// without becoming part of the image.
+	Mounts []RunMount
+	// Secrets are made available in SecretsDir inside the container while
+	// the command runs, without becoming part of the image.
+	Secrets []RunSecret
+	// Network is the network the command is run with. The host network is
+	// used if this is empty.
+	Network NetworkMode
+	// Limits restrict the resources the command can use.
+	Limits RunLimits
+	// HostFiles sets the policy for each of the files from the host in
+	// HostFiles, by name. Files that aren't in the map use
+	// DefaultHostFilePolicy.
+	HostFiles map[string]HostFilePolicy
+
+	// User and Group are the user and group to run the command as, either as
+	// names from the image's /etc/passwd and /etc/group or as numeric IDs. The
+	// command is run as root if User is empty, and with the user's primary
+	// group if Group is empty.
+	User  string
+	Group string
+
+	// Overlay is how the image's layers are combined while the command
+	// runs, which is picked automatically if it's empty.
+	Overlay OverlayDriver
+
+	// Discard throws away any changes the command makes to the image, instead
+	// of saving them.
+	Discard bool
+	// Terminal is whether the command is used interactively from the terminal
+	// Stdin is connected to.
+	Terminal bool
+
+	// Stdin, Stdout and Stderr are connected to the command. Any that are nil
+	// default to the corresponding file of the acbuild process.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
 // Run will execute the given command in the ACI being built. a.CurrentImagePath
 // is where the untarred ACI is stored, a.DepStoreTarPath is the directory to
 // download dependencies into, a.DepStoreExpandedPath is where the dependencies
@@ -42,13 +97,45 @@ import (
 //
 // Arguments:
 //
+// - ctx:        Cancelling ctx kills the command.
+//
 // - cmd:        The command to run and its arguments.
 //
 // - workingDir: If specified, the current directory inside the container is
 // changed to its value before running the given command.
 //
 // - runEngine:  The engine used to perform the execution of the command.
-func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine engine.Engine) (err error) {
+//
+// - opts:       Additional settings for this run.
+func (a *ACBuild) Run(ctx context.Context, cmd []string, workingDir string, insecure bool, runEngine engine.Engine, opts RunOptions) (err error) {
+	return a.RunBatch(ctx, [][]string{cmd}, workingDir, insecure, runEngine, opts)
+}
+
+// RunBatchError is returned by RunBatch when one of several commands fails.
+type RunBatchError struct {
+	// Command is the command that failed.
+	Command []string
+	// Index is where Command is in the commands given to RunBatch.
+	Index int
+	// Err is the error the command failed with, as Run would have returned
+	// it.
+	Err error
+}
+
+func (e *RunBatchError) Error() string {
+	return fmt.Sprintf("%q: %v", e.Command, e.Err)
+}
+
+// RunBatch runs each of cmds in turn like Run, but sets up the container's
+// root filesystem only once for all of them, and saves the changes they make to
+// the image once at the end. This saves a lot of work when running many
+// commands in a row, especially in OCI builds, where saving changes means
+// rewriting the whole top layer.
+//
+// The commands are run until one of them fails, and if there's more than one
+// command the error is then a *RunBatchError. Resource limits apply to each
+// command separately.
+func (a *ACBuild) RunBatch(ctx context.Context, cmds [][]string, workingDir string, insecure bool, runEngine engine.Engine, opts RunOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -58,15 +145,112 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		}
 	}()
 
-	if os.Geteuid() != 0 {
-		return fmt.Errorf("the run subcommand must be run as root")
+	if len(cmds) == 0 {
+		return fmt.Errorf("command to run not set")
+	}
+	for _, cmd := range cmds {
+		if len(cmd) == 0 {
+			return fmt.Errorf("command to run not set")
+		}
 	}
 
-	if len(cmd) == 0 {
-		return fmt.Errorf("command to run not set")
+	// Everything that has to be mounted needs root, as do most engines.
+	needsRoot := len(opts.Mounts) > 0 || len(opts.Secrets) > 0 || opts.Network == NetworkNone
+	if e, ok := runEngine.(engine.Unprivileged); !ok || !e.Unprivileged() {
+		needsRoot = true
+	}
+	if needsRoot && os.Geteuid() != 0 {
+		return errRunNeedsRoot
 	}
 
-	err = util.MaybeUnmount(a.OverlayTargetPath)
+	switch opts.Network {
+	case "", NetworkHost, NetworkNone:
+	default:
+		return fmt.Errorf("unknown network mode %q", opts.Network)
+	}
+	switch opts.Overlay {
+	case "", OverlayAuto, OverlayKernel, OverlayFuse, OverlayCopy:
+	default:
+		return fmt.Errorf("unknown overlay driver %q", opts.Overlay)
+	}
+
+	var env map[string]string
+	switch a.Mode {
+	case BuildModeOCI:
+		env, err = a.getEnvVarsOCI()
+	case BuildModeAppC:
+		env, err = a.getEnvVarsAppC()
+	default:
+		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	// What's done interactively can be different every time, so it's never
+	// taken from the cache
+	if opts.Discard || opts.Terminal {
+		err = a.forgetRootfsState()
+		if err != nil {
+			return err
+		}
+		return a.run(ctx, cmds, workingDir, insecure, runEngine, opts, env)
+	}
+	var secretIDs []string
+	for _, s := range opts.Secrets {
+		secretIDs = append(secretIDs, s.ID)
+	}
+	// What's bound in from the host can change what the commands do, as
+	// much as what copy copies does
+	var bindSources []string
+	for _, m := range opts.Mounts {
+		if m.Type != RunMountBind {
+			continue
+		}
+		hash, err := hashTree(m.Source)
+		if err != nil {
+			return fmt.Errorf("error reading bind mount source %q: %v", m.Source, err)
+		}
+		bindSources = append(bindSources, hash)
+	}
+	step := runStep{
+		Commands:    cmds,
+		WorkingDir:  workingDir,
+		Env:         env,
+		User:        opts.User,
+		Group:       opts.Group,
+		Network:     opts.Network,
+		Mounts:      opts.Mounts,
+		BindSources: bindSources,
+		Secrets:     secretIDs,
+		HostFiles:   opts.HostFiles,
+	}
+	return a.cachedStep(step, func() error {
+		return a.run(ctx, cmds, workingDir, insecure, runEngine, opts, env)
+	})
+}
+
+// runStep is what identifies a run command in the build cache, along with the
+// state of the image it's run on. The contents of bind mounts are part of it,
+// as BindSources, but the contents of cache mounts and secrets aren't.
+type runStep struct {
+	Commands    [][]string                `json:"run"`
+	WorkingDir  string                    `json:"workingDir"`
+	Env         map[string]string         `json:"env"`
+	User        string                    `json:"user"`
+	Group       string                    `json:"group"`
+	Network     NetworkMode               `json:"network"`
+	Mounts      []RunMount                `json:"mounts"`
+	BindSources []string                  `json:"bindSources,omitempty"`
+	Secrets     []string                  `json:"secrets"`
+	HostFiles   map[string]HostFilePolicy `json:"hostFiles"`
+}
+
+// run does the work of RunBatch, with the build context locked and env being
+// the environment of the image.
+func (a *ACBuild) run(ctx context.Context, cmds [][]string, workingDir string, insecure bool, runEngine engine.Engine, opts RunOptions, env map[string]string) (err error) {
+	// Clean up after any previous run that didn't get to unmount everything
+	err = util.UnmountAll(a.ContextPath)
 	if err != nil {
 		return err
 	}
@@ -103,71 +287,173 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		return err
 	}
 
-	if len(depPaths) != 1 {
-		if !supportsOverlay() {
-			err := exec.Command("modprobe", "overlay").Run()
-			if err != nil {
-				if _, ok := err.(*exec.ExitError); ok {
-					return fmt.Errorf("overlayfs is not supported on your system")
-				}
-				return err
-			}
-			if !supportsOverlay() {
-				return fmt.Errorf(
-					"overlayfs support required for using run with dependencies")
-			}
+	var change *layerChange
+	if a.Mode == BuildModeOCI && !opts.Discard {
+		// Starting a new layer means the overlay has lower layers, which
+		// may not work when we're not root.
+		change, err = a.beginLayerChange(depPaths[len(depPaths)-1], os.Geteuid() == 0 && !util.InUserNamespace())
+		if err != nil {
+			return err
+		}
+		if change.newLayer {
+			depPaths = append(depPaths, change.path)
 		}
 	}
 
-	var chrootDir string
-	if len(depPaths) == 1 {
-		chrootDir = depPaths[0]
-	} else {
-		lowerLayers := depPaths[0 : len(depPaths)-1]
-		upperLayer := depPaths[len(depPaths)-1]
-		options := "lowerdir=" + strings.Join(lowerLayers, ":") +
-			",upperdir=" + upperLayer +
-			",workdir=" + a.OverlayWorkPath
-		err := syscall.Mount("overlay", a.OverlayTargetPath, "overlay", 0, options)
+	// The image's layers are the lower layers of the overlay, and the top one
+	// is written to, unless the changes are to be discarded, in which case
+	// they go into a throwaway directory instead.
+	lowerLayers := depPaths[:len(depPaths)-1]
+	upperLayer := depPaths[len(depPaths)-1]
+	if opts.Discard {
+		lowerLayers = depPaths
+		upperLayer = a.OverlayDiscardPath
+		err = util.RmAndMkdir(upperLayer)
 		if err != nil {
 			return err
 		}
+		defer os.RemoveAll(upperLayer)
+	}
+
+	if a.Mode == BuildModeAppC && len(depPaths) > 1 {
+		own := depPaths[len(depPaths)-1]
+		deps := depPaths[:len(depPaths)-1]
+		var created []string
+		created, err = a.hideUnlistedDepPaths(upperLayer, own, deps)
+		if !opts.Discard {
+			// Deferred before the overlay is mounted, so that it runs
+			// after it's unmounted again. Whatever the commands changed
+			// is kept even if they fail, so this has to happen then too.
+			defer func() {
+				err1 := a.updatePathWhitelist(own, deps, created)
+				if err == nil {
+					err = err1
+				}
+			}()
+		}
+		if err != nil {
+			return err
+		}
+	}
 
+	chrootDir := upperLayer
+	unmountLayers := func(save bool) error { return nil }
+	if len(lowerLayers) > 0 {
+		chrootDir, unmountLayers, err = a.mountLayers(opts.Overlay, lowerLayers, upperLayer)
+		if err != nil {
+			return err
+		}
 		defer func() {
-			err1 := syscall.Unmount(a.OverlayTargetPath, 0)
-			if err == nil {
+			// Only does anything if the commands didn't get to run
+			if err1 := unmountLayers(false); err == nil {
 				err = err1
 			}
 		}()
-
-		chrootDir = a.OverlayTargetPath
 	}
 
-	var env map[string]string
-	switch a.Mode {
-	case BuildModeOCI:
-		env, err = a.getEnvVarsOCI()
-	case BuildModeAppC:
-		env, err = a.getEnvVarsAppC()
-	default:
-		return fmt.Errorf("unknown build mode: %s", a.Mode)
+	var caps []string
+	var noNewPrivs bool
+	if a.Mode == BuildModeAppC {
+		caps, noNewPrivs, err = a.getCapabilitiesAppC()
+		if err != nil {
+			return err
+		}
 	}
+
+	user, err := resolveRunUser(chrootDir, opts.User, opts.Group)
 	if err != nil {
 		return err
 	}
+	if _, ok := env["HOME"]; !ok && opts.User != "" {
+		env["HOME"] = user.home
+	}
+
+	engineOpts := engine.Options{
+		Environment: env,
+		Chroot:      chrootDir,
+		WorkingDir:  workingDir,
+		UID:         user.uid,
+		GID:         user.gid,
+		Groups:      user.groups,
+		Stdin:       opts.Stdin,
+		Stdout:      opts.Stdout,
+		Stderr:      opts.Stderr,
+		Terminal:    opts.Terminal,
 
-	err = a.mirrorLocalZoneInfo()
+		Capabilities:    caps,
+		NoNewPrivileges: noNewPrivs,
+	}
+	if engineOpts.Stdin == nil {
+		engineOpts.Stdin = os.Stdin
+	}
+	if engineOpts.Stdout == nil {
+		engineOpts.Stdout = os.Stdout
+	}
+	if engineOpts.Stderr == nil {
+		engineOpts.Stderr = os.Stderr
+	}
+
+	unmountHostFiles, err := a.mountHostFiles(chrootDir, opts.HostFiles)
 	if err != nil {
 		return err
 	}
-
-	err = runEngine.Run(cmd[0], cmd[1:], env, chrootDir, workingDir)
+	runMounts, unmountRunMounts, err := a.mountRunMounts(chrootDir, opts.Mounts)
+	if err != nil {
+		unmountHostFiles()
+		return err
+	}
+	secretsMount, unmountRunSecrets, err := a.mountRunSecrets(chrootDir, opts.Secrets, user)
+	if err != nil {
+		unmountRunMounts()
+		unmountHostFiles()
+		return err
+	}
+	engineOpts.Mounts = runMounts
+	if secretsMount != nil {
+		engineOpts.Mounts = append(engineOpts.Mounts, *secretsMount)
+	}
+	runCmds := func() error {
+		for i, cmd := range cmds {
+			engineOpts.Command = cmd[0]
+			engineOpts.Args = cmd[1:]
+			err := withLimits(opts.Limits, func(cgroup string) error {
+				engineOpts.Cgroup = cgroup
+				return runEngine.Run(ctx, engineOpts)
+			})
+			if err != nil && len(cmds) > 1 {
+				return &RunBatchError{Command: cmd, Index: i, Err: err}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if opts.Network == NetworkNone {
+		err = runWithoutNetwork(runCmds)
+	} else {
+		err = runCmds()
+	}
+	// The mounts need to be gone before the top layer is read back in
+	if err1 := unmountRunSecrets(); err == nil {
+		err = err1
+	}
+	if err1 := unmountRunMounts(); err == nil {
+		err = err1
+	}
+	if err1 := unmountHostFiles(); err == nil {
+		err = err1
+	}
+	// Whatever the commands changed is kept even if they fail
+	if err1 := unmountLayers(!opts.Discard); err == nil {
+		err = err1
+	}
 	if err != nil {
 		return err
 	}
 
-	if a.Mode == BuildModeOCI {
-		err = a.rehashAndStoreOCIBlob(depPaths[len(depPaths)-1], false)
+	if change != nil {
+		err = a.finishLayerChange(change)
 		if err != nil {
 			return err
 		}
@@ -176,6 +462,24 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 	return nil
 }
 
+// runWithoutNetwork calls f on a thread that has been moved into a new network
+// namespace, so that any processes started by f have no network access.
+func runWithoutNetwork(f func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so the runtime will discard it along
+		// with its network namespace once this goroutine exits.
+		runtime.LockOSThread()
+		err := util.UnshareNetwork()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- f()
+	}()
+	return <-errCh
+}
+
 func (a *ACBuild) generateOverlayPathsAppC(insecure bool) ([]string, error) {
 	deps, err := a.renderACI(insecure, a.Debug)
 	if err != nil {
@@ -222,6 +526,43 @@ func (a *ACBuild) generateOverlayPathsOCI() ([]string, error) {
 	return layerPaths, nil
 }
 
+// getCapabilitiesAppC returns the capabilities and whether to prevent gaining
+// new privileges according to the isolators in the manifest. The capabilities
+// are nil if the manifest doesn't restrict them.
+func (a *ACBuild) getCapabilitiesAppC() (caps []string, noNewPrivs bool, err error) {
+	man, err := util.GetManifest(a.CurrentImagePath)
+	if err != nil {
+		return nil, false, err
+	}
+	if man.App == nil {
+		return nil, false, nil
+	}
+
+	for _, isolator := range man.App.Isolators {
+		switch v := isolator.Value().(type) {
+		case *types.LinuxCapabilitiesRetainSet:
+			caps = []string{}
+			for _, c := range v.Set() {
+				caps = append(caps, string(c))
+			}
+		case *types.LinuxCapabilitiesRevokeSet:
+			revoked := make(map[string]bool)
+			for _, c := range v.Set() {
+				revoked[string(c)] = true
+			}
+			caps = []string{}
+			for _, c := range engine.DefaultCapabilities {
+				if !revoked[c] {
+					caps = append(caps, c)
+				}
+			}
+		case *types.LinuxNoNewPrivileges:
+			noNewPrivs = bool(*v)
+		}
+	}
+	return caps, noNewPrivs, nil
+}
+
 func (a *ACBuild) getEnvVarsAppC() (map[string]string, error) {
 	man, err := util.GetManifest(a.CurrentImagePath)
 	if err != nil {
@@ -352,35 +693,3 @@ func genDeplist(acipath string, reg registry.Registry) ([]string, error) {
 	deps = append(deps, key)
 	return deps, nil
 }
-
-func (a *ACBuild) mirrorLocalZoneInfo() error {
-	zif, err := filepath.EvalSymlinks("/etc/localtime")
-	if err != nil {
-		return err
-	}
-
-	src, err := os.Open(zif)
-	if err != nil {
-		return err
-	}
-	defer src.Close()
-
-	destp := filepath.Join(a.CurrentImagePath, aci.RootfsDir, zif)
-
-	if err = os.MkdirAll(filepath.Dir(destp), 0755); err != nil {
-		return err
-	}
-
-	dest, err := os.OpenFile(destp, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer dest.Close()
-
-	_, err = io.Copy(dest, src)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,302 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containers/build/lib/oci"
+	"github.com/containers/build/util"
+)
+
+// writeOCIDir writes the build's image into the image layout directory at
+// output, which is created if it doesn't exist. The images already in the
+// layout are kept, unless they have the same ref as the build's image, which
+// they are only replaced by if overwrite is set.
+func (a *ACBuild) writeOCIDir(output string, overwrite bool) (string, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+
+	idx := &oci.Index{}
+	info, err := os.Stat(output)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return "", err
+	case !info.IsDir():
+		return "", fmt.Errorf("%s exists and isn't a directory", output)
+	case oci.IsLayout(output):
+		idx, err = oci.ReadIndex(output)
+		if err != nil {
+			return "", err
+		}
+	default:
+		files, err := ioutil.ReadDir(output)
+		if err != nil {
+			return "", err
+		}
+		if len(files) != 0 {
+			return "", fmt.Errorf("%s exists and isn't an image layout", output)
+		}
+	}
+
+	// The entry for the image in the build's layout has its platform
+	entry, err := a.currentIndexEntry(ociMan)
+	if err != nil {
+		return "", err
+	}
+	refName := entry.RefName()
+	manifests := []oci.IndexDescriptor{}
+	for _, d := range idx.Manifests {
+		if d.RefName() != refName {
+			manifests = append(manifests, d)
+			continue
+		}
+		if !overwrite {
+			return "", fmt.Errorf("%s already has an image with ref %q", output, refName)
+		}
+	}
+	idx.Manifests = append(manifests, entry)
+
+	man := ociMan.GetManifest()
+	digests := []string{entry.Digest, man.Config.Digest}
+	for _, l := range man.Layers {
+		digests = append(digests, l.Digest)
+	}
+	for _, d := range digests {
+		err := a.copyBlob(output, d)
+		if err != nil {
+			return "", err
+		}
+	}
+	return entry.Digest, oci.WriteIndex(output, idx)
+}
+
+// currentIndexEntry returns the entry for the build's image in the index of
+// its image layout.
+func (a *ACBuild) currentIndexEntry(ociMan *oci.Image) (oci.IndexDescriptor, error) {
+	idx, err := oci.ReadIndex(a.CurrentImagePath)
+	if err != nil {
+		return oci.IndexDescriptor{}, err
+	}
+	for _, d := range idx.Manifests {
+		if d.Digest == ociMan.GetRef().Digest {
+			return d, nil
+		}
+	}
+	return oci.IndexDescriptor{}, fmt.Errorf("image manifest %s is missing from the index", ociMan.GetRef().Digest)
+}
+
+// copyBlob copies the blob with the given digest from the build's image
+// layout to the one at ociPath, unless it's already there.
+func (a *ACBuild) copyBlob(ociPath, digest string) error {
+	algo, hash, err := util.SplitOCILayerID(digest)
+	if err != nil {
+		return err
+	}
+	blobDir := path.Join(ociPath, "blobs", algo)
+	target := path.Join(blobDir, hash)
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	err = os.MkdirAll(blobDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(a.blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(blobDir, "."+hash)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// writeDockerArchive writes the build's image to tw in the format of `docker
+// save`, and returns the digest of its config, which docker uses as the
+// image's ID. The image is tagged with the build's tag, if it names a
+// repository.
+func (a *ACBuild) writeDockerArchive(tw *tar.Writer) (string, error) {
+	ociMan, ok := a.man.(*oci.Image)
+	if !ok {
+		return "", fmt.Errorf("internal error: mismatched manifest type and build mode???")
+	}
+	man := ociMan.GetManifest()
+	diffIDs := ociMan.GetDiffIDs()
+	if len(diffIDs) != len(man.Layers) {
+		return "", fmt.Errorf("image config has %d diffIDs for %d layers", len(diffIDs), len(man.Layers))
+	}
+
+	_, configHash, err := util.SplitOCILayerID(man.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	configBlob, err := ioutil.ReadFile(a.blobPath(man.Config.Digest))
+	if err != nil {
+		return "", err
+	}
+	img := dockerArchiveImage{
+		Config:   configHash + ".json",
+		RepoTags: []string{},
+	}
+	err = writeTarEntry(tw, img.Config, bytes.NewReader(configBlob), int64(len(configBlob)))
+	if err != nil {
+		return "", err
+	}
+
+	written := make(map[string]bool)
+	for i, l := range man.Layers {
+		_, diffHash, err := util.SplitOCILayerID(diffIDs[i])
+		if err != nil {
+			return "", err
+		}
+		layerPath := diffHash + "/layer.tar"
+		img.Layers = append(img.Layers, layerPath)
+		if written[layerPath] {
+			continue
+		}
+		written[layerPath] = true
+		err = tw.WriteHeader(&tar.Header{
+			Name:     diffHash + "/",
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+			Typeflag: tar.TypeDir,
+		})
+		if err != nil {
+			return "", err
+		}
+		err = a.writeDockerArchiveLayer(tw, layerPath, l.Digest, l.MediaType)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if repoTag := dockerRepoTag(ociMan.GetRefName()); repoTag != "" {
+		img.RepoTags = append(img.RepoTags, repoTag)
+	} else {
+		fmt.Fprintf(os.Stderr, "warning: tag %q doesn't name a repository, docker will load the image untagged; set a tag like \"example.com/app:%s\" to name it\n", ociMan.GetRefName(), ociMan.GetRefName())
+	}
+	manifestBlob, err := json.Marshal([]dockerArchiveImage{img})
+	if err != nil {
+		return "", err
+	}
+	err = writeTarEntry(tw, dockerArchiveManifestFile, bytes.NewReader(manifestBlob), int64(len(manifestBlob)))
+	if err != nil {
+		return "", err
+	}
+	return man.Config.Digest, nil
+}
+
+// writeDockerArchiveLayer writes the layer with the given digest to tw at
+// name as a plain tar file, which is the only form older versions of docker
+// load layers in. Compressed layers are uncompressed into a temporary file
+// first, as their size is needed up front.
+func (a *ACBuild) writeDockerArchiveLayer(tw *tar.Writer, name, digest, mediaType string) error {
+	f, err := os.Open(a.blobPath(digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if mediaType == oci.MediaTypeImageLayerUncompressed {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return writeTarEntry(tw, name, f, info.Size())
+	}
+
+	dr, err := util.NewDecompressReader(f)
+	if err != nil {
+		return fmt.Errorf("error reading layer %s: %v", digest, err)
+	}
+	defer dr.Close()
+	tmp, err := ioutil.TempFile(a.ContextPath, "layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, dr)
+	if err != nil {
+		return fmt.Errorf("error reading layer %s: %v", digest, err)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return writeTarEntry(tw, name, tmp, size)
+}
+
+// writeTarEntry writes a regular file named name with size bytes from r to tw.
+func writeTarEntry(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s was %d bytes, expected %d", name, n, size)
+	}
+	return nil
+}
+
+// dockerRepoTag returns the "repo:tag" to tag the image with the given tag
+// with in docker, or "" if the tag doesn't name a repository. Tags set with
+// `acbuild set-tag` may be a bare tag, such as "v1", or a whole reference,
+// such as "example.com/app:v1" or "example.com/app" for its latest tag.
+func dockerRepoTag(tag string) string {
+	if !strings.ContainsAny(tag, ":/") {
+		return ""
+	}
+	if dockerTag(tag) == oci.DefaultRefName && !strings.HasSuffix(tag, ":"+oci.DefaultRefName) {
+		return tag + ":" + oci.DefaultRefName
+	}
+	return tag
+}
@@ -16,7 +16,6 @@ package lib
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
@@ -29,12 +28,34 @@ import (
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/schema/types"
 
+	"github.com/containers/build/lib/oci"
 	"github.com/containers/build/util"
 )
 
+// WriteFormat is a format that the image from an oci build can be written in.
+type WriteFormat string
+
+const (
+	// WriteFormatDefault writes an ACI in appc builds, and a tar of the
+	// build's image layout in oci builds, both compressed with the build's
+	// compression.
+	WriteFormatDefault = WriteFormat("")
+	// WriteFormatOCIDir writes the image into an image layout directory,
+	// next to the images already in it.
+	WriteFormatOCIDir = WriteFormat("oci-dir")
+	// WriteFormatOCIArchive writes a tar of an image layout.
+	WriteFormatOCIArchive = WriteFormat("oci-archive")
+	// WriteFormatDockerArchive writes a tar in the format of `docker save`,
+	// which `docker load` accepts.
+	WriteFormatDockerArchive = WriteFormat("docker-archive")
+)
+
 // Write will produce the resulting image from the current build context, saving
-// it to the given path, optionally signing it.
-func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
+// it to the given path in the given format. The returned id is the sha512 of
+// the written tar in the default format, the digest of the image's manifest
+// for OCI layouts, and the digest of the image's config, which docker uses as
+// the image's ID, for docker archives.
+func (a *ACBuild) Write(output string, overwrite bool, format WriteFormat) (id string, err error) {
 	if err = a.lock(); err != nil {
 		return "", err
 	}
@@ -44,6 +65,19 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 	}()
 
+	switch format {
+	case WriteFormatDefault:
+	case WriteFormatOCIDir, WriteFormatOCIArchive, WriteFormatDockerArchive:
+		if a.Mode != BuildModeOCI {
+			return "", fmt.Errorf("the %s format is only supported in oci builds", format)
+		}
+	default:
+		return "", fmt.Errorf("unknown image format %q", format)
+	}
+	if format == WriteFormatOCIDir {
+		return a.writeOCIDir(output, overwrite)
+	}
+
 	if a.Mode == BuildModeAppC {
 		man, err := util.GetManifest(a.CurrentImagePath)
 		if err != nil {
@@ -90,15 +124,28 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 	}()
 
-	// setup compression
-	gzwriter := gzip.NewWriter(ofile)
-	defer gzwriter.Close()
+	// setup compression, OCI and docker archives are plain tar files
+	var w io.Writer = ofile
+	if format == WriteFormatDefault {
+		cwriter, err := util.NewCompressWriter(ofile, a.Compression, a.CompressionLevel)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			// The compressed data is only all written out once this is
+			// closed, so an error here leaves the image incomplete
+			if err1 := cwriter.Close(); err == nil {
+				err = err1
+			}
+		}()
+		w = cwriter
+	}
 
 	// setup hasher
 	hasher := sha512.New()
 
 	// setup tar writer
-	twriter := tar.NewWriter(&duplexer{[]io.Writer{gzwriter, hasher}})
+	twriter := tar.NewWriter(&duplexer{[]io.Writer{w, hasher}})
 	defer twriter.Close()
 
 	// create the aci writer
@@ -108,6 +155,12 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		if err != nil {
 			return "", err
 		}
+		// Files added since the whitelist was last updated would be left out
+		// of the image otherwise
+		man.PathWhitelist, err = addRootfsToPathWhitelist(path.Join(a.CurrentImagePath, aci.RootfsDir), man.PathWhitelist)
+		if err != nil {
+			return "", err
+		}
 		aw := aci.NewImageWriter(*man, twriter)
 		err = filepath.Walk(a.CurrentImagePath, aci.BuildWalker(a.CurrentImagePath, aw, nil))
 		defer aw.Close()
@@ -128,10 +181,24 @@ func (a *ACBuild) Write(output string, overwrite bool) (id string, err error) {
 		}
 		aw.Close()
 	case BuildModeOCI:
+		if format == WriteFormatDockerArchive {
+			id, err = a.writeDockerArchive(twriter)
+			if err != nil {
+				return "", err
+			}
+			return id, twriter.Close()
+		}
 		err = filepath.Walk(a.CurrentImagePath, util.PathWalker(twriter, a.CurrentImagePath))
 		if err != nil {
 			return "", err
 		}
+		if format == WriteFormatOCIArchive {
+			ociMan, ok := a.man.(*oci.Image)
+			if !ok {
+				return "", fmt.Errorf("internal error: mismatched manifest type and build mode???")
+			}
+			return ociMan.GetRef().Digest, twriter.Close()
+		}
 	}
 	twriter.Flush()
 	hash := "sha512-" + hex.EncodeToString(hasher.Sum(nil))
@@ -0,0 +1,355 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package docker is a client for fetching images from and pushing images to
+// registries speaking the Docker Registry HTTP API V2, which OCI images are
+// distributed with as well.
+package docker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+)
+
+// The media types of docker's image format, which registries serve alongside
+// the OCI ones.
+const (
+	MediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Client fetches manifests and blobs from registries, and pushes them to
+// them. The authorization registries ask for is kept for the following
+// requests.
+type Client struct {
+	// Insecure allows talking to registries over plain HTTP or with
+	// certificates that can't be verified.
+	Insecure bool
+	// Credentials are the credentials to authenticate to registries with,
+	// keyed by their hostname. Registries without credentials are accessed
+	// anonymously.
+	Credentials map[string]Credentials
+	// ChunkSize is the size of the chunks blobs larger than it are uploaded
+	// in. DefaultChunkSize is used if it's 0.
+	ChunkSize int64
+
+	http    *http.Client
+	schemes map[string]string
+	// auth holds the Authorization headers to send, keyed by registry and
+	// the scopes they grant.
+	auth map[string]string
+}
+
+// NewClient returns a new Client.
+func NewClient(insecure bool) *Client {
+	c := &Client{
+		Insecure: insecure,
+		http:     &http.Client{},
+		schemes:  make(map[string]string),
+		auth:     make(map[string]string),
+	}
+	if insecure {
+		c.http.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return c
+}
+
+// GetManifest fetches the manifest of the image ref refers to, accepting
+// manifests of the given media types. The manifest is returned along with its
+// media type and digest, which is checked against the one in ref if it has
+// one.
+func (c *Client) GetManifest(ref Reference, mediaTypes ...string) ([]byte, string, string, error) {
+	header := http.Header{"Accept": []string{strings.Join(mediaTypes, ", ")}}
+	resp, err := c.get(ref, "manifests/"+ref.manifestRef(), header)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error fetching manifest of %s: %v", ref, err)
+	}
+	defer resp.Body.Close()
+
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("error fetching manifest of %s: %v", ref, err)
+	}
+	dgst := digest.FromBytes(blob).String()
+	if ref.Digest != "" && dgst != ref.Digest {
+		return nil, "", "", fmt.Errorf("manifest of %s has digest %s", ref, dgst)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.IndexRune(mediaType, ';'); i != -1 {
+		mediaType = mediaType[:i]
+	}
+	if mediaType == "" || mediaType == "application/json" {
+		// Not all registries bother setting it, but manifests have
+		// their media type in them too
+		var m struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(blob, &m)
+		mediaType = m.MediaType
+	}
+	return blob, mediaType, dgst, nil
+}
+
+// GetBlob copies the blob with the given digest from the repository of ref to
+// w, returning its size. An error is returned if what the registry sent
+// doesn't match the digest, and w should be discarded.
+func (c *Client) GetBlob(ref Reference, dgst string, w io.Writer) (int64, error) {
+	verifier, err := digest.NewDigestVerifier(digest.Digest(dgst))
+	if err != nil {
+		return 0, fmt.Errorf("invalid blob digest %q: %v", dgst, err)
+	}
+	resp, err := c.get(ref, "blobs/"+dgst, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching blob %s: %v", dgst, err)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.MultiWriter(w, verifier), resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("error fetching blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		return n, fmt.Errorf("blob %s from %s doesn't match its digest", dgst, ref.Registry)
+	}
+	return n, nil
+}
+
+// get requests the given path under the API endpoint of ref's repository,
+// authenticating if the registry asks for it. The response is only returned if
+// it has a 200 status code.
+func (c *Client) get(ref Reference, p string, header http.Header) (*http.Response, error) {
+	scopes := []string{"repository:" + ref.Repository + ":pull"}
+	resp, err := c.request("GET", c.endpoint(ref)+p, ref, header, nil, scopes)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// endpoint returns the URL of the API endpoint of ref's repository, which
+// the paths of requests for it are relative to.
+func (c *Client) endpoint(ref Reference) string {
+	return fmt.Sprintf("%s://%s/v2/%s/", c.scheme(ref.Registry), ref.Registry, ref.Repository)
+}
+
+// request sends a request to u on ref's registry, authenticating with
+// authorization for the given scopes if the registry asks for it. The
+// response is returned whatever its status code.
+func (c *Client) request(method, u string, ref Reference, header http.Header, body []byte, scopes []string) (*http.Response, error) {
+	authKey := ref.Registry + " " + strings.Join(scopes, " ")
+
+	resp, err := c.do(method, u, header, body, c.auth[authKey])
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		auth, err := c.authorize(ref.Registry, challenge, scopes)
+		if err != nil {
+			return nil, err
+		}
+		c.auth[authKey] = auth
+		resp, err = c.do(method, u, header, body, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) do(method, u string, header http.Header, body []byte, auth string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return c.http.Do(req)
+}
+
+// authorize returns the Authorization header to send to registry for the
+// given scopes, as asked for by challenge, which is the WWW-Authenticate
+// header of a response the registry refused to serve without one.
+func (c *Client) authorize(registry, challenge string, scopes []string) (string, error) {
+	creds, hasCreds := c.Credentials[registry]
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		if !hasCreds {
+			return "", fmt.Errorf("%s requires credentials", registry)
+		}
+		return "Basic " + creds.basicAuth(), nil
+	}
+	token, err := c.token(challenge, scopes, creds)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+// scheme returns the URL scheme to reach registry with. That's always https,
+// unless the client is insecure and the registry can't be reached that way.
+func (c *Client) scheme(registry string) string {
+	if s, ok := c.schemes[registry]; ok {
+		return s
+	}
+	if !c.Insecure {
+		return "https"
+	}
+	s := "https"
+	resp, err := c.http.Get("https://" + registry + "/v2/")
+	if err == nil {
+		resp.Body.Close()
+	} else {
+		s = "http"
+	}
+	c.schemes[registry] = s
+	return s
+}
+
+// token fetches a bearer token for the given scopes from the authorization
+// service named in challenge, authenticating with creds if they're set.
+func (c *Client) token(challenge string, scopes []string, creds Credentials) (string, error) {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok {
+		return "", fmt.Errorf("registry requires unsupported authentication %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry sent an invalid token realm %q", params["realm"])
+	}
+	q := realm.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	q.Del("scope")
+	for _, scope := range scopes {
+		q.Add("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if creds.Username != "" {
+		req.Header.Set("Authorization", "Basic "+creds.basicAuth())
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching token: %v", responseError(resp))
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return "", fmt.Errorf("error fetching token: %v", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("error fetching token: no token in response")
+	}
+	return t.Token, nil
+}
+
+// parseBearerChallenge returns the parameters of a WWW-Authenticate header
+// with a Bearer challenge, such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	const prefix = "bearer "
+	if len(challenge) < len(prefix) || !strings.EqualFold(challenge[:len(prefix)], prefix) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	s := strings.TrimSpace(challenge[len(prefix):])
+	for s != "" {
+		eq := strings.IndexRune(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexRune(s[1:], '"')
+			if end == -1 {
+				return nil, false
+			}
+			value, s = s[1:end+1], s[end+2:]
+		} else if comma := strings.IndexRune(s, ','); comma != -1 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+	return params, true
+}
+
+// responseError returns an error describing a response with an unexpected
+// status code, including the errors the registry gave for it if any.
+func responseError(resp *http.Response) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	blob, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if json.Unmarshal(blob, &body) == nil && len(body.Errors) > 0 {
+		var msgs []string
+		for _, e := range body.Errors {
+			msgs = append(msgs, e.Code+": "+e.Message)
+		}
+		return fmt.Errorf("%s (%s)", resp.Status, strings.Join(msgs, ", "))
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Credentials are a username and password to authenticate to a registry with.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+func (c Credentials) basicAuth() string {
+	return base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+}
+
+// LoadCredentials reads the credentials in the file at p, keyed by the
+// hostname of the registry they're for. The file is in the format of docker's
+// config.json, in which the "auths" object has the base64 encoded
+// "username:password" of each registry in "auth", or the username and
+// password in "username" and "password":
+//
+//	{"auths": {"example.com": {"auth": "dXNlcjpwYXNzd29yZA=="}}}
+func LoadCredentials(p string) (map[string]Credentials, error) {
+	blob, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	err = json.Unmarshal(blob, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials from %s: %v", p, err)
+	}
+
+	creds := make(map[string]Credentials)
+	for registry, a := range config.Auths {
+		c := Credentials{Username: a.Username, Password: a.Password}
+		if a.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("error reading credentials for %s from %s: %v", registry, p, err)
+			}
+			i := strings.IndexRune(string(decoded), ':')
+			if i == -1 {
+				return nil, fmt.Errorf("error reading credentials for %s from %s: expected username:password", registry, p)
+			}
+			c.Username, c.Password = string(decoded[:i]), string(decoded[i+1:])
+		}
+		creds[credentialsHost(registry)] = c
+	}
+	return creds, nil
+}
+
+// credentialsHost returns the hostname of the registry a key in the auths of
+// docker's config.json is for. The keys are either hostnames or URLs, such as
+// "https://index.docker.io/v1/" for the Docker Hub.
+func credentialsHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexRune(host, '/'); i != -1 {
+		host = host[:i]
+	}
+	switch host {
+	case "docker.io", "index.docker.io":
+		host = DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOnMzY3I6dA=="},
+		"localhost:5000": {"username": "me", "password": "pw"}
+	}}`)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := LoadCredentials(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Credentials{
+		DefaultRegistry:  {"hub", "s3cr:t"},
+		"localhost:5000": {"me", "pw"},
+	}
+	if !reflect.DeepEqual(creds, want) {
+		t.Errorf("got %v, expected %v", creds, want)
+	}
+}
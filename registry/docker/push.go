@@ -0,0 +1,216 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/docker/distribution/digest"
+)
+
+// DefaultChunkSize is the size of the chunks large blobs are uploaded in,
+// unless the client has another one set.
+const DefaultChunkSize = 5 << 20
+
+// The ways PushBlob can get a blob into a repository.
+const (
+	// BlobExisted means the repository had the blob already.
+	BlobExisted = "existed"
+	// BlobMounted means the blob was mounted from another repository.
+	BlobMounted = "mounted"
+	// BlobUploaded means the blob was uploaded.
+	BlobUploaded = "uploaded"
+)
+
+// pushScopes returns the scopes needed to push to ref's repository, and to
+// mount blobs from the repository from if it's not empty.
+func pushScopes(ref Reference, from string) []string {
+	scopes := []string{"repository:" + ref.Repository + ":pull,push"}
+	if from != "" {
+		scopes = append(scopes, "repository:"+from+":pull")
+	}
+	return scopes
+}
+
+// BlobExists returns whether the repository of ref has the blob with the
+// given digest.
+func (c *Client) BlobExists(ref Reference, dgst string) (bool, error) {
+	resp, err := c.request("HEAD", c.endpoint(ref)+"blobs/"+dgst, ref, nil, nil, pushScopes(ref, ""))
+	if err != nil {
+		return false, fmt.Errorf("error checking for blob %s: %v", dgst, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("error checking for blob %s: %v", dgst, responseError(resp))
+}
+
+// PushBlob makes sure the repository of ref has the blob with the given digest
+// and size, whose contents r reads. If the repository doesn't have it yet, it
+// is mounted from the repository from on the same registry if from is set and
+// has it, and uploaded otherwise. Blobs larger than the client's chunk size
+// are uploaded in chunks of it. How the blob got into the repository is
+// returned, as one of BlobExisted, BlobMounted and BlobUploaded.
+func (c *Client) PushBlob(ref Reference, dgst string, size int64, r io.Reader, from string) (string, error) {
+	exists, err := c.BlobExists(ref, dgst)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return BlobExisted, nil
+	}
+	if from == ref.Repository {
+		from = ""
+	}
+
+	scopes := pushScopes(ref, from)
+	u := c.endpoint(ref) + "blobs/uploads/"
+	if from != "" {
+		u += "?" + url.Values{"mount": {dgst}, "from": {from}}.Encode()
+	}
+	resp, err := c.request("POST", u, ref, nil, nil, scopes)
+	if err != nil {
+		return "", fmt.Errorf("error pushing blob %s: %v", dgst, err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusCreated && from != "":
+		return BlobMounted, nil
+	case resp.StatusCode != http.StatusAccepted:
+		return "", fmt.Errorf("error pushing blob %s: %v", dgst, responseError(resp))
+	}
+
+	// The registry started an upload instead, because it couldn't mount
+	// the blob or wasn't asked to
+	location, err := resolveLocation(u, resp.Header.Get("Location"))
+	if err != nil {
+		return "", fmt.Errorf("error pushing blob %s: %v", dgst, err)
+	}
+	err = c.upload(ref, location, dgst, size, r, scopes)
+	if err != nil {
+		return "", fmt.Errorf("error pushing blob %s: %v", dgst, err)
+	}
+	return BlobUploaded, nil
+}
+
+// upload uploads the blob r reads to the upload at location. Blobs no larger
+// than the chunk size are uploaded in a single request, and larger ones in
+// chunks before the upload is completed.
+func (c *Client) upload(ref Reference, location, dgst string, size int64, r io.Reader, scopes []string) error {
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if size <= chunkSize {
+		blob := make([]byte, size)
+		_, err := io.ReadFull(r, blob)
+		if err != nil {
+			return err
+		}
+		return c.completeUpload(ref, location, dgst, blob, scopes)
+	}
+
+	chunk := make([]byte, chunkSize)
+	for offset := int64(0); offset < size; {
+		n := chunkSize
+		if size-offset < n {
+			n = size - offset
+		}
+		_, err := io.ReadFull(r, chunk[:n])
+		if err != nil {
+			return err
+		}
+		header := http.Header{
+			"Content-Type":  {"application/octet-stream"},
+			"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+n-1)},
+		}
+		resp, err := c.request("PATCH", location, ref, header, chunk[:n], scopes)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return responseError(resp)
+		}
+		location, err = resolveLocation(location, resp.Header.Get("Location"))
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	return c.completeUpload(ref, location, dgst, nil, scopes)
+}
+
+// completeUpload finishes the upload at location of the blob with the given
+// digest, sending the rest of it along.
+func (c *Client) completeUpload(ref Reference, location, dgst string, rest []byte, scopes []string) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", dgst)
+	u.RawQuery = q.Encode()
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := c.request("PUT", u.String(), ref, header, rest, scopes)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// PutManifest pushes the manifest blob, of the given media type, to the tag
+// of ref, and returns its digest. The blobs it refers to must have been pushed
+// already.
+func (c *Client) PutManifest(ref Reference, mediaType string, blob []byte) (string, error) {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.request("PUT", c.endpoint(ref)+"manifests/"+ref.manifestRef(), ref, header, blob, pushScopes(ref, ""))
+	if err != nil {
+		return "", fmt.Errorf("error pushing manifest of %s: %v", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("error pushing manifest of %s: %v", ref, responseError(resp))
+	}
+	return digest.FromBytes(blob).String(), nil
+}
+
+// resolveLocation returns the URL in the Location header of a response to a
+// request for u, which may be relative to it.
+func resolveLocation(u, location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("registry sent no upload location")
+	}
+	base, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	l, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("registry sent an invalid upload location %q", location)
+	}
+	return base.ResolveReference(l).String(), nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	// DefaultRegistry is the registry images without a hostname in their
+	// reference are fetched from.
+	DefaultRegistry = "registry-1.docker.io"
+	// DefaultTag is the tag of images referenced by neither tag nor digest.
+	DefaultTag = "latest"
+
+	officialRepoPrefix = "library/"
+)
+
+// Reference identifies an image in a registry.
+type Reference struct {
+	// Registry is the hostname, and optionally the port, of the registry.
+	Registry string
+	// Repository is the name of the image's repository in the registry.
+	Repository string
+	// Tag is the image's tag. It's empty if the image is referenced by
+	// digest.
+	Tag string
+	// Digest is the digest of the image's manifest, or empty if the image
+	// is referenced by tag.
+	Digest string
+}
+
+// ParseReference parses an image reference of the form
+// [host[:port]/]repository[:tag][@digest], as used by docker. Images without a
+// host are on the Docker Hub, where official images are in the library
+// namespace, and images with neither tag nor digest have the latest tag.
+func ParseReference(s string) (Reference, error) {
+	named, err := reference.ParseNamed(s)
+	if err != nil {
+		return Reference{}, fmt.Errorf("invalid image reference %q: %v", s, err)
+	}
+
+	var ref Reference
+	name := named.Name()
+	i := strings.IndexRune(name, '/')
+	if i == -1 || (!strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost") {
+		ref.Registry, ref.Repository = DefaultRegistry, name
+	} else {
+		ref.Registry, ref.Repository = name[:i], name[i+1:]
+	}
+	switch ref.Registry {
+	case "docker.io", "index.docker.io":
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.ContainsRune(ref.Repository, '/') {
+		ref.Repository = officialRepoPrefix + ref.Repository
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest().String()
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	return ref, nil
+}
+
+// String returns the reference in the form ParseReference accepts.
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// manifestRef returns what identifies the image's manifest in the registry's
+// API, which is its digest if it's known.
+func (r Reference) manifestRef() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
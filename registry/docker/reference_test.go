@@ -0,0 +1,70 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseReference(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Reference
+	}{
+		{"alpine", Reference{DefaultRegistry, "library/alpine", "latest", ""}},
+		{"alpine:3.5", Reference{DefaultRegistry, "library/alpine", "3.5", ""}},
+		{"docker.io/coreos/etcd", Reference{DefaultRegistry, "coreos/etcd", "latest", ""}},
+		{"quay.io/coreos/etcd:v3", Reference{"quay.io", "coreos/etcd", "v3", ""}},
+		{"localhost/foo", Reference{"localhost", "foo", "latest", ""}},
+		{"localhost:5000/foo/bar:v1", Reference{"localhost:5000", "foo/bar", "v1", ""}},
+		{"127.0.0.1:5000/foo@" + testDigest, Reference{"127.0.0.1:5000", "foo", "", testDigest}},
+		{"foo:v1@" + testDigest, Reference{DefaultRegistry, "library/foo", "v1", testDigest}},
+	}
+	for _, c := range cases {
+		got, err := ParseReference(c.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, expected %+v", c.in, got, c.want)
+		}
+	}
+
+	for _, in := range []string{"", "UPPER/case", "foo@sha256:short", "foo:bad tag"} {
+		if _, err := ParseReference(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	params, ok := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+	want := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/alpine:pull",
+	}
+	if !ok || !reflect.DeepEqual(params, want) {
+		t.Errorf("got %v, expected %v", params, want)
+	}
+
+	if _, ok := parseBearerChallenge(`Basic realm="registry"`); ok {
+		t.Errorf("Basic challenge was accepted")
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testDockerImage is an image to put in a docker archive, with a layer for
+// each of contents, and cmd as the command in its config.
+type testDockerImage struct {
+	repoTag  string
+	arch     string
+	cmd      string
+	contents []string
+}
+
+// mustWriteDockerArchive writes an archive like the ones `docker save` makes
+// to dir, with the given images in it. The archive's path and the diffIDs of
+// the layers of the first image are returned.
+func mustWriteDockerArchive(dir string, images ...testDockerImage) (string, []string) {
+	var files, firstDiffIDs []string
+	var manifest []map[string]interface{}
+	for _, img := range images {
+		var diffIDs, layerPaths []string
+		for i, content := range img.contents {
+			layer := mustMakeTar(fmt.Sprintf("file%d", i), content)
+			diffID := testDigest(layer)
+			layerPath := strings.TrimPrefix(diffID, "sha256:") + "/layer.tar"
+			files = append(files, layerPath, string(layer))
+			diffIDs = append(diffIDs, diffID)
+			layerPaths = append(layerPaths, layerPath)
+		}
+		if firstDiffIDs == nil {
+			firstDiffIDs = diffIDs
+		}
+
+		arch := img.arch
+		if arch == "" {
+			arch = runtime.GOARCH
+		}
+		config, err := json.Marshal(map[string]interface{}{
+			"architecture": arch,
+			"os":           runtime.GOOS,
+			"config":       map[string][]string{"Cmd": {img.cmd}},
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		if err != nil {
+			panic(err)
+		}
+		configPath := strings.TrimPrefix(testDigest(config), "sha256:") + ".json"
+		files = append(files, configPath, string(config))
+
+		manifest = append(manifest, map[string]interface{}{
+			"Config":   configPath,
+			"RepoTags": []string{img.repoTag},
+			"Layers":   layerPaths,
+		})
+	}
+	manifestBlob, err := json.Marshal(manifest)
+	if err != nil {
+		panic(err)
+	}
+	files = append(files, "manifest.json", string(manifestBlob))
+
+	archive := path.Join(dir, "docker-archive.tar")
+	err = ioutil.WriteFile(archive, mustMakeTar(files...), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return archive, firstDiffIDs
+}
+
+func TestBeginDockerArchive(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	archive, diffIDs := mustWriteDockerArchive(tmpdir, testDockerImage{
+		repoTag:  "example.com/foo:v1",
+		cmd:      "/file0",
+		contents: []string{"foo", "bar"},
+	})
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	checkOCILayout(t, path.Join(workingDir, ".acbuild", "currentaci"), "v1")
+
+	_, out, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var man testManifest
+	err = json.Unmarshal([]byte(out), &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(man.Layers) != len(diffIDs) {
+		t.Fatalf("expected %d layers, got %d", len(diffIDs), len(man.Layers))
+	}
+	for i, layer := range man.Layers {
+		// docker's layers aren't compressed, so their digests are their
+		// diffIDs
+		if layer.MediaType != "application/vnd.oci.image.layer.v1.tar" || layer.Digest != diffIDs[i] {
+			t.Errorf("unexpected layer %+v, expected digest %s", layer, diffIDs[i])
+		}
+	}
+
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(config, "/file0") || !strings.Contains(config, diffIDs[1]) {
+		t.Errorf("image config was lost: %s", config)
+	}
+
+	checkBaseLayersKept(t, workingDir, diffIDs)
+}
+
+func TestBeginDockerArchiveBadDiffID(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	archive, diffIDs := mustWriteDockerArchive(tmpdir, testDockerImage{
+		repoTag:  "foo:latest",
+		cmd:      "/file0",
+		contents: []string{"foo"},
+	})
+
+	// Swap the layer for another one, leaving the config alone
+	blob, err := ioutil.ReadFile(archive)
+	if err != nil {
+		panic(err)
+	}
+	blob = []byte(strings.Replace(string(blob), "foo", "baz", 1))
+	err = ioutil.WriteFile(archive, blob, 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "begin", "--build-mode=oci", archive)
+	if err == nil {
+		t.Fatalf("begin succeeded with a layer not matching its diffID")
+	}
+	if !strings.Contains(stderr, "expected "+diffIDs[0]) {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+}
+
+// mustMakeTarWithLinks makes a tar like mustMakeTar, with symlinks from the
+// first to the second path of each of links in directories of their own
+// before the files.
+func mustMakeTarWithLinks(links [][2]string, files ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, l := range links {
+		err := tw.WriteHeader(&tar.Header{Name: path.Dir(l[0]) + "/", Mode: 0755, Typeflag: tar.TypeDir})
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: l[0], Linkname: l[1], Mode: 0777, Typeflag: tar.TypeSymlink})
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < len(files); i += 2 {
+		err := tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write([]byte(files[i+1]))
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBeginDockerArchiveLayerOutside(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	// A file outside of the archive, which its layer is a symlink to
+	outside := path.Join(tmpdir, "outside.tar")
+	layer := mustMakeTar("file0", "foo")
+	err := ioutil.WriteFile(outside, layer, 0644)
+	if err != nil {
+		panic(err)
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{testDigest(layer)}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config": "config.json",
+		"Layers": []string{"x/layer.tar"},
+	}})
+	if err != nil {
+		panic(err)
+	}
+
+	archive := path.Join(tmpdir, "docker-archive.tar")
+	err = ioutil.WriteFile(archive, mustMakeTarWithLinks([][2]string{{"x/layer.tar", outside}}, "config.json", string(config), "manifest.json", string(manifest)), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err = runACBuildNoHist(workingDir, "begin", "--build-mode=oci", archive)
+	if err == nil {
+		t.Errorf("begin succeeded with a layer outside of the archive")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file the layer linked to was moved: %v", err)
+	}
+}
+
+func TestBeginDockerArchiveDuplicateLayer(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	// docker save writes a layer that's in the image twice once, and links
+	// the second copy to the first
+	layer := mustMakeTar("file0", "foo")
+	diffID := testDigest(layer)
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           runtime.GOOS,
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID, diffID}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config": "config.json",
+		"Layers": []string{"l0/layer.tar", "l1/layer.tar"},
+	}})
+	if err != nil {
+		panic(err)
+	}
+	archive := path.Join(tmpdir, "docker-archive.tar")
+	err = ioutil.WriteFile(archive, mustMakeTarWithLinks([][2]string{{"l1/layer.tar", "../l0/layer.tar"}}, "l0/layer.tar", string(layer), "config.json", string(config), "manifest.json", string(manifest)), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err = runACBuildNoHist(workingDir, "begin", "--build-mode=oci", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, out, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var man testManifest
+	err = json.Unmarshal([]byte(out), &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(man.Layers) != 2 || man.Layers[0].Digest != diffID || man.Layers[1].Digest != diffID {
+		t.Errorf("expected the layer %s twice, got %+v", diffID, man.Layers)
+	}
+}
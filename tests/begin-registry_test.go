@@ -0,0 +1,583 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	testRegistryRepo     = "test/image"
+	testRegistryUser     = "tester"
+	testRegistryPassword = "secret"
+)
+
+// testRegistry is a stand-in for a registry, which hands out tokens the way
+// the Docker Hub does. Anyone may pull, but pushing takes the test user's
+// credentials.
+type testRegistry struct {
+	// blobs holds the contents of all the blobs in the registry
+	blobs map[string][]byte
+	repos map[string]*testRepository
+	// uploads holds the blob uploads in progress, by their ID
+	uploads map[string][]byte
+	// tokens holds the scopes of the tokens handed out
+	tokens map[string][]string
+
+	// The number of blobs mounted, uploads finished, and chunks uploaded
+	mounts, uploaded, chunks int
+}
+
+// testRepository is a repository in a testRegistry.
+type testRepository struct {
+	manifests map[string]testRegistryBlob
+	blobs     map[string]bool
+}
+
+type testRegistryBlob struct {
+	mediaType string
+	content   []byte
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		blobs:   make(map[string][]byte),
+		repos:   make(map[string]*testRepository),
+		uploads: make(map[string][]byte),
+		tokens:  make(map[string][]string),
+	}
+}
+
+// repo returns the repository with the given name, creating it if it doesn't
+// exist.
+func (r *testRegistry) repo(name string) *testRepository {
+	if repo, ok := r.repos[name]; ok {
+		return repo
+	}
+	repo := &testRepository{
+		manifests: make(map[string]testRegistryBlob),
+		blobs:     make(map[string]bool),
+	}
+	r.repos[name] = repo
+	return repo
+}
+
+func testDigest(content []byte) string {
+	h := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// addBlob adds a blob to the test repository, and returns its digest.
+func (r *testRegistry) addBlob(content []byte) string {
+	d := testDigest(content)
+	r.blobs[d] = content
+	r.repo(testRegistryRepo).blobs[d] = true
+	return d
+}
+
+// addManifest marshals m and serves it from the test repository by digest,
+// and by tag if one is given. The digest is returned.
+func (r *testRegistry) addManifest(mediaType, tag string, m interface{}) string {
+	content, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	d := testDigest(content)
+	repo := r.repo(testRegistryRepo)
+	repo.manifests[d] = testRegistryBlob{mediaType, content}
+	if tag != "" {
+		repo.manifests[tag] = testRegistryBlob{mediaType, content}
+	}
+	return d
+}
+
+var testRegistryPath = regexp.MustCompile("^/v2/(.+)/(manifests|blobs)/(.*)$")
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	m := testRegistryPath.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+	name, kind, p := m[1], m[2], m[3]
+	scopes := []string{name + ":pull"}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		scopes = []string{name + ":push"}
+	}
+	if from := req.URL.Query().Get("from"); from != "" {
+		scopes = append(scopes, from+":pull")
+	}
+	if !r.authorized(req, scopes) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	repo := r.repo(name)
+	switch {
+	case kind == "manifests" && req.Method == "PUT":
+		r.putManifest(w, req, repo, p)
+	case kind == "manifests":
+		m, ok := repo.manifests[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`)
+			return
+		}
+		if !strings.Contains(req.Header.Get("Accept"), m.mediaType) {
+			http.Error(w, "manifest type not accepted", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Write(m.content)
+	case strings.HasPrefix(p, "uploads/"):
+		r.serveUpload(w, req, name, strings.TrimPrefix(p, "uploads/"))
+	default:
+		blob, ok := r.blobs[p]
+		if !ok || !repo.blobs[p] {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if req.Method != "HEAD" {
+			w.Write(blob)
+		}
+	}
+}
+
+// serveToken hands out tokens for the scopes asked for, as long as the test
+// user's credentials are given for pushing.
+func (r *testRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	var scopes []string
+	for _, scope := range req.URL.Query()["scope"] {
+		parts := strings.Split(scope, ":")
+		if len(parts) != 3 || parts[0] != "repository" {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		for _, action := range strings.Split(parts[2], ",") {
+			if action == "push" {
+				user, password, ok := req.BasicAuth()
+				if !ok || user != testRegistryUser || password != testRegistryPassword {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprint(w, `{"errors": [{"code": "UNAUTHORIZED", "message": "bad credentials"}]}`)
+					return
+				}
+			}
+			scopes = append(scopes, parts[1]+":"+action)
+		}
+	}
+	token := fmt.Sprintf("token-%d", len(r.tokens))
+	r.tokens[token] = scopes
+	fmt.Fprintf(w, `{"token": %q}`, token)
+}
+
+// authorized returns whether req has a token for all of the given scopes.
+func (r *testRegistry) authorized(req *http.Request, scopes []string) bool {
+	granted, ok := r.tokens[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")]
+	if !ok {
+		return false
+	}
+	for _, scope := range scopes {
+		found := false
+		for _, g := range granted {
+			found = found || g == scope
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serveUpload handles starting, continuing and finishing blob uploads, and
+// blob mounts.
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	repo := r.repo(name)
+	q := req.URL.Query()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	if req.Method == "POST" {
+		if d := q.Get("mount"); d != "" && r.repo(q.Get("from")).blobs[d] {
+			repo.blobs[d] = true
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id = fmt.Sprintf("upload-%d", len(r.uploads))
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	upload, ok := r.uploads[id]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case "PATCH":
+		if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", len(upload), len(upload)+len(body)-1) {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(upload, body...)
+		r.chunks++
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		content := append(upload, body...)
+		d := q.Get("digest")
+		if testDigest(content) != d {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": [{"code": "DIGEST_INVALID", "message": "digest mismatch"}]}`)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[d] = content
+		repo.blobs[d] = true
+		r.uploaded++
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// putManifest stores the manifest in the body of req in repo under ref, and
+// its digest, as long as repo has the blobs it refers to.
+func (r *testRegistry) putManifest(w http.ResponseWriter, req *http.Request, repo *testRepository, ref string) {
+	content, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	var man testManifest
+	err = json.Unmarshal(content, &man)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, d := range append([]testDescriptor{man.Config}, man.Layers...) {
+		if !repo.blobs[d.Digest] {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors": [{"code": "MANIFEST_BLOB_UNKNOWN", "message": "blob %s unknown"}]}`, d.Digest)
+			return
+		}
+	}
+	blob := testRegistryBlob{req.Header.Get("Content-Type"), content}
+	repo.manifests[ref] = blob
+	repo.manifests[testDigest(content)] = blob
+	w.Header().Set("Docker-Content-Digest", testDigest(content))
+	w.WriteHeader(http.StatusCreated)
+}
+
+type testDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int    `json:"size"`
+}
+
+type testManifest struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	MediaType     string           `json:"mediaType"`
+	Config        testDescriptor   `json:"config"`
+	Layers        []testDescriptor `json:"layers"`
+}
+
+// mustMakeTar returns a tar file with the given files in it, in the order
+// they're given, as name and content pairs.
+func mustMakeTar(files ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     files[i],
+			Mode:     0644,
+			Size:     int64(len(files[i+1])),
+			Typeflag: tar.TypeReg,
+		})
+		if err == nil {
+			_, err = tw.Write([]byte(files[i+1]))
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func mustMakeLayer(name, content string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(mustMakeTar(name, content))
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// checkBaseLayersKept checks that changing the image in the build context at
+// workingDir adds a layer on top of the layers with the given digests rather
+// than changing them.
+func checkBaseLayersKept(t *testing.T, workingDir string, digests []string) {
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	err = runACBuildNoHist(workingDir, "copy", f.Name(), "/new-file")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, out, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var man testManifest
+	err = json.Unmarshal([]byte(out), &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(man.Layers) != len(digests)+1 {
+		t.Fatalf("expected %d layers after copy, got %d", len(digests)+1, len(man.Layers))
+	}
+	for i, d := range digests {
+		if man.Layers[i].Digest != d {
+			t.Errorf("layer %d changed from %s to %s", i, d, man.Layers[i].Digest)
+		}
+	}
+}
+
+// addTestImage adds an image with two layers to reg, with manifests of the
+// given media types, and returns its manifest.
+func addTestImage(reg *testRegistry, manifestType, configType, layerType string) testManifest {
+	man := testManifest{
+		SchemaVersion: 2,
+		MediaType:     manifestType,
+	}
+	for i, content := range []string{"foo", "bar"} {
+		layer := mustMakeLayer(fmt.Sprintf("file%d", i), content)
+		man.Layers = append(man.Layers, testDescriptor{layerType, reg.addBlob(layer), len(layer)})
+	}
+	config := []byte(fmt.Sprintf(`{"architecture": %q, "os": %q, "config": {"Cmd": ["/file0"]}}`, runtime.GOARCH, runtime.GOOS))
+	man.Config = testDescriptor{configType, reg.addBlob(config), len(config)}
+	return man
+}
+
+type beginRegistryIndex struct {
+	Manifests []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"manifests"`
+}
+
+// checkRegistryImage checks that the image in the build context at workingDir
+// has the layers of man, and returns the digest of its manifest.
+func checkRegistryImage(t *testing.T, workingDir, tag string, man testManifest) string {
+	imageDir := path.Join(workingDir, ".acbuild", "currentaci")
+	checkOCILayout(t, imageDir, tag)
+
+	blob, err := ioutil.ReadFile(path.Join(imageDir, "index.json"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var idx beginRegistryIndex
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest in the index, got %d", len(idx.Manifests))
+	}
+
+	_, out, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var got testManifest
+	err = json.Unmarshal([]byte(out), &got)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if got.MediaType != "application/vnd.oci.image.manifest.v1+json" {
+		t.Errorf("unexpected manifest media type %q", got.MediaType)
+	}
+	if got.Config.MediaType != "application/vnd.oci.image.config.v1+json" || got.Config.Digest != man.Config.Digest {
+		t.Errorf("unexpected config %+v, expected digest %s", got.Config, man.Config.Digest)
+	}
+	if len(got.Layers) != len(man.Layers) {
+		t.Fatalf("expected %d layers, got %d", len(man.Layers), len(got.Layers))
+	}
+	for i, layer := range got.Layers {
+		if layer.MediaType != "application/vnd.oci.image.layer.v1.tar+gzip" || layer.Digest != man.Layers[i].Digest {
+			t.Errorf("unexpected layer %+v, expected digest %s", layer, man.Layers[i].Digest)
+		}
+		_, err = os.Stat(path.Join(imageDir, "blobs", strings.Replace(layer.Digest, ":", "/", 1)))
+		if err != nil {
+			t.Errorf("layer is missing: %v", err)
+		}
+	}
+
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(config, "/file0") {
+		t.Errorf("image config was lost: %s", config)
+	}
+	return idx.Manifests[0].Digest
+}
+
+func TestBeginDockerRegistry(t *testing.T) {
+	reg := newTestRegistry()
+	man := addTestImage(reg,
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.container.image.v1+json",
+		"application/vnd.docker.image.rootfs.diff.tar.gzip")
+	manDigest := reg.addManifest(man.MediaType, "", man)
+	otherArch := "s390x"
+	if runtime.GOARCH == otherArch {
+		otherArch = "ppc64le"
+	}
+	list := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": []map[string]interface{}{
+			{
+				"mediaType": man.MediaType,
+				"digest":    testDigest([]byte("some other image")),
+				"size":      16,
+				"platform":  map[string]string{"architecture": otherArch, "os": runtime.GOOS},
+			},
+			{
+				"mediaType": man.MediaType,
+				"digest":    manDigest,
+				"size":      len(reg.repo(testRegistryRepo).manifests[manDigest].content),
+				"platform":  map[string]string{"architecture": runtime.GOARCH, "os": runtime.GOOS},
+			},
+		},
+	}
+	reg.addManifest("application/vnd.docker.distribution.manifest.list.v2+json", "v1", list)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	host := strings.TrimPrefix(server.URL, "http://")
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--insecure", "docker://"+host+"/"+testRegistryRepo+":v1")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	checkRegistryImage(t, workingDir, "v1", man)
+	checkBaseLayersKept(t, workingDir, []string{man.Layers[0].Digest, man.Layers[1].Digest})
+}
+
+func TestBeginOCIRegistryByDigest(t *testing.T) {
+	reg := newTestRegistry()
+	man := addTestImage(reg,
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.config.v1+json",
+		"application/vnd.oci.image.layer.v1.tar+gzip")
+	manDigest := reg.addManifest(man.MediaType, "", man)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	host := strings.TrimPrefix(server.URL, "http://")
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--insecure", "oci://"+host+"/"+testRegistryRepo+"@"+manDigest)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	// OCI manifests are kept as they are
+	if d := checkRegistryImage(t, workingDir, "latest", man); d != manDigest {
+		t.Errorf("manifest digest changed from %s to %s", manDigest, d)
+	}
+}
+
+func TestBeginRegistryCorruptBlob(t *testing.T) {
+	reg := newTestRegistry()
+	man := addTestImage(reg,
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.config.v1+json",
+		"application/vnd.oci.image.layer.v1.tar+gzip")
+	reg.addManifest(man.MediaType, "v1", man)
+	reg.blobs[man.Layers[1].Digest] = mustMakeLayer("file1", "baz")
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	host := strings.TrimPrefix(server.URL, "http://")
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "begin", "--build-mode=oci", "--insecure", "docker://"+host+"/"+testRegistryRepo+":v1")
+	if err == nil {
+		t.Fatalf("begin succeeded with a corrupt layer")
+	}
+	if !strings.Contains(stderr, "doesn't match its digest") {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+	if _, err := os.Stat(path.Join(workingDir, ".acbuild")); !os.IsNotExist(err) {
+		t.Errorf("build context was left behind")
+	}
+}
+
+func TestBeginRegistryUnknownTag(t *testing.T) {
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	host := strings.TrimPrefix(server.URL, "http://")
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "begin", "--build-mode=oci", "--insecure", "docker://"+host+"/"+testRegistryRepo+":nope")
+	if err == nil {
+		t.Fatalf("begin succeeded with an unknown tag")
+	}
+	if !strings.Contains(stderr, "MANIFEST_UNKNOWN") {
+		t.Errorf("unexpected error: %s", stderr)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// otherArch returns an architecture other than the one the tests run on.
+func otherArch() string {
+	if runtime.GOARCH == "s390x" {
+		return "ppc64le"
+	}
+	return "s390x"
+}
+
+// testOCIArchive builds an uncompressed tar of an image layout.
+type testOCIArchive struct {
+	files []string
+	index []map[string]interface{}
+}
+
+func mustMarshal(v interface{}) []byte {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return blob
+}
+
+func (a *testOCIArchive) addBlob(blob []byte) map[string]interface{} {
+	d := testDigest(blob)
+	a.files = append(a.files, "blobs/sha256/"+strings.TrimPrefix(d, "sha256:"), string(blob))
+	return map[string]interface{}{"digest": d, "size": len(blob)}
+}
+
+// addImage adds the blobs of an image for arch with cmd as its command, and
+// returns a descriptor of its manifest.
+func (a *testOCIArchive) addImage(arch, cmd string) map[string]interface{} {
+	layer := a.addBlob(mustMakeLayer("file", cmd))
+	layer["mediaType"] = "application/vnd.oci.image.layer.v1.tar+gzip"
+	config := a.addBlob(mustMarshal(map[string]interface{}{
+		"architecture": arch,
+		"os":           runtime.GOOS,
+		"config":       map[string][]string{"Cmd": {cmd}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{"sha256:unused"}},
+	}))
+	config["mediaType"] = "application/vnd.oci.image.config.v1+json"
+	man := a.addBlob(mustMarshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        config,
+		"layers":        []interface{}{layer},
+	}))
+	man["mediaType"] = "application/vnd.oci.image.manifest.v1+json"
+	return man
+}
+
+func (a *testOCIArchive) addRef(ref string, desc map[string]interface{}) {
+	desc["annotations"] = map[string]string{"org.opencontainers.image.ref.name": ref}
+	a.index = append(a.index, desc)
+}
+
+// addMultiPlatformRef adds an index with images with the commands in cmds,
+// keyed by their architecture, under ref.
+func (a *testOCIArchive) addMultiPlatformRef(ref string, cmds map[string]string) {
+	var manifests []interface{}
+	for arch, cmd := range cmds {
+		m := a.addImage(arch, cmd)
+		m["platform"] = map[string]string{"architecture": arch, "os": runtime.GOOS}
+		manifests = append(manifests, m)
+	}
+	a.addIndexRef(ref, manifests)
+}
+
+// addIndexRef adds an index with the given manifest descriptors under ref.
+func (a *testOCIArchive) addIndexRef(ref string, manifests []interface{}) {
+	idx := a.addBlob(mustMarshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     manifests,
+	}))
+	idx["mediaType"] = "application/vnd.oci.image.index.v1+json"
+	a.addRef(ref, idx)
+}
+
+func (a *testOCIArchive) mustWrite(dir string) string {
+	files := append(a.files,
+		"oci-layout", `{"imageLayoutVersion":"1.0.0"}`,
+		"index.json", string(mustMarshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests":     a.index,
+		})))
+	archive := path.Join(dir, "oci-archive.tar")
+	err := ioutil.WriteFile(archive, mustMakeTar(files...), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return archive
+}
+
+// checkBeginSelect begins a build from archive with the given extra arguments
+// to begin, and checks that the image with wantCmd and the ref wantRef was
+// chosen.
+func checkBeginSelect(t *testing.T, archive string, args []string, wantCmd, wantRef string) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	beginArgs := append([]string{"--no-history", "begin", "--build-mode=oci"}, args...)
+	_, _, stderr, err := runACBuild(workingDir, append(beginArgs, archive)...)
+	if err != nil {
+		t.Errorf("%v: %v", args, err)
+		return
+	}
+	if stderr != "" {
+		t.Errorf("%v: stderr wasn't empty: %s", args, stderr)
+	}
+
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Errorf("%v: %v", args, err)
+		return
+	}
+	if !strings.Contains(config, fmt.Sprintf("%q", wantCmd)) {
+		t.Errorf("%v: expected the image with %s, got %s", args, wantCmd, config)
+	}
+	checkOCILayout(t, path.Join(workingDir, ".acbuild", "currentaci"), wantRef)
+}
+
+// checkBeginSelectFails checks that beginning a build from archive with the
+// given extra arguments to begin fails with an error containing wantErr.
+func checkBeginSelectFails(t *testing.T, archive string, args []string, wantErr string) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	beginArgs := append([]string{"--no-history", "begin", "--build-mode=oci"}, args...)
+	_, _, stderr, err := runACBuild(workingDir, append(beginArgs, archive)...)
+	if err == nil {
+		t.Errorf("%v: begin succeeded", args)
+		return
+	}
+	if !strings.Contains(stderr, wantErr) {
+		t.Errorf("%v: expected an error with %q, got: %s", args, wantErr, stderr)
+	}
+}
+
+func TestBeginOCIArchiveSelect(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	var a testOCIArchive
+	a.addRef("a", a.addImage(runtime.GOARCH, "/a"))
+	a.addRef("b", a.addImage(runtime.GOARCH, "/b"))
+	a.addMultiPlatformRef("multi", map[string]string{
+		runtime.GOARCH: "/multi-native",
+		otherArch():    "/multi-other",
+	})
+	archive := a.mustWrite(tmpdir)
+
+	other := runtime.GOOS + "/" + otherArch()
+	checkBeginSelect(t, archive, nil, "/a", "a")
+	checkBeginSelect(t, archive, []string{"--ref=b"}, "/b", "b")
+	checkBeginSelect(t, archive, []string{"--ref=multi"}, "/multi-native", "multi")
+	checkBeginSelect(t, archive, []string{"--ref=multi", "--platform=" + other}, "/multi-other", "multi")
+	checkBeginSelect(t, archive, []string{"--platform=" + other}, "/multi-other", "multi")
+	checkBeginSelectFails(t, archive, []string{"--ref=c"}, `"b" (`+runtime.GOOS+"/"+runtime.GOARCH+")")
+	checkBeginSelectFails(t, archive, []string{"--platform=" + runtime.GOOS + "/" + runtime.GOARCH}, "3 images with platform")
+	checkBeginSelectFails(t, archive, []string{"--platform=linux"}, "invalid platform")
+}
+
+func TestBeginDockerArchiveSelect(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	archive, _ := mustWriteDockerArchive(tmpdir,
+		testDockerImage{repoTag: "example.com/foo:v1", cmd: "/v1", contents: []string{"v1"}},
+		testDockerImage{repoTag: "example.com/foo:v2", cmd: "/v2", contents: []string{"v2"}, arch: otherArch()},
+	)
+
+	checkBeginSelect(t, archive, nil, "/v1", "v1")
+	checkBeginSelect(t, archive, []string{"--ref=v2"}, "/v2", "v2")
+	checkBeginSelect(t, archive, []string{"--ref=example.com/foo:v1"}, "/v1", "v1")
+	checkBeginSelect(t, archive, []string{"--platform=" + runtime.GOOS + "/" + otherArch()}, "/v2", "v2")
+	checkBeginSelectFails(t, archive, []string{"--ref=v3"}, `"example.com/foo:v2" (`+runtime.GOOS+"/"+otherArch()+")")
+	checkBeginSelectFails(t, archive, []string{"--ref=v1", "--platform=" + runtime.GOOS + "/" + otherArch()}, "no image with")
+}
+
+func TestBeginSelectKeepsVariant(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	var a testOCIArchive
+	m := a.addImage(otherArch(), "/variant")
+	m["platform"] = map[string]string{"architecture": otherArch(), "os": runtime.GOOS, "variant": "v9"}
+	a.addIndexRef("multi", []interface{}{m})
+	archive := a.mustWrite(tmpdir)
+
+	// The variant is only in the index, so it must survive the index being
+	// rewritten when the image changes
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--platform="+runtime.GOOS+"/"+otherArch()+"/v9", archive)
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "set-exec", "/changed")
+	}
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(workingDir, ".acbuild", "currentaci", "index.json"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var idx ociIndex
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest in the index, got %d", len(idx.Manifests))
+	}
+	p := idx.Manifests[0].Platform
+	if p == nil || p.OS != runtime.GOOS || p.Architecture != otherArch() || p.Variant != "v9" {
+		t.Errorf("unexpected platform in the index: %s", blob)
+	}
+}
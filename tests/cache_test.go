@@ -0,0 +1,229 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// withBuildCache turns the build cache on, in a new directory, until the
+// returned function is called.
+func withBuildCache() func() {
+	cacheDir := mustTempDir()
+	os.Setenv("ACBUILD_CACHE_DIR", cacheDir)
+	os.Unsetenv("ACBUILD_NO_CACHE")
+	return func() {
+		os.Setenv("ACBUILD_NO_CACHE", "1")
+		os.Unsetenv("ACBUILD_CACHE_DIR")
+		os.RemoveAll(cacheDir)
+	}
+}
+
+func TestCacheRun(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+	defer withBuildCache()()
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(touchprogram, path.Join(tmprootfs, "touch"))
+
+	// The same command on the same image is only run the first time, unless
+	// the cache is turned off.
+	for i, hit := range []bool{false, true, false} {
+		tmpdir := mustTempDir()
+		defer os.RemoveAll(tmpdir)
+		_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+
+		args := []string{"--debug", "run", "--engine=namespace", "--", "/touch", "/created"}
+		if i == 2 {
+			args = append([]string{"--no-cache"}, args...)
+		}
+		_, _, stderr, err := runACBuild(tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if strings.Contains(stderr, "Using cached result") != hit {
+			t.Errorf("run %d: expected cache hit to be %v: %s", i, hit, stderr)
+		}
+		_, err = os.Stat(path.Join(tmpdir, ".acbuild", "currentaci", "rootfs", "created"))
+		if err != nil {
+			t.Errorf("run %d: file created by the command is missing: %v", i, err)
+		}
+	}
+}
+
+func TestCacheRunBindMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+	defer withBuildCache()()
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(touchprogram, path.Join(tmprootfs, "touch"))
+	source := mustTempDir()
+	defer os.RemoveAll(source)
+
+	// Changing what's in the bind mount's source means running the command
+	// again, as it might do something different with it.
+	for i, c := range []struct {
+		contents string
+		hit      bool
+	}{{"one", false}, {"one", true}, {"two", false}} {
+		err := ioutil.WriteFile(path.Join(source, "file"), []byte(c.contents), 0644)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		tmpdir := mustTempDir()
+		defer os.RemoveAll(tmpdir)
+		_, _, _, err = runACBuild(tmpdir, "begin", tmprootfs)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		_, _, stderr, err := runACBuild(tmpdir, "--debug", "run", "--engine=namespace", "--mount", "type=bind,src="+source+",dst=/src", "--", "/touch", "/created")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if strings.Contains(stderr, "Using cached result") != c.hit {
+			t.Errorf("run %d: expected cache hit to be %v: %s", i, c.hit, stderr)
+		}
+	}
+}
+
+func TestCacheCopyOCI(t *testing.T) {
+	defer withBuildCache()()
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	source := path.Join(tmpdir, "source")
+
+	copyInto := func(contents string) (string, string) {
+		err := ioutil.WriteFile(source, []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		workdir := mustTempDir()
+		defer os.RemoveAll(workdir)
+		_, _, _, err = runACBuild(workdir, "begin", "--build-mode=oci")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		_, _, stderr, err := runACBuild(workdir, "--debug", "--no-history", "copy", source, "/dest")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		_, manifest, _, err := runACBuild(workdir, "cat-manifest")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		// The config differs between builds, as it has the time the build
+		// began in it.
+		var man struct {
+			Layers json.RawMessage `json:"layers"`
+		}
+		err = json.Unmarshal([]byte(manifest), &man)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		return stderr, string(man.Layers)
+	}
+
+	stderr, first := copyInto("one")
+	if !strings.Contains(stderr, "Result not in cache") {
+		t.Errorf("first copy wasn't a cache miss: %s", stderr)
+	}
+	stderr, second := copyInto("one")
+	if !strings.Contains(stderr, "Using cached result") {
+		t.Errorf("identical copy wasn't a cache hit: %s", stderr)
+	}
+	if first != second {
+		t.Errorf("cached copy gave different layers:\n%s\n%s", first, second)
+	}
+	stderr, _ = copyInto("two")
+	if !strings.Contains(stderr, "Result not in cache") {
+		t.Errorf("copy of changed file was a cache hit: %s", stderr)
+	}
+}
+
+func TestCacheCopyAppCChained(t *testing.T) {
+	defer withBuildCache()()
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	for _, name := range []string{"a", "b", "c"} {
+		err := ioutil.WriteFile(path.Join(tmpdir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	// build runs the given copies in a new build, and returns whether each of
+	// them was taken from the cache
+	build := func(names ...string) []bool {
+		workdir := mustTempDir()
+		defer os.RemoveAll(workdir)
+		_, _, _, err := runACBuild(workdir, "begin")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		var hits []bool
+		for _, name := range names {
+			args := []string{"--debug", "--no-history", "copy", path.Join(tmpdir, strings.TrimPrefix(name, "!")), "/" + name}
+			if strings.HasPrefix(name, "!") {
+				args = append([]string{"--no-cache"}, args...)
+			}
+			_, _, stderr, err := runACBuild(workdir, args...)
+			if err != nil {
+				t.Fatalf("%v\n", err)
+			}
+			hits = append(hits, strings.Contains(stderr, "Using cached result"))
+		}
+		for _, name := range names {
+			_, err = os.Stat(path.Join(workdir, ".acbuild", "currentaci", "rootfs", name))
+			if err != nil {
+				t.Errorf("file copied by the build is missing: %v", err)
+			}
+		}
+		return hits
+	}
+
+	for i, c := range []struct {
+		names []string
+		hits  []bool
+	}{
+		{[]string{"a", "c"}, []bool{false, false}},
+		{[]string{"a", "c"}, []bool{true, true}},
+		// A step that isn't cached changes the rootfs, so the steps after it
+		// aren't the same as before
+		{[]string{"a", "!b", "c"}, []bool{true, false, false}},
+	} {
+		hits := build(c.names...)
+		for j := range hits {
+			if hits[j] != c.hits[j] {
+				t.Errorf("build %d, step %d: expected cache hit to be %v", i, j, c.hits[j])
+			}
+		}
+	}
+}
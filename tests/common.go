@@ -59,6 +59,10 @@ func init() {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+
+	// Tests expect their commands to actually run. The build cache is turned
+	// back on by the tests for it.
+	os.Setenv("ACBUILD_NO_CACHE", "1")
 }
 
 func emptyManifest() schema.ImageManifest {
@@ -0,0 +1,208 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// skipWithoutCommand skips the test if the command name isn't installed.
+func skipWithoutCommand(t *testing.T, name string) {
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s isn't installed", name)
+	}
+}
+
+// mustWriteSource writes contents to a temporary file, and returns its path.
+func mustWriteSource(contents string) string {
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		panic(err)
+	}
+	_, err = f.WriteString(contents)
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	return f.Name()
+}
+
+// checkTopLayer checks that the top layer of the image in workingDir has the
+// given media type, and that its blob begins with magic.
+func checkTopLayer(t *testing.T, workingDir, mediaType string, magic []byte) {
+	_, manifest, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var man testManifest
+	err = json.Unmarshal([]byte(manifest), &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(man.Layers) == 0 {
+		t.Fatalf("image has no layers")
+	}
+	top := man.Layers[len(man.Layers)-1]
+	if top.MediaType != mediaType {
+		t.Errorf("expected layer media type %q, got %q", mediaType, top.MediaType)
+	}
+	blob, err := ioutil.ReadFile(path.Join(workingDir, ".acbuild", "currentaci", "blobs", strings.Replace(top.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !bytes.HasPrefix(blob, magic) {
+		t.Errorf("layer isn't compressed as %s, it begins with %x", mediaType, blob[:len(magic)])
+	}
+}
+
+func testCompressionOCI(t *testing.T, compression, mediaType string, magic []byte) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	hello := mustWriteSource("hello")
+	defer os.Remove(hello)
+	world := mustWriteSource("world")
+	defer os.Remove(world)
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	steps := [][]string{
+		{"begin", "--build-mode=oci"},
+		{"--compression=" + compression, "copy", hello, "/hello"},
+		{"set-exec", "/hello"},
+		{"write", "--format=oci-archive", path.Join(tmpdir, "image.tar")},
+	}
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+	checkTopLayer(t, workingDir, mediaType, magic)
+
+	// Copying into the layer of a build begun from the image extracts it
+	workingDir = mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", path.Join(tmpdir, "image.tar"))
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "--compression="+compression, "copy", world, "/world")
+	}
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	checkTopLayer(t, workingDir, mediaType, magic)
+
+	// docker archives have plain tar layers, which beginning from one checks
+	// against their diffIDs
+	archive := path.Join(tmpdir, "docker.tar")
+	err = runACBuildNoHist(workingDir, "write", "--format=docker-archive", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	workingDir = mustTempDir()
+	defer cleanUpTest(workingDir)
+	err = runACBuildNoHist(workingDir, "begin", "--build-mode=oci", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(config, `"/hello"`) {
+		t.Errorf("image config was lost: %s", config)
+	}
+}
+
+func TestCompressionOCIZstd(t *testing.T) {
+	skipWithoutCommand(t, "zstd")
+	testCompressionOCI(t, "zstd", "application/vnd.oci.image.layer.v1.tar+zstd", []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
+func TestCompressionOCIXz(t *testing.T) {
+	skipWithoutCommand(t, "xz")
+	testCompressionOCI(t, "xz", "application/vnd.oci.image.layer.v1.tar+xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00})
+}
+
+func TestCompressionOCINone(t *testing.T) {
+	// Plain tar files have no magic number at their beginning
+	testCompressionOCI(t, "none", "application/vnd.oci.image.layer.v1.tar", nil)
+}
+
+func TestCompressionACI(t *testing.T) {
+	skipWithoutCommand(t, "xz")
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	hello := mustWriteSource("hello")
+	defer os.Remove(hello)
+
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+	image := path.Join(tmpdir, "image.aci")
+	err := runACBuildNoHist(workingDir, "set-name", "example.com/hello")
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "copy", hello, "/hello")
+	}
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "--compression=xz", "--compression-level=9", "write", image)
+	}
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	blob, err := ioutil.ReadFile(image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !bytes.HasPrefix(blob, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}) {
+		t.Errorf("ACI isn't xz compressed, it begins with %x", blob[:6])
+	}
+
+	workingDir = mustTempDir()
+	defer cleanUpTest(workingDir)
+	err = runACBuildNoHist(workingDir, "begin", image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	content, err := ioutil.ReadFile(path.Join(workingDir, ".acbuild", "currentaci", "rootfs", "hello"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("unexpected contents of /hello: %q", content)
+	}
+}
+
+func TestCompressionBadLevel(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+	for _, args := range [][]string{
+		{"--compression=none", "--compression-level=1"},
+		{"--compression=gzip", "--compression-level=10"},
+		{"--compression=lz4"},
+	} {
+		_, _, stderr, err := runACBuild(workingDir, append(args, "--no-history", "write", path.Join(workingDir, "image.aci"))...)
+		if err == nil {
+			t.Errorf("%v: write succeeded", args)
+		} else if !strings.Contains(stderr, "compression") {
+			t.Errorf("%v: unexpected error: %s", args, stderr)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package tests
 
 import (
 	"archive/tar"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -276,3 +277,148 @@ func testMatchingFSTree(t *testing.T, workingDir, source, dest string) {
 		t.Fatalf("Got %d changes, expected 0\n%s", len(changes), changestring)
 	}
 }
+
+func TestCopyOCINewLayer(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	_, _, _, err := runACBuild(workingDir, "begin", "--build-mode=oci")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	source := path.Join(workingDir, "source")
+	err = ioutil.WriteFile(source, []byte("contents"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	layers := func() []string {
+		_, manifest, _, err := runACBuild(workingDir, "cat-manifest")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		var man struct {
+			Layers []struct {
+				Digest string `json:"digest"`
+			} `json:"layers"`
+		}
+		err = json.Unmarshal([]byte(manifest), &man)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		var digests []string
+		for _, l := range man.Layers {
+			digests = append(digests, l.Digest)
+		}
+		return digests
+	}
+
+	err = runACBuildNoHist(workingDir, "copy", source, "/one")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, "copy", source, "/two")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n := len(layers()); n != 1 {
+		t.Fatalf("expected copies into a small layer to keep 1 layer, got %d", n)
+	}
+
+	// Every layer is too big now
+	os.Setenv("ACBUILD_MAX_LAYER_SIZE", "1")
+	defer os.Unsetenv("ACBUILD_MAX_LAYER_SIZE")
+	before := layers()
+	err = runACBuildNoHist(workingDir, "copy", source, "/three")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	after := layers()
+	if len(after) != 2 || after[0] != before[0] {
+		t.Fatalf("expected a new layer on top of %v, got %v", before, after)
+	}
+}
+
+func TestCopyOCIMaxLayerSizeCache(t *testing.T) {
+	defer withBuildCache()()
+
+	layerCount := func(maxLayerSize string) int {
+		workingDir := mustTempDir()
+		defer cleanUpTest(workingDir)
+		_, _, _, err := runACBuild(workingDir, "begin", "--build-mode=oci")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		source := path.Join(workingDir, "source")
+		err = ioutil.WriteFile(source, []byte("contents"), 0644)
+		if err != nil {
+			panic(err)
+		}
+		err = runACBuildNoHist(workingDir, "--max-layer-size="+maxLayerSize, "copy", source, "/one")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		err = runACBuildNoHist(workingDir, "--max-layer-size="+maxLayerSize, "copy", source, "/two")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		_, manifest, _, err := runACBuild(workingDir, "cat-manifest")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		var man struct {
+			Layers []json.RawMessage `json:"layers"`
+		}
+		err = json.Unmarshal([]byte(manifest), &man)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		return len(man.Layers)
+	}
+
+	// The same step with a different maximum layer size isn't taken from
+	// the cache
+	small := layerCount("1G")
+	big := layerCount("1")
+	if big != small+1 {
+		t.Errorf("expected a new layer with a maximum layer size of 1 byte, got %d layers instead of %d", big, small)
+	}
+}
+
+func TestCopyOCIMaxLayerSizeScript(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	source := path.Join(workingDir, "source")
+	err := ioutil.WriteFile(source, []byte("contents"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	script := path.Join(workingDir, "build.acb")
+	err = ioutil.WriteFile(script, []byte(fmt.Sprintf("begin --build-mode=oci\ncopy %s /one\ncopy %s /two\ncat-manifest\n", source, source)), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	layerCount := func(args ...string) int {
+		_, manifest, stderr, err := runACBuild(workingDir, append(args, "script", script)...)
+		if err != nil {
+			t.Fatalf("%v: %s\n", err, stderr)
+		}
+		var man struct {
+			Layers []json.RawMessage `json:"layers"`
+		}
+		err = json.Unmarshal([]byte(manifest), &man)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		return len(man.Layers)
+	}
+
+	// The second copy starts a new layer when the script is given a maximum
+	// layer size of 1 byte
+	small := layerCount()
+	big := layerCount("--max-layer-size=1")
+	if big != small+1 {
+		t.Errorf("expected a new layer with a maximum layer size of 1 byte, got %d layers instead of %d", big, small)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+type ociIndex struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	Manifests     []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+		Platform    *struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// mustWriteOCIImage builds an OCI image with the given tag, and returns the
+// directory it's extracted into.
+func mustWriteOCIImage(t *testing.T, tmpdir, tag string) string {
+	workingDir := path.Join(tmpdir, "work")
+	err := os.Mkdir(workingDir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	steps := [][]string{
+		{"begin", "--build-mode=oci"},
+		{"set-exec", "/bin/true"},
+		{"set-tag", tag},
+		{"write", path.Join(tmpdir, "image.tar")},
+		{"end"},
+	}
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	imageDir := path.Join(tmpdir, "image")
+	err = os.Mkdir(imageDir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	out, err := exec.Command("tar", "-xzf", path.Join(tmpdir, "image.tar"), "-C", imageDir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	return imageDir
+}
+
+func checkOCILayout(t *testing.T, imageDir, tag string) {
+	layout, err := ioutil.ReadFile(path.Join(imageDir, "oci-layout"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if string(layout) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("unexpected oci-layout: %s", layout)
+	}
+	if _, err := os.Stat(path.Join(imageDir, "refs")); !os.IsNotExist(err) {
+		t.Errorf("image still has a refs directory")
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(imageDir, "index.json"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var idx ociIndex
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if idx.SchemaVersion != 2 || idx.MediaType != "application/vnd.oci.image.index.v1+json" {
+		t.Errorf("unexpected index schema version or media type: %s", blob)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest in the index, got %d", len(idx.Manifests))
+	}
+	m := idx.Manifests[0]
+	if m.MediaType != "application/vnd.oci.image.manifest.v1+json" {
+		t.Errorf("unexpected manifest media type %q", m.MediaType)
+	}
+	if name := m.Annotations["org.opencontainers.image.ref.name"]; name != tag {
+		t.Errorf("unexpected ref name %q, expected %q", name, tag)
+	}
+	_, err = os.Stat(path.Join(imageDir, "blobs", strings.Replace(m.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Errorf("manifest in the index is missing: %v", err)
+	}
+}
+
+func TestWriteOCILayout(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	imageDir := mustWriteOCIImage(t, tmpdir, "v1")
+	checkOCILayout(t, imageDir, "v1")
+}
+
+func TestBeginLegacyOCILayout(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	// Turn the image into one using the pre-1.0 refs directory
+	imageDir := mustWriteOCIImage(t, tmpdir, "v1")
+	blob, err := ioutil.ReadFile(path.Join(imageDir, "index.json"))
+	if err != nil {
+		panic(err)
+	}
+	var idx struct {
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Mkdir(path.Join(imageDir, "refs"), 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(imageDir, "refs", "v1"), idx.Manifests[0], 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(imageDir, "oci-layout"), []byte("{}"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove(path.Join(imageDir, "index.json"))
+	if err != nil {
+		panic(err)
+	}
+	legacyTar := path.Join(tmpdir, "legacy.tar")
+	out, err := exec.Command("tar", "-czf", legacyTar, "-C", imageDir, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "begin", "--build-mode=oci", legacyTar)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+
+	checkOCILayout(t, path.Join(workingDir, ".acbuild", "currentaci"), "v1")
+	_, manifest, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(manifest, "/bin/true") {
+		t.Errorf("image config was lost: %s", manifest)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/appc/spec/schema"
+)
+
+func manWithPathWhitelist(pwl []string) schema.ImageManifest {
+	man := emptyManifest()
+	man.PathWhitelist = pwl
+	return man
+}
+
+func TestAddPathWhitelist(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "path-whitelist", "add", "/usr/bin/curl", "/etc/ssl/")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, "path-whitelist", "add", "/etc/ssl")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	checkManifest(t, workingDir, manWithPathWhitelist([]string{"/etc/ssl", "/usr/bin/curl"}))
+	checkEmptyRootfs(t, workingDir)
+}
+
+func TestAddRelativePathWhitelist(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "path-whitelist", "add", "usr/bin/curl")
+	if err == nil {
+		t.Fatalf("path-whitelist add didn't return an error when given a relative path")
+	}
+
+	checkManifest(t, workingDir, emptyManifest())
+	checkEmptyRootfs(t, workingDir)
+}
+
+func TestAddRmPathWhitelist(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "path-whitelist", "add", "/usr/bin/curl", "/etc/ssl")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, "path-whitelist", "remove", "/usr/bin/curl")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	checkManifest(t, workingDir, manWithPathWhitelist([]string{"/etc/ssl"}))
+	checkEmptyRootfs(t, workingDir)
+}
+
+func TestAddClearPathWhitelist(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "path-whitelist", "add", "/usr/bin/curl", "/etc/ssl")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, "path-whitelist", "clear")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	checkManifest(t, workingDir, emptyManifest())
+	checkEmptyRootfs(t, workingDir)
+}
+
+func TestRmNonexistentPathWhitelist(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	exitCode, _, _, err := runACBuild(workingDir, "--no-history", "path-whitelist", "remove", "/usr/bin/curl")
+	switch {
+	case err == nil:
+		t.Fatalf("path-whitelist remove didn't return an error when asked to remove nonexistent path")
+	case exitCode == 2:
+		return
+	default:
+		t.Fatalf("error occurred when running path-whitelist remove:\n%v", err)
+	}
+}
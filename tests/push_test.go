@@ -0,0 +1,241 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// mustWriteCredentials writes a docker config.json with the test user's
+// credentials for host, with the given password, to dir, and returns its path.
+func mustWriteCredentials(dir, host, password string) string {
+	auth := base64.StdEncoding.EncodeToString([]byte(testRegistryUser + ":" + password))
+	p := path.Join(dir, "config.json")
+	err := ioutil.WriteFile(p, []byte(fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, host, auth)), 0600)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// checkPushed checks that reg has a manifest with the given digest under
+// tag in repo, and returns it.
+func checkPushed(t *testing.T, reg *testRegistry, repo, tag, digest string) testManifest {
+	m, ok := reg.repo(repo).manifests[tag]
+	if !ok {
+		t.Fatalf("%s:%s wasn't pushed", repo, tag)
+	}
+	if d := testDigest(m.content); d != strings.TrimSpace(digest) {
+		t.Errorf("push printed digest %s, the manifest has digest %s", digest, d)
+	}
+	if m.mediaType != "application/vnd.oci.image.manifest.v1+json" {
+		t.Errorf("unexpected manifest media type %q", m.mediaType)
+	}
+	var man testManifest
+	err := json.Unmarshal(m.content, &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	return man
+}
+
+// checkBeginPushed begins a build from image in a registry, and checks that
+// its command is /hello.
+func checkBeginPushed(t *testing.T, image string) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--insecure", image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(config, `"/hello"`) {
+		t.Errorf("image config was lost: %s", config)
+	}
+}
+
+func TestPushOCI(t *testing.T) {
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	creds := mustWriteCredentials(tmpdir, host, testRegistryPassword)
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	mustBeginTestImage(t, workingDir, "v1")
+
+	// The layer is larger than the chunks, so it's uploaded in several
+	image := host + "/test/pushed:v1"
+	_, digest, _, err := runACBuild(workingDir, "--no-history", "push", "--insecure", "--credentials="+creds, "--chunk-size=64", image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	man := checkPushed(t, reg, "test/pushed", "v1", digest)
+	if reg.uploaded != 1+len(man.Layers) {
+		t.Errorf("expected %d blobs to be uploaded, got %d", 1+len(man.Layers), reg.uploaded)
+	}
+	if reg.chunks < 2 {
+		t.Errorf("expected the blobs to be uploaded in chunks, got %d chunks", reg.chunks)
+	}
+
+	// Pushing again uploads nothing, the registry has all the blobs
+	uploaded := reg.uploaded
+	err = runACBuildNoHist(workingDir, "push", "--insecure", "--credentials="+creds, image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if reg.uploaded != uploaded {
+		t.Errorf("%d blobs were uploaded again", reg.uploaded-uploaded)
+	}
+
+	checkBeginPushed(t, "docker://"+image)
+}
+
+func TestPushMountsBaseLayers(t *testing.T) {
+	reg := newTestRegistry()
+	base := addTestImage(reg,
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.config.v1+json",
+		"application/vnd.oci.image.layer.v1.tar+gzip")
+	reg.addManifest(base.MediaType, "v1", base)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	creds := mustWriteCredentials(tmpdir, host, testRegistryPassword)
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", "--insecure", "docker://"+host+"/"+testRegistryRepo+":v1")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	err = runACBuildNoHist(workingDir, "copy", f.Name(), "/new-file")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, digest, _, err := runACBuild(workingDir, "--no-history", "push", "--insecure", "--credentials="+creds, host+"/test/derived:v1")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	man := checkPushed(t, reg, "test/derived", "v1", digest)
+	if len(man.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(man.Layers))
+	}
+	// The base layers are mounted, and only the config and the new layer
+	// are uploaded
+	if reg.mounts != 2 || reg.uploaded != 2 {
+		t.Errorf("expected 2 blobs to be mounted and 2 uploaded, got %d and %d", reg.mounts, reg.uploaded)
+	}
+}
+
+func TestPushAppC(t *testing.T) {
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	creds := mustWriteCredentials(tmpdir, host, testRegistryPassword)
+
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+	steps := [][]string{
+		{"copy", f.Name(), "/hello"},
+		{"set-exec", "/hello", "world"},
+		{"environment", "add", "FOO", "bar"},
+	}
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	image := host + "/test/appc:v1"
+	_, digest, _, err := runACBuild(workingDir, "--no-history", "push", "--insecure", "--credentials="+creds, image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	man := checkPushed(t, reg, "test/appc", "v1", digest)
+	if len(man.Layers) != 1 {
+		t.Fatalf("expected the ACI to be pushed as 1 layer, got %d", len(man.Layers))
+	}
+	config := string(reg.blobs[man.Config.Digest])
+	for _, want := range []string{`"Entrypoint":["/hello"]`, `"Cmd":["world"]`, `"FOO=bar"`} {
+		if !strings.Contains(config, want) {
+			t.Errorf("expected %s in the image config, got %s", want, config)
+		}
+	}
+
+	checkBeginPushed(t, "docker://"+image)
+}
+
+func TestPushBadCredentials(t *testing.T) {
+	reg := newTestRegistry()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	creds := mustWriteCredentials(tmpdir, host, "wrong")
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	mustBeginTestImage(t, workingDir, "v1")
+
+	for _, args := range [][]string{{"--credentials=" + creds}, nil} {
+		pushArgs := append([]string{"--no-history", "push", "--insecure"}, args...)
+		_, _, stderr, err := runACBuild(workingDir, append(pushArgs, host+"/test/pushed:v1")...)
+		if err == nil {
+			t.Errorf("%v: push succeeded without valid credentials", args)
+			continue
+		}
+		if !strings.Contains(stderr, "bad credentials") {
+			t.Errorf("%v: unexpected error: %s", args, stderr)
+		}
+	}
+	if len(reg.repo("test/pushed").blobs) != 0 {
+		t.Errorf("blobs were pushed without valid credentials")
+	}
+}
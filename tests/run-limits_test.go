@@ -0,0 +1,107 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// limitsprogram sleeps for an hour, starts processes until that fails, or
+// allocates as many MiB of memory as its second argument says, depending on
+// its first argument.
+const limitsprogram = `
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+func main() {
+	switch os.Args[1] {
+	case "sleep":
+		time.Sleep(time.Hour)
+	case "fork":
+		for i := 0; i < 1000; i++ {
+			err := exec.Command(os.Args[0], "sleep").Start()
+			if err != nil {
+				os.Exit(1)
+			}
+		}
+	case "alloc":
+		n, _ := strconv.Atoi(os.Args[2])
+		var blocks [][]byte
+		for i := 0; i < n; i++ {
+			b := make([]byte, 1<<20)
+			for j := range b {
+				b[j] = 1
+			}
+			blocks = append(blocks, b)
+		}
+	}
+}
+`
+
+// checkRunLimit runs limitsprogram with the given limit flag and arguments,
+// and checks that acbuild exits with wantCode. The test is skipped if the
+// limit can't be applied on this host.
+func checkRunLimit(t *testing.T, flag string, wantCode int, args ...string) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(limitsprogram, path.Join(tmprootfs, "limits"))
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	start := time.Now()
+	runArgs := append([]string{"--no-history", "--no-cache", "run", "--engine=namespace", flag, "--", "/limits"}, args...)
+	code, _, stderr, _ := runACBuild(workingDir, runArgs...)
+	for _, unsupported := range []string{"cgroup v2, which isn't mounted", "cgroup controller can't be enabled", "error creating cgroup", "couldn't find cgroup v2"} {
+		if strings.Contains(stderr, unsupported) {
+			t.Skipf("skipping test; %s", strings.TrimSpace(stderr))
+		}
+	}
+	if code != wantCode {
+		t.Errorf("expected exit code %d, got %d: %s", wantCode, code, stderr)
+	}
+	if time.Since(start) > time.Minute {
+		t.Errorf("command ran for %v", time.Since(start))
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	checkRunLimit(t, "--timeout=1s", 124, "sleep")
+}
+
+func TestRunPidsLimit(t *testing.T) {
+	checkRunLimit(t, "--pids-limit=16", 122, "fork")
+}
+
+func TestRunMemoryLimit(t *testing.T) {
+	checkRunLimit(t, "--memory=32M", 123, "alloc", "256")
+}
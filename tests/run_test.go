@@ -15,11 +15,16 @@
 package tests
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -28,42 +33,83 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 )
 
 func main() {
-	fmt.Printf("success")
+	fmt.Print(strings.Join(append([]string{"success"}, os.Args[1:]...), "\n"))
 }
 `
 
-func TestRun(t *testing.T) {
-	if os.Getenv("ENABLE_SYSTEMD_TESTS") == "" {
-		t.Skip("skipping test; $ENABLE_SYSTEMD_TESTS not set")
+// stubruntime is a minimal stand-in for an OCI runtime like runc. It runs the
+// process from the bundle's config.json in a chroot, without any isolation,
+// and copies the config.json to $STUB_RUNTIME_CONFIG.
+const stubruntime = `
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+type spec struct {
+	Process struct {
+		Args []string
+		Env  []string
+		Cwd  string
+	}
+	Root struct {
+		Path string
 	}
+}
 
-	// Build a statically linked test program
-	tmpsourcedir := mustTempDir()
-	defer os.RemoveAll(tmpsourcedir)
-	tmpsource := path.Join(tmpsourcedir, "thing.go")
-	defer os.RemoveAll(tmpsourcedir)
-	err := ioutil.WriteFile(tmpsource, []byte(goprogram), 0644)
+func main() {
+	if len(os.Args) != 5 || os.Args[1] != "run" || os.Args[2] != "--bundle" {
+		// kill and delete have nothing to do
+		return
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(os.Args[3], "config.json"))
 	if err != nil {
 		panic(err)
 	}
-
-	tmprootfs := mustTempDir()
-	defer os.RemoveAll(tmprootfs)
-
-	cmd := exec.Command("go", "build", "-o", path.Join(tmprootfs, "worker"), "-tags", "netgo", "-ldflags", "-w", tmpsource)
-	cmd.Env = []string{"CGO_ENABLED=0", "GOOS=linux", "GOROOT=" + os.Getenv("GOROOT"), "GOPATH=" + os.Getenv("GOPATH")}
-	output, err := cmd.CombinedOutput()
+	err = ioutil.WriteFile(os.Getenv("STUB_RUNTIME_CONFIG"), blob, 0644)
+	if err != nil {
+		panic(err)
+	}
+	var s spec
+	err = json.Unmarshal(blob, &s)
 	if err != nil {
-		fmt.Println(string(output))
 		panic(err)
 	}
+	cmd := exec.Command(s.Process.Args[0], s.Process.Args[1:]...)
+	cmd.Env = s.Process.Env
+	cmd.Dir = s.Process.Cwd
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: s.Root.Path}
+	err = cmd.Run()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+`
+
+func TestRun(t *testing.T) {
+	if os.Getenv("ENABLE_SYSTEMD_TESTS") == "" {
+		t.Skip("skipping test; $ENABLE_SYSTEMD_TESTS not set")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
 
 	// Call begin on it
 	tmpdir := mustTempDir()
-	_, _, _, err = runACBuild(tmpdir, "begin", tmprootfs)
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
 	if err != nil {
 		t.Fatalf("%v\n", err)
 	}
@@ -82,6 +128,473 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunNamespaceEngine(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=namespace", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+	if stdout != "success" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	for _, dir := range []string{"proc", "dev", "sys"} {
+		_, err := os.Stat(path.Join(tmpdir, ".acbuild", "currentaci", "rootfs", dir))
+		if !os.IsNotExist(err) {
+			t.Errorf("mountpoint /%s was left behind in the rootfs", dir)
+		}
+	}
+}
+
+func TestRunSecret(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	const secret = "hunter2"
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(fsprogram, path.Join(tmprootfs, "fs"))
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	secretFile := path.Join(tmpdir, "token")
+	err = ioutil.WriteFile(secretFile, []byte(secret+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "run", "--engine=namespace", "--secret=id=token,src="+secretFile, "/worker", secret)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+
+	_, err = os.Stat(path.Join(tmpdir, ".acbuild", "currentaci", "rootfs", "run"))
+	if !os.IsNotExist(err) {
+		t.Errorf("secrets mountpoint was left behind in the rootfs")
+	}
+
+	// The command can read the secret where it's mounted
+	_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine=namespace", "--secret=id=token,src="+secretFile, "--", "/fs", "cat", "/run/secrets/token")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != secret+"\n" {
+		t.Errorf("command read %q from the secret, expected %q", stdout, secret+"\n")
+	}
+
+	_, manifest, _, err := runACBuild(tmpdir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if strings.Contains(manifest, secret) {
+		t.Errorf("secret found in manifest: %s", manifest)
+	}
+}
+
+// systemd-nspawn mounts a tmpfs on /run and /tmp, which must not hide the
+// secrets and mounts acbuild makes there.
+func TestRunSecretSystemdNspawn(t *testing.T) {
+	if os.Getenv("ENABLE_SYSTEMD_TESTS") == "" {
+		t.Skip("skipping test; $ENABLE_SYSTEMD_TESTS not set")
+	}
+
+	const secret = "hunter2"
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(fsprogram, path.Join(tmprootfs, "fs"))
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	secretFile := path.Join(tmpdir, "token")
+	err = ioutil.WriteFile(secretFile, []byte(secret+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--secret=id=token,src="+secretFile, "--", "/fs", "cat", "/run/secrets/token")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != secret+"\n" {
+		t.Errorf("command read %q from the secret, expected %q: %s", stdout, secret+"\n", stderr)
+	}
+
+	_, stdout, stderr, err = runACBuild(tmpdir, "--no-history", "run", "--mount=type=bind,src="+tmpdir+",dst=/tmp/context,ro", "--", "/fs", "cat", "/tmp/context/token")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stdout != secret+"\n" {
+		t.Errorf("command read %q from the bind mount, expected %q: %s", stdout, secret+"\n", stderr)
+	}
+}
+
+// The runtime mounts its own filesystems in the container, so the secrets
+// have to be in the spec it's given.
+func TestRunOCIRuntimeSecret(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the stub runtime must be run as root")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	runtime := path.Join(tmpdir, "stub-runtime")
+	mustBuildGoProgram(stubruntime, runtime)
+	configPath := path.Join(tmpdir, "config.json")
+	os.Setenv("STUB_RUNTIME_CONFIG", configPath)
+	defer os.Unsetenv("STUB_RUNTIME_CONFIG")
+
+	secretFile := path.Join(tmpdir, "token")
+	err = ioutil.WriteFile(secretFile, []byte("hunter2\n"), 0600)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=oci-runtime", "--oci-runtime="+runtime, "--secret=id=token,src="+secretFile, "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+
+	blob, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var config struct {
+		Mounts []struct {
+			Destination string
+			Type        string
+			Options     []string
+		}
+	}
+	err = json.Unmarshal(blob, &config)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	found := false
+	for _, m := range config.Mounts {
+		if m.Destination == "/run/secrets" && m.Type == "bind" && strings.Contains(strings.Join(m.Options, ","), "ro") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no read-only bind mount of /run/secrets in config.json: %s", blob)
+	}
+}
+
+func TestRunChrootEngine(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the chroot engine must be run as root")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=chroot", "/worker", "a,b", "c")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+	if stdout != "success\na,b\nc" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	for _, dir := range []string{"proc", "dev", "sys"} {
+		_, err := os.Stat(path.Join(tmpdir, ".acbuild", "currentaci", "rootfs", dir))
+		if !os.IsNotExist(err) {
+			t.Errorf("mountpoint /%s was left behind in the rootfs", dir)
+		}
+	}
+}
+
+func TestRunHostFiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+
+	// Injected files must not end up in the image
+	_, _, _, err = runACBuild(tmpdir, "--no-history", "run", "--engine=namespace", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	for _, dir := range []string{"etc", "usr"} {
+		_, err := os.Stat(path.Join(rootfs, dir))
+		if !os.IsNotExist(err) {
+			t.Errorf("/%s was left behind in the rootfs", dir)
+		}
+	}
+
+	_, _, _, err = runACBuild(tmpdir, "--no-history", "run", "--engine=namespace", "--host-file=resolv.conf=persist,hosts=skip", "/worker")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	want, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("%v\n", err)
+	}
+	got, err := ioutil.ReadFile(path.Join(rootfs, "etc", "resolv.conf"))
+	if err != nil {
+		t.Fatalf("persisted resolv.conf is missing: %v\n", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("persisted resolv.conf differs from the host's: %q", got)
+	}
+	_, err = os.Stat(path.Join(rootfs, "etc", "hosts"))
+	if !os.IsNotExist(err) {
+		t.Errorf("skipped hosts file is in the rootfs")
+	}
+
+	_, _, _, err = runACBuild(tmpdir, "--no-history", "run", "--engine=namespace", "--host-file=hosts=sometimes", "/worker")
+	if err == nil {
+		t.Errorf("run with an unknown host file policy succeeded")
+	}
+}
+
+func TestRunOCIRuntimeEngine(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the stub runtime must be run as root")
+	}
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	runtime := path.Join(tmpdir, "stub-runtime")
+	mustBuildGoProgram(stubruntime, runtime)
+	configPath := path.Join(tmpdir, "config.json")
+	os.Setenv("STUB_RUNTIME_CONFIG", configPath)
+	defer os.Unsetenv("STUB_RUNTIME_CONFIG")
+
+	isoFile := path.Join(tmpdir, "isolator.json")
+	err = ioutil.WriteFile(isoFile, []byte(`{ "set": ["CAP_CHOWN"] }`), 0644)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(tmpdir, "isolator", "add", "os/linux/capabilities-retain-set", isoFile)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=oci-runtime", "--oci-runtime="+runtime, "--user=1000", "--working-dir=/", "/worker", "a,b")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+	if stdout != "success\na,b" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	blob, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var config struct {
+		Process struct {
+			User struct {
+				UID uint32
+			}
+			Args         []string
+			Cwd          string
+			Capabilities struct {
+				Bounding []string
+			}
+		}
+	}
+	err = json.Unmarshal(blob, &config)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if config.Process.User.UID != 1000 {
+		t.Errorf("unexpected uid in config.json: %d", config.Process.User.UID)
+	}
+	if strings.Join(config.Process.Args, " ") != "/worker a,b" {
+		t.Errorf("unexpected args in config.json: %v", config.Process.Args)
+	}
+	if config.Process.Cwd != "/" {
+		t.Errorf("unexpected cwd in config.json: %s", config.Process.Cwd)
+	}
+	if strings.Join(config.Process.Capabilities.Bounding, " ") != "CAP_CHOWN" {
+		t.Errorf("unexpected capabilities in config.json: %v", config.Process.Capabilities.Bounding)
+	}
+}
+
+// mustBuildWorkerRootfs builds a statically linked test program, and returns
+// the path to a directory containing it at /worker.
+func mustBuildWorkerRootfs() string {
+	tmprootfs := mustTempDir()
+	mustBuildGoProgram(goprogram, path.Join(tmprootfs, "worker"))
+	return tmprootfs
+}
+
+// mustBuildGoProgram builds a statically linked binary at output from the
+// given source.
+func mustBuildGoProgram(source, output string) {
+	tmpsourcedir := mustTempDir()
+	defer os.RemoveAll(tmpsourcedir)
+	tmpsource := path.Join(tmpsourcedir, "thing.go")
+	err := ioutil.WriteFile(tmpsource, []byte(source), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	cmd := exec.Command("go", "build", "-o", output, "-tags", "netgo", "-ldflags", "-w", tmpsource)
+	cmd.Env = []string{"CGO_ENABLED=0", "GOOS=linux", "GOROOT=" + os.Getenv("GOROOT"), "GOPATH=" + os.Getenv("GOPATH"), "HOME=" + os.Getenv("HOME")}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		panic(err)
+	}
+}
+
+// withStubEngine links acbuild into a temporary directory as the stub engine,
+// and adds that directory to $PATH until the returned function is called.
+func withStubEngine(t *testing.T) func() {
+	bin, err := filepath.Abs(acbuildBinPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	dir := mustTempDir()
+	err = os.Symlink(bin, path.Join(dir, "acbuild-engine-stub"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%v\n", err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+oldPath)
+	return func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunExternalEngine(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+	defer withStubEngine(t)()
+
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "run", "--engine=missing", "--", "/bin/true")
+	if err == nil || !strings.Contains(stderr, `no such engine "missing"`) {
+		t.Errorf("unexpected result for a missing engine: %v: %s", err, stderr)
+	}
+
+	logPath := path.Join(workingDir, "stub.log")
+	os.Setenv("ACBUILD_ENGINE_STUB_LOG", logPath)
+	defer os.Unsetenv("ACBUILD_ENGINE_STUB_LOG")
+
+	_, _, stderr, err = runACBuild(workingDir, "--no-history", "run", "--engine=stub", "--working-dir=/tmp", "--", "/bin/sh", "-c", "a,b")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+
+	blob, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var req struct {
+		Version    int
+		Command    string
+		Args       []string
+		Rootfs     string
+		WorkingDir string
+	}
+	err = json.Unmarshal(blob, &req)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if req.Version != 1 {
+		t.Errorf("unexpected request version: %d", req.Version)
+	}
+	if req.Command != "/bin/sh" || strings.Join(req.Args, " ") != "-c a,b" {
+		t.Errorf("unexpected command: %s %v", req.Command, req.Args)
+	}
+	if req.WorkingDir != "/tmp" {
+		t.Errorf("unexpected working dir: %s", req.WorkingDir)
+	}
+	if !strings.HasPrefix(req.Rootfs, "/") {
+		t.Errorf("rootfs isn't absolute: %s", req.Rootfs)
+	}
+
+	os.Setenv("ACBUILD_ENGINE_STUB_EXIT_CODE", "5")
+	defer os.Unsetenv("ACBUILD_ENGINE_STUB_EXIT_CODE")
+	exitCode, _, _, err := runACBuild(workingDir, "--no-history", "run", "--engine=stub", "/bin/false")
+	if err == nil || exitCode != 5 {
+		t.Errorf("expected exit code 5, got %d", exitCode)
+	}
+}
+
 func TestRunBadEngine(t *testing.T) {
 	workingDir := setUpTest(t)
 	defer cleanUpTest(workingDir)
@@ -99,3 +612,294 @@ func TestRunBadEngine(t *testing.T) {
 		t.Errorf("unexpected message on stderr: %s", stderr)
 	}
 }
+
+func TestRunScript(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(touchprogram, path.Join(tmprootfs, "touch"))
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+
+	steps := path.Join(tmpdir, "steps")
+	err = ioutil.WriteFile(steps, []byte("/touch /a\n# a comment\n/touch /b \\\n    /c\n\n/touch '/d e'\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	_, _, _, err = runACBuild(tmpdir, "run", "--engine=namespace", "--script", steps)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	for _, file := range []string{"a", "b", "c", "d e"} {
+		if _, err := os.Stat(path.Join(rootfs, file)); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	manblob, err := ioutil.ReadFile(path.Join(tmpdir, ".acbuild", "currentaci", "manifest"))
+	if err != nil {
+		panic(err)
+	}
+	if n := strings.Count(string(manblob), "coreos.com/acbuild/command-"); n != 3 {
+		t.Errorf("expected an annotation for each of the 3 commands, got %d", n)
+	}
+
+	err = ioutil.WriteFile(steps, []byte("/touch /f\n/missing\n/touch /g\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	_, _, stderr, err := runACBuild(tmpdir, "run", "--engine=namespace", "--script", steps)
+	if err == nil {
+		t.Fatalf("was expecting the failing command to fail the run")
+	}
+	if !strings.Contains(stderr, `["/missing"]`) {
+		t.Errorf("failing command wasn't named: %s", stderr)
+	}
+	if _, err := os.Stat(path.Join(rootfs, "g")); !os.IsNotExist(err) {
+		t.Errorf("command after the failing one was run")
+	}
+
+	_, _, _, err = runACBuild(tmpdir, "run", "--script", steps, "--", "/touch", "/h")
+	if err == nil {
+		t.Errorf("was expecting an error when given both a command and --script")
+	}
+}
+
+// fsprogram performs the operation named by its first argument on the paths
+// given after it: rm, mkdir, touch, cat to print their contents, or absent to
+// fail if any of them exist.
+const fsprogram = `
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	for _, p := range os.Args[2:] {
+		var err error
+		switch os.Args[1] {
+		case "rm":
+			err = os.RemoveAll(p)
+		case "mkdir":
+			err = os.MkdirAll(p, 0755)
+		case "touch":
+			err = ioutil.WriteFile(p, nil, 0644)
+		case "cat":
+			var blob []byte
+			blob, err = ioutil.ReadFile(p)
+			os.Stdout.Write(blob)
+		case "absent":
+			if _, err := os.Lstat(p); err == nil {
+				os.Exit(1)
+			}
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+`
+
+func TestRunOCIWhiteouts(t *testing.T) {
+	testRunOCIWhiteouts(t, "")
+}
+
+func TestRunOCIWhiteoutsCopyOverlay(t *testing.T) {
+	testRunOCIWhiteouts(t, "copy")
+}
+
+func TestRunOCIWhiteoutsFuseOverlay(t *testing.T) {
+	if _, err := exec.LookPath("fuse-overlayfs"); err != nil {
+		t.Skip("skipping test; fuse-overlayfs isn't installed")
+	}
+	testRunOCIWhiteouts(t, "fuse-overlayfs")
+}
+
+// testRunOCIWhiteouts checks that deleting files from lower layers with the
+// given overlay driver is recorded as whiteouts in the top layer.
+func testRunOCIWhiteouts(t *testing.T, overlay string) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+	runFlags := []string{"run", "--engine=namespace"}
+	if overlay != "" {
+		runFlags = append(runFlags, "--overlay="+overlay)
+	}
+	run := func(args ...string) []string {
+		return append(append(append([]string{}, runFlags...), "--"), args...)
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	fsprog := path.Join(tmpdir, "fs")
+	mustBuildGoProgram(fsprogram, fsprog)
+
+	workingDir := path.Join(tmpdir, "work")
+	err := os.Mkdir(workingDir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	steps := [][]string{
+		{"begin", "--build-mode=oci"},
+		{"copy", fsprog, "/fs"},
+		run("/fs", "mkdir", "/d"),
+		run("/fs", "touch", "/f", "/d/x"),
+		{"layer"},
+		run("/fs", "rm", "/f", "/d"),
+		run("/fs", "mkdir", "/d"),
+	}
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+
+	_, manifest, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var man struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+	}
+	err = json.Unmarshal([]byte(manifest), &man)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if len(man.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(man.Layers))
+	}
+	topLayer := path.Join(workingDir, ".acbuild", "currentaci", "blobs", strings.Replace(man.Layers[1].Digest, ":", "/", 1))
+	out, err := exec.Command("tar", "-tvzf", topLayer).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	var entries []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.HasPrefix(line, "c") {
+			t.Errorf("layer has a device in it: %s", line)
+		}
+		fields := strings.Fields(line)
+		entries = append(entries, strings.TrimSuffix(fields[len(fields)-1], "/"))
+	}
+	expected := []string{"d", "d/.wh..wh..opq", ".wh.f"}
+	sort.Strings(entries)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected top layer entries, expected:%q actual:%q", expected, entries)
+	}
+
+	// Extracting the layers again has to turn the whiteouts back into
+	// deletions, which also have to hide the files once the layer they're in
+	// is below a new one.
+	err = os.RemoveAll(path.Join(workingDir, ".acbuild", "ociblobs"))
+	if err != nil {
+		panic(err)
+	}
+	err = runACBuildNoHist(workingDir, "layer")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, run("/fs", "absent", "/f", "/d/x")...)
+	if err != nil {
+		t.Errorf("deleted files came back after extracting the layers: %v", err)
+	}
+}
+
+// netprogram prints the names of the network interfaces it can see.
+const netprogram = `
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func main() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, iface := range ifaces {
+		fmt.Println(iface.Name)
+	}
+}
+`
+
+func TestRunNetworkNone(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(netprogram, path.Join(tmprootfs, "ifaces"))
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for _, engine := range []string{"namespace", "chroot"} {
+		_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine="+engine, "--network=none", "/ifaces")
+		if err != nil {
+			t.Fatalf("%v: %s\n", err, stderr)
+		}
+		if stdout != "lo\n" {
+			t.Errorf("%s: expected only lo with --network=none, got %q", engine, stdout)
+		}
+	}
+}
+
+func TestRunNetworkNoneScript(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(netprogram, path.Join(tmprootfs, "ifaces"))
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	for _, c := range []struct {
+		args   []string
+		script string
+	}{
+		{[]string{"--network=none"}, "begin %s\nrun --engine=namespace -- /ifaces\n"},
+		{nil, "begin %s\nnetwork none\nrun --engine=namespace -- /ifaces\n"},
+	} {
+		script := path.Join(tmpdir, "build.acb")
+		err := ioutil.WriteFile(script, []byte(fmt.Sprintf(c.script, tmprootfs)), 0644)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		args := append([]string{"script"}, c.args...)
+		_, stdout, stderr, err := runACBuild(tmpdir, append(args, script)...)
+		if err != nil {
+			t.Fatalf("%v: %s\n", err, stderr)
+		}
+		if stdout != "lo\n" {
+			t.Errorf("script %q with %v: expected only lo, got %q", c.script, c.args, stdout)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// touchprogram creates the files named by its arguments.
+const touchprogram = `
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	for _, p := range os.Args[1:] {
+		err := ioutil.WriteFile(p, nil, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+`
+
+func TestShellKeepAndDiscard(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+
+	tmprootfs := mustTempDir()
+	defer os.RemoveAll(tmprootfs)
+	mustBuildGoProgram(touchprogram, path.Join(tmprootfs, "touch"))
+
+	tmpdir := mustTempDir()
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+
+	_, _, stderr, err := runACBuild(tmpdir, "shell", "--engine=namespace", "--", "/touch", "/discarded")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+	_, err = os.Stat(path.Join(rootfs, "discarded"))
+	if !os.IsNotExist(err) {
+		t.Errorf("change made in the shell wasn't discarded")
+	}
+
+	_, _, _, err = runACBuild(tmpdir, "shell", "--engine=namespace", "--keep", "--", "/touch", "/kept")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, err = os.Stat(path.Join(rootfs, "kept"))
+	if err != nil {
+		t.Errorf("change made in the shell wasn't kept: %v", err)
+	}
+
+	_, manifest, _, err := runACBuild(tmpdir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if n := strings.Count(manifest, "acbuild shell"); n != 1 {
+		t.Errorf("expected history for the kept shell only, found %d entries: %s", n, manifest)
+	}
+}
+
+func TestShellKeepNotCached(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; the namespace engine must be run as root")
+	}
+	defer withBuildCache()()
+
+	tmprootfs := mustBuildWorkerRootfs()
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// The image is the same both times, but the shell has to be opened again
+	// rather than replayed from the cache
+	for i := 0; i < 2; i++ {
+		_, stdout, _, err := runACBuild(tmpdir, "--no-history", "shell", "--engine=namespace", "--keep", "--", "/worker")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		if stdout != "success" {
+			t.Errorf("shell %d wasn't run, stdout: %q", i, stdout)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// mustBeginTestImage begins an oci build with a file in it in workingDir, with
+// the given tag.
+func mustBeginTestImage(t *testing.T, workingDir, tag string) {
+	f, err := ioutil.TempFile("", "acbuild-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("hello")
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	steps := [][]string{
+		{"begin", "--build-mode=oci"},
+		{"copy", f.Name(), "/hello"},
+		{"set-exec", "/hello"},
+		{"set-tag", tag},
+	}
+	for _, step := range steps {
+		err := runACBuildNoHist(workingDir, step...)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+	}
+}
+
+// mustReadTar returns the contents of the regular files in the tar at p.
+func mustReadTar(p string) map[string]string {
+	f, err := os.Open(p)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			panic(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			panic(err)
+		}
+		files[hdr.Name] = string(content)
+	}
+}
+
+// checkBeginWritten begins a build from the image written to image, and
+// checks that it's the one mustBeginTestImage makes.
+func checkBeginWritten(t *testing.T, image, wantRef string) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	err := runACBuildNoHist(workingDir, "begin", "--build-mode=oci", image)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	checkOCILayout(t, path.Join(workingDir, ".acbuild", "currentaci"), wantRef)
+	_, config, _, err := runACBuild(workingDir, "cat-manifest", "--file=config")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	if !strings.Contains(config, `"/hello"`) {
+		t.Errorf("image config was lost: %s", config)
+	}
+}
+
+func TestWriteOCIDir(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	mustBeginTestImage(t, workingDir, "v1")
+
+	layout := path.Join(tmpdir, "layout")
+	err := runACBuildNoHist(workingDir, "write", "--format=oci-dir", layout)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	checkOCILayout(t, layout, "v1")
+
+	// Writing the image with another tag adds it to the layout
+	err = runACBuildNoHist(workingDir, "set-exec", "/hello", "v2")
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "set-tag", "v2")
+	}
+	if err == nil {
+		err = runACBuildNoHist(workingDir, "write", "--format=oci-dir", layout)
+	}
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "write", "--format=oci-dir", layout)
+	if err == nil || !strings.Contains(stderr, `already has an image with ref "v2"`) {
+		t.Errorf("rewriting the v2 image didn't fail as expected: %v: %s", err, stderr)
+	}
+	err = runACBuildNoHist(workingDir, "write", "--format=oci-dir", "--overwrite", layout)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var idx ociIndex
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	var refs []string
+	for _, m := range idx.Manifests {
+		refs = append(refs, m.Annotations["org.opencontainers.image.ref.name"])
+		_, err := os.Stat(path.Join(layout, "blobs", strings.Replace(m.Digest, ":", "/", 1)))
+		if err != nil {
+			t.Errorf("manifest in the index is missing: %v", err)
+		}
+	}
+	if strings.Join(refs, ",") != "v1,v2" {
+		t.Errorf("expected refs v1 and v2 in the layout, got %v", refs)
+	}
+}
+
+func TestWriteOCIArchive(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	mustBeginTestImage(t, workingDir, "v1")
+
+	archive := path.Join(tmpdir, "image.tar")
+	err := runACBuildNoHist(workingDir, "write", "--format=oci-archive", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	files := mustReadTar(archive)
+	if _, ok := files["index.json"]; !ok {
+		t.Errorf("oci archive has no index.json, it has %d files", len(files))
+	}
+	checkBeginWritten(t, archive, "v1")
+}
+
+func TestWriteDockerArchive(t *testing.T) {
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	mustBeginTestImage(t, workingDir, "example.com/app:v1")
+
+	archive := path.Join(tmpdir, "image.tar")
+	_, id, _, err := runACBuild(workingDir, "--no-history", "write", "--format=docker-archive", archive)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	files := mustReadTar(archive)
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	err = json.Unmarshal([]byte(files["manifest.json"]), &manifest)
+	if err != nil {
+		t.Fatalf("error reading manifest.json: %v", err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("expected 1 image in manifest.json, got %d", len(manifest))
+	}
+	img := manifest[0]
+	if len(img.RepoTags) != 1 || img.RepoTags[0] != "example.com/app:v1" {
+		t.Errorf("unexpected repo tags %v", img.RepoTags)
+	}
+	if want := strings.TrimPrefix(strings.TrimSpace(id), "sha256:") + ".json"; img.Config != want {
+		t.Errorf("expected the config at %s, got %s", want, img.Config)
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	err = json.Unmarshal([]byte(files[img.Config]), &config)
+	if err != nil {
+		t.Fatalf("error reading image config: %v", err)
+	}
+	if len(img.Layers) == 0 || len(img.Layers) != len(config.RootFS.DiffIDs) {
+		t.Fatalf("expected a layer for each of the diffIDs %v, got %v", config.RootFS.DiffIDs, img.Layers)
+	}
+	for i, l := range img.Layers {
+		// docker expects plain tar layers, whose digests are their diffIDs
+		if d := testDigest([]byte(files[l])); d != config.RootFS.DiffIDs[i] {
+			t.Errorf("layer %s has digest %s, expected %s", l, d, config.RootFS.DiffIDs[i])
+		}
+	}
+
+	checkBeginWritten(t, archive, "v1")
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"xi2.org/x/xz"
+)
+
+// Compression is a format ACIs and OCI layers can be compressed in.
+type Compression string
+
+const (
+	CompressionGzip = Compression("gzip")
+	CompressionZstd = Compression("zstd")
+	CompressionXz   = Compression("xz")
+	CompressionNone = Compression("none")
+)
+
+// DefaultCompressionLevel stands for the default level of each compression.
+const DefaultCompressionLevel = -1
+
+// compressionLevels holds the lowest and highest level of each compression.
+var compressionLevels = map[Compression][2]int{
+	CompressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	CompressionZstd: {1, 19},
+	CompressionXz:   {0, 9},
+}
+
+// The magic numbers zstd and xz compressed files begin with.
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// ParseCompression returns the compression named s, which is gzip if s is
+// empty.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(s); c {
+	case "":
+		return CompressionGzip, nil
+	case CompressionGzip, CompressionZstd, CompressionXz, CompressionNone:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected one of gzip, zstd, xz, none", s)
+}
+
+// CheckLevel returns an error if level isn't a level of c.
+func (c Compression) CheckLevel(level int) error {
+	if level == DefaultCompressionLevel {
+		return nil
+	}
+	levels, ok := compressionLevels[c]
+	if !ok {
+		return fmt.Errorf("%s compression has no levels", c)
+	}
+	if level < levels[0] || level > levels[1] {
+		return fmt.Errorf("invalid %s compression level %d, expected %d to %d", c, level, levels[0], levels[1])
+	}
+	return nil
+}
+
+// NewCompressWriter returns a writer compressing what's written to it with c
+// at the given level to w. It must be closed to flush the compressed data out.
+// xz and zstd compression is done by their command line tools, which must be
+// installed.
+func NewCompressWriter(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	err := c.CheckLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if level != DefaultCompressionLevel {
+		args = append(args, "-"+strconv.Itoa(level))
+	}
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, level)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionXz:
+		return newCommandWriter(w, "xz", append(args, "--compress", "--stdout")...)
+	case CompressionZstd:
+		return newCommandWriter(w, "zstd", append(args, "--quiet", "--stdout")...)
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// NewDecompressReader returns a reader of the decompressed contents of rs,
+// which may be compressed with gzip, bzip2, xz or zstd, or not at all. zstd is
+// decompressed by its command line tool, which must be installed.
+func NewDecompressReader(rs io.ReadSeeker) (io.ReadCloser, error) {
+	_, err := rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(rs)
+	magic, _ := br.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return newCommandReader(br, "zstd", "--decompress", "--quiet", "--stdout")
+	case bytes.HasPrefix(magic, xzMagic):
+		// The xz reader aci has shells out to xz, this one doesn't
+		xr, err := xz.NewReader(br, 0)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}
+	return aci.NewCompressedReader(rs)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// commandWriter pipes what's written to it through a command.
+type commandWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func newCommandWriter(w io.Writer, name string, args ...string) (*commandWriter, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s compression needs the %s command: %v", name, name, err)
+	}
+	cw := &commandWriter{
+		cmd:    exec.Command(bin, args...),
+		stderr: &bytes.Buffer{},
+	}
+	cw.cmd.Stdout = w
+	cw.cmd.Stderr = cw.stderr
+	cw.WriteCloser, err = cw.cmd.StdinPipe()
+	if err == nil {
+		err = cw.cmd.Start()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Close waits for the command to write out the rest of its output.
+func (cw *commandWriter) Close() error {
+	err := cw.WriteCloser.Close()
+	if err1 := cw.cmd.Wait(); err1 != nil {
+		err = fmt.Errorf("%s failed: %v: %s", cw.cmd.Args[0], err1, strings.TrimSpace(cw.stderr.String()))
+	}
+	return err
+}
+
+// commandReader reads the output of a command.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func newCommandReader(r io.Reader, name string, args ...string) (*commandReader, error) {
+	bin, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s decompression needs the %s command: %v", name, name, err)
+	}
+	cr := &commandReader{
+		cmd:    exec.Command(bin, args...),
+		stderr: &bytes.Buffer{},
+	}
+	cr.cmd.Stdin = r
+	cr.cmd.Stderr = cr.stderr
+	cr.ReadCloser, err = cr.cmd.StdoutPipe()
+	if err == nil {
+		err = cr.cmd.Start()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Read returns the command's error along with the end of its output, so
+// corrupt input isn't mistaken for a short one.
+func (cr *commandReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	if err == io.EOF {
+		if err1 := cr.wait(); err1 != nil {
+			err = err1
+		}
+	}
+	return n, err
+}
+
+func (cr *commandReader) wait() error {
+	if cr.cmd.ProcessState != nil {
+		if !cr.cmd.ProcessState.Success() {
+			return fmt.Errorf("%s failed: %s", cr.cmd.Args[0], strings.TrimSpace(cr.stderr.String()))
+		}
+		return nil
+	}
+	err := cr.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", cr.cmd.Args[0], err, strings.TrimSpace(cr.stderr.String()))
+	}
+	return nil
+}
+
+// Close stops the command if it's still running.
+func (cr *commandReader) Close() error {
+	if cr.cmd.ProcessState == nil {
+		cr.cmd.Process.Kill()
+		cr.cmd.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	// Uncompressed images are only recognized by being tar files
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := []byte(strings.Repeat("acbuild compression test\n", 100))
+	err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(data))})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd, CompressionXz, CompressionNone} {
+		for _, level := range []int{DefaultCompressionLevel, 1} {
+			if c == CompressionNone && level != DefaultCompressionLevel {
+				continue
+			}
+			if c == CompressionZstd || c == CompressionXz {
+				if _, err := exec.LookPath(string(c)); err != nil {
+					t.Logf("skipping %s, it isn't installed", c)
+					continue
+				}
+			}
+
+			f, err := ioutil.TempFile("", "acbuild-compress")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			cw, err := NewCompressWriter(f, c, level)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			_, err = cw.Write(content)
+			if err == nil {
+				err = cw.Close()
+			}
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+
+			dr, err := NewDecompressReader(f)
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			got, err := ioutil.ReadAll(dr)
+			dr.Close()
+			if err != nil {
+				t.Fatalf("%s level %d: %v", c, level, err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("%s level %d: decompressed contents differ", c, level)
+			}
+		}
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	tests := []struct {
+		c     Compression
+		level int
+		valid bool
+	}{
+		{CompressionGzip, DefaultCompressionLevel, true},
+		{CompressionGzip, 9, true},
+		{CompressionGzip, 0, false},
+		{CompressionZstd, 19, true},
+		{CompressionZstd, 20, false},
+		{CompressionXz, 0, true},
+		{CompressionNone, DefaultCompressionLevel, true},
+		{CompressionNone, 1, false},
+	}
+	for _, tt := range tests {
+		err := tt.c.CheckLevel(tt.level)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s level %d: expected valid to be %v, got error %v", tt.c, tt.level, tt.valid, err)
+		}
+	}
+
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Errorf("expected an error for an unknown compression")
+	}
+	if c, err := ParseCompression(""); err != nil || c != CompressionGzip {
+		t.Errorf("expected gzip for no compression, got %q, %v", c, err)
+	}
+}
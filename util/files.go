@@ -20,8 +20,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
-	"github.com/appc/spec/aci"
 	rkttar "github.com/coreos/rkt/pkg/tar"
 	"github.com/coreos/rkt/pkg/user"
 )
@@ -44,6 +44,60 @@ func RmAndMkdir(path string) error {
 	return nil
 }
 
+// maxSymlinks is the number of symlinks ResolveInRoot will follow before
+// giving up, matching the limit the kernel uses.
+const maxSymlinks = 40
+
+// ResolveInRoot returns the location of p inside of the directory root,
+// resolving symlinks as if root were the root directory. Absolute symlinks and
+// ".." components can't be used to escape root, which makes the result safe to
+// mount on top of or write to from the host. Trailing components of p that
+// don't exist yet are left as they are.
+func ResolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		switch {
+		case os.IsNotExist(err):
+			resolved = filepath.Join(append([]string{next}, parts...)...)
+			parts = nil
+			continue
+		case err != nil:
+			return "", err
+		case info.Mode()&os.ModeSymlink == 0:
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %q", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
 // ExtractImage will extract the contents of the image at path to the directory
 // at dst. If fileMap is set, only files in it will be extracted.
 func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
@@ -57,7 +111,7 @@ func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
 	}
 	defer file.Close()
 
-	dr, err := aci.NewCompressedReader(file)
+	dr, err := NewDecompressReader(file)
 	if err != nil {
 		return fmt.Errorf("error decompressing image: %v", err)
 	}
@@ -0,0 +1,78 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "acbuild-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	err = os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"lib":    "usr/lib",
+		"abs":    "/usr",
+		"escape": "../../../../etc",
+		"loop":   "loop",
+	}
+	for name, target := range links {
+		err = os.Symlink(target, filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"/", "/", false},
+		{"/usr/lib", "/usr/lib", false},
+		{"/lib/x", "/usr/lib/x", false},
+		{"/abs/lib", "/usr/lib", false},
+		{"/escape/passwd", "/etc/passwd", false},
+		{"/../../usr", "/usr", false},
+		{"/missing/../../x", "/x", false},
+		{"/loop", "", true},
+	}
+	for _, test := range tests {
+		out, err := ResolveInRoot(root, test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.in, err)
+			continue
+		}
+		if expected := filepath.Join(root, test.out); out != expected {
+			t.Errorf("%s: expected %s, got %s", test.in, expected, out)
+		}
+	}
+}
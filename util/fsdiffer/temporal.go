@@ -14,12 +14,22 @@
 package fsdiffer
 
 import (
+	"os"
 	"path/filepath"
+	"syscall"
 )
 
 // TemporalFSDiffer is used to generate changes in a given directory
 // between two different points in time.
 type TemporalFSDiffer struct {
+	// CheckMetadata makes Diff compare the metadata of files rather than just
+	// their size and mtime, reporting files whose mode, ownership or inode
+	// changed, or that were touched in a way only their status change time
+	// shows. Directories are only reported if their mode, ownership or inode
+	// changed, as changes to what's in them are reported for the entries
+	// themselves.
+	CheckMetadata bool
+
 	dir    string
 	before map[string]fileInfo
 }
@@ -42,7 +52,8 @@ func NewTemporalFSDiffer(dir string) (*TemporalFSDiffer, error) {
 // since Start was called.
 //
 // To detect if a file was changed it checks the file's size and mtime (like
-// rsync does by default if no --checksum options is used)
+// rsync does by default if no --checksum options is used), as well as its
+// metadata if CheckMetadata is set.
 func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	changes := FSChanges{}
 	after := make(map[string]fileInfo)
@@ -57,7 +68,13 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 		if !ok {
 			changes = append(changes, &FSChange{Path: relpath, ChangeType: Added})
 		} else {
-			if sourceInfo.Size() != afterInfo.Size() || sourceInfo.ModTime().Before(afterInfo.ModTime()) {
+			var modified bool
+			if t.CheckMetadata {
+				modified = metadataChanged(sourceInfo, afterInfo)
+			} else {
+				modified = sourceInfo.Size() != afterInfo.Size() || sourceInfo.ModTime().Before(afterInfo.ModTime())
+			}
+			if modified {
 				changes = append(changes, &FSChange{Path: relpath, ChangeType: Modified})
 			}
 		}
@@ -71,3 +88,23 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	}
 	return changes, nil
 }
+
+// metadataChanged implements the comparison for CheckMetadata.
+func metadataChanged(before, after os.FileInfo) bool {
+	if before.Mode() != after.Mode() {
+		return true
+	}
+	bst, ok1 := before.Sys().(*syscall.Stat_t)
+	ast, ok2 := after.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
+	}
+	if bst.Ino != ast.Ino || bst.Uid != ast.Uid || bst.Gid != ast.Gid {
+		return true
+	}
+	if after.IsDir() {
+		return false
+	}
+	return before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) ||
+		bst.Ctim != ast.Ctim
+}
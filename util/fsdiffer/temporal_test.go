@@ -123,3 +123,52 @@ func TestTemporalFSDiffer(t *testing.T) {
 	}
 
 }
+
+func TestTemporalFSDifferCheckMetadata(t *testing.T) {
+	time1 := time.Now()
+	dir, err := ioutil.TempDir("", tstprefix)
+	if err != nil {
+		t.Fatalf("error creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	err = buildFS(dir, []*buildFileInfo{
+		&buildFileInfo{path: "file01", typeflag: tar.TypeReg, mode: 0644, atime: time1, mtime: time1, contents: "hello"},
+		&buildFileInfo{path: "file02", typeflag: tar.TypeReg, mode: 0644, atime: time1, mtime: time1, contents: "hello"},
+		&buildFileInfo{path: "dir01", typeflag: tar.TypeDir, mode: 0755, atime: time1, mtime: time1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tm, err := NewTemporalFSDiffer(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tm.CheckMetadata = true
+
+	// Only the mode changes, and the mtime is kept
+	if err := os.Chmod(filepath.Join(dir, "file01"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Only the ctime changes
+	if err := os.Chmod(filepath.Join(dir, "file02"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Only the directory's times change
+	tmpFile := filepath.Join(dir, "dir01", "tmp")
+	if err := ioutil.WriteFile(tmpFile, nil, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.Remove(tmpFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changes, err := tm.Diff()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedChanges := FSChangesMap{"file01": Modified, "file02": Modified}
+	if changesMap := changes.ToMap(); !reflect.DeepEqual(changesMap, expectedChanges) {
+		t.Errorf("changes differs: want: %q, got: %q", printChanges(expectedChanges), printChanges(changesMap))
+	}
+}
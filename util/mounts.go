@@ -15,9 +15,11 @@
 package util
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -65,3 +67,127 @@ func MaybeUnmount(path string) error {
 	}
 	return nil
 }
+
+// UnmountAll unmounts anything mounted at or below path, most recent mount
+// first.
+func UnmountAll(path string) error {
+	mountpoints, err := MountpointsUnder(path)
+	if err != nil {
+		return err
+	}
+	for i := len(mountpoints) - 1; i >= 0; i-- {
+		err := syscall.Unmount(mountpoints[i], syscall.MNT_DETACH)
+		// If a parent was detached first, this one is gone already
+		if err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return nil
+}
+
+// MountpointsUnder returns the mountpoints at or below path, in the order
+// they were mounted in.
+func MountpointsUnder(path string) ([]string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// The mounts of the thread, which may have a mount namespace of its own,
+	// rather than of the process, on kernels that can tell them apart
+	file, err := ioutil.ReadFile("/proc/thread-self/mounts")
+	if os.IsNotExist(err) {
+		file, err = ioutil.ReadFile("/proc/mounts")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mountpoints []string
+	for _, line := range strings.Split(string(file), "\n") {
+		tokens := strings.Split(line, " ")
+		if len(tokens) < 2 {
+			continue
+		}
+		mountpoint := unescapeMountpoint(tokens[1])
+		if mountpoint == absPath || strings.HasPrefix(mountpoint, absPath+"/") {
+			mountpoints = append(mountpoints, mountpoint)
+		}
+	}
+	return mountpoints, nil
+}
+
+// BindMountReadOnly recursively bind mounts source at target, and makes every
+// mount under target read-only, not just the top one, which is all that
+// remounting a recursive bind mount read-only does.
+func BindMountReadOnly(source, target string) error {
+	err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+	mountpoints, err := MountpointsUnder(target)
+	if err != nil {
+		return err
+	}
+	for _, m := range mountpoints {
+		// The flags a mount already has must be kept, as a user namespace
+		// doesn't allow clearing them
+		var st syscall.Statfs_t
+		err := syscall.Statfs(m, &st)
+		if err != nil {
+			return err
+		}
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | statfsMountFlags(int64(st.Flags))
+		err = syscall.Mount("", m, "", flags, "")
+		if err != nil {
+			return fmt.Errorf("couldn't remount %s read-only: %v", m, err)
+		}
+	}
+	return nil
+}
+
+// statfsMountFlags returns the mount flags matching the flags statfs returns.
+func statfsMountFlags(stFlags int64) uintptr {
+	var flags uintptr
+	for st, ms := range map[int64]uintptr{
+		stNosuid:     syscall.MS_NOSUID,
+		stNodev:      syscall.MS_NODEV,
+		stNoexec:     syscall.MS_NOEXEC,
+		stNoatime:    syscall.MS_NOATIME,
+		stNodiratime: syscall.MS_NODIRATIME,
+		stRelatime:   syscall.MS_RELATIME,
+	} {
+		if stFlags&st != 0 {
+			flags |= ms
+		}
+	}
+	return flags
+}
+
+// The flags statfs returns, which the syscall package doesn't have.
+const (
+	stNosuid     = 0x2
+	stNodev      = 0x4
+	stNoexec     = 0x8
+	stNoatime    = 0x400
+	stNodiratime = 0x800
+	stRelatime   = 0x1000
+)
+
+// unescapeMountpoint undoes the octal escaping of whitespace and backslashes
+// in /proc/mounts.
+func unescapeMountpoint(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
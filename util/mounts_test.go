@@ -0,0 +1,84 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestBindMountReadOnly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; mounting needs root")
+	}
+	tmpDir, err := ioutil.TempDir("", "acbuild-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The mounts are made in a mount namespace of their own, on a thread
+	// that's thrown away along with it
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		errCh <- testBindMountReadOnly(tmpDir)
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBindMountReadOnly(tmpDir string) error {
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+
+	source := filepath.Join(tmpDir, "source")
+	target := filepath.Join(tmpDir, "target")
+	for _, dir := range []string{filepath.Join(source, "sub"), target} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscall.Mount("tmpfs", filepath.Join(source, "sub"), "tmpfs", syscall.MS_NOSUID, "")
+	if err != nil {
+		return err
+	}
+
+	err = BindMountReadOnly(source, target)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{target, filepath.Join(target, "sub")} {
+		err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644)
+		if err == nil {
+			return fmt.Errorf("%s is writable", dir)
+		}
+	}
+	// The source stays writable
+	return ioutil.WriteFile(filepath.Join(source, "sub", "file"), nil, 0644)
+}
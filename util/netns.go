@@ -0,0 +1,73 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// UnshareNetwork moves the calling thread into a new network namespace with
+// only a loopback interface, which is brought up. Processes started from the
+// thread afterwards inherit the namespace.
+//
+// The caller must have locked the goroutine to its thread with
+// runtime.LockOSThread, and must never unlock it, so that the thread is thrown
+// away once the goroutine exits instead of being reused by other goroutines.
+func UnshareNetwork() error {
+	err := syscall.Unshare(syscall.CLONE_NEWNET)
+	if err != nil {
+		return fmt.Errorf("couldn't create network namespace: %v", err)
+	}
+	err = setLinkUp("lo")
+	if err != nil {
+		return fmt.Errorf("couldn't bring up loopback interface: %v", err)
+	}
+	return nil
+}
+
+// ifreqFlags is struct ifreq from <net/if.h>, as used by the SIOCGIFFLAGS and
+// SIOCSIFFLAGS ioctls.
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+func setLinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr ifreqFlags
+	copy(ifr.Name[:], name)
+	err = ioctl(fd, syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if err != nil {
+		return err
+	}
+	ifr.Flags |= syscall.IFF_UP
+	return ioctl(fd, syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+}
+
+func ioctl(fd int, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -44,16 +44,22 @@ func OCIExtractLayers(layerIDs []string, imageLoc, blobsDest string) error {
 		_, err = os.Stat(to)
 		if err == nil {
 			// This has already been extracted
-			break
+			continue
 		}
 
-		err = os.MkdirAll(path.Join(blobsDest, algo), 0755)
+		err = os.MkdirAll(to, 0755)
 		if err != nil {
 			return err
 		}
 
 		err = ExtractImage(from, to, nil)
+		if err == nil {
+			err = ConvertOCIWhiteouts(to)
+		}
 		if err != nil {
+			// Don't leave a partial layer behind to be mistaken for an
+			// extracted one
+			os.RemoveAll(to)
 			return err
 		}
 	}
@@ -62,9 +68,10 @@ func OCIExtractLayers(layerIDs []string, imageLoc, blobsDest string) error {
 
 func OCINewExpandedLayer(ociExpandedBlobsPath string) (string, error) {
 	targetPath := path.Join(ociExpandedBlobsPath, "sha256", "new-layer")
-	_, err := os.Stat(targetPath)
-	if os.IsNotExist(err) {
-		os.RemoveAll(targetPath)
+	// Leftovers of an earlier step that failed don't belong in the layer
+	err := os.RemoveAll(targetPath)
+	if err != nil {
+		return "", err
 	}
 	err = os.MkdirAll(targetPath, 0755)
 	if err != nil {
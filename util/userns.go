@@ -0,0 +1,110 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ErrNoSubordinateIDs is returned by SubordinateIDs when the given user has no
+// range assigned to it.
+var ErrNoSubordinateIDs = fmt.Errorf("no subordinate ID range found")
+
+// IDRange is a contiguous range of subordinate user or group IDs, as listed in
+// /etc/subuid and /etc/subgid.
+type IDRange struct {
+	Start uint32
+	Count uint32
+}
+
+// SubordinateIDs returns the first subordinate ID range in the file at path
+// (/etc/subuid or /etc/subgid) belonging to the user with the given name or
+// numeric ID.
+func SubordinateIDs(path, name string, id int) (IDRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return IDRange{}, ErrNoSubordinateIDs
+		}
+		return IDRange{}, err
+	}
+	defer f.Close()
+	return parseSubordinateIDs(f, name, id)
+}
+
+func parseSubordinateIDs(r io.Reader, name string, id int) (IDRange, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ":")
+		if len(tokens) != 3 {
+			continue
+		}
+		if tokens[0] != name && tokens[0] != strconv.Itoa(id) {
+			continue
+		}
+		start, err := strconv.ParseUint(tokens[1], 10, 32)
+		if err != nil {
+			return IDRange{}, fmt.Errorf("couldn't parse subordinate ID range %q: %v", line, err)
+		}
+		count, err := strconv.ParseUint(tokens[2], 10, 32)
+		if err != nil {
+			return IDRange{}, fmt.Errorf("couldn't parse subordinate ID range %q: %v", line, err)
+		}
+		if count == 0 {
+			continue
+		}
+		return IDRange{uint32(start), uint32(count)}, nil
+	}
+	if err := s.Err(); err != nil {
+		return IDRange{}, err
+	}
+	return IDRange{}, ErrNoSubordinateIDs
+}
+
+// WriteIDMap maps ID 0 inside the user namespace of process pid to hostID, and
+// IDs 1 and up to the subordinate range sub. helper is the setuid binary used
+// to write the map, either newuidmap or newgidmap.
+func WriteIDMap(helper string, pid int, hostID int, sub IDRange) error {
+	out, err := exec.Command(helper, strconv.Itoa(pid),
+		"0", strconv.Itoa(hostID), "1",
+		"1", strconv.FormatUint(uint64(sub.Start), 10), strconv.FormatUint(uint64(sub.Count), 10),
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", helper, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// InUserNamespace returns whether the current process is running inside of a
+// user namespace other than the initial one.
+func InUserNamespace() bool {
+	blob, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(blob))
+	return len(fields) != 3 || fields[0] != "0" || fields[1] != "0" || fields[2] != "4294967295"
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSubordinateIDs(t *testing.T) {
+	const subuid = `# comment
+alice:100000:65536
+
+1001:165536:65536
+carol:231072:0
+carol:296608:1000
+`
+	type testcase struct {
+		name string
+		id   int
+		out  IDRange
+		err  error
+	}
+	cases := []testcase{
+		testcase{"alice", 1000, IDRange{100000, 65536}, nil},
+		testcase{"bob", 1001, IDRange{165536, 65536}, nil},
+		testcase{"carol", 1002, IDRange{296608, 1000}, nil},
+		testcase{"dave", 1003, IDRange{}, ErrNoSubordinateIDs},
+	}
+	for _, c := range cases {
+		out, err := parseSubordinateIDs(strings.NewReader(subuid), c.name, c.id)
+		if err != c.err {
+			t.Errorf("%s: unexpected error, expected: %v actual: %v", c.name, c.err, err)
+		}
+		if out != c.out {
+			t.Errorf("%s: unexpected range, expected: %v actual: %v", c.name, c.out, out)
+		}
+	}
+}
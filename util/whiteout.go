@@ -0,0 +1,182 @@
+// Copyright 2017 The acbuild Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Deletions in an OCI layer are recorded as empty files named after what was
+// deleted with OCIWhiteoutPrefix in front. A directory containing an
+// OCIOpaqueWhiteout file hides everything the layers below have in it. See
+// https://github.com/opencontainers/image-spec/blob/master/layer.md#whiteouts
+//
+// Overlayfs records the same things as character devices with device number
+// 0/0 and directories with the opaque xattr set, and an expanded OCI layer
+// uses those, so that it can be mounted as is.
+const (
+	OCIWhiteoutPrefix = ".wh."
+	OCIOpaqueWhiteout = ".wh..wh..opq"
+)
+
+// overlayXattr returns the name of the overlayfs xattr with the given name.
+// Overlayfs is mounted with the userxattr option in a user namespace, as
+// trusted.* xattrs can't be set there.
+func overlayXattr(name string) string {
+	if InUserNamespace() {
+		return "user.overlay." + name
+	}
+	return "trusted.overlay." + name
+}
+
+// IsOverlayWhiteout returns whether the file with the given info is an
+// overlayfs whiteout.
+func IsOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// opaqueXattrs are the xattrs that mark a directory as opaque, as set by
+// overlayfs inside and outside of a user namespace, and by fuse-overlayfs when
+// it can't set trusted.* xattrs.
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque", "user.fuseoverlayfs.opaque"}
+
+// IsOverlayOpaque returns whether the directory at dir is marked by overlayfs
+// as hiding what the layers below have in it.
+func IsOverlayOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range opaqueXattrs {
+		n, err := syscall.Getxattr(dir, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeOverlayWhiteout creates an overlayfs whiteout at p.
+func MakeOverlayWhiteout(p string) error {
+	return syscall.Mknod(p, syscall.S_IFCHR, 0)
+}
+
+// SetOverlayOpaque marks the directory at dir as hiding what the layers below
+// have in it.
+func SetOverlayOpaque(dir string) error {
+	return syscall.Setxattr(dir, overlayXattr("opaque"), []byte("y"), 0)
+}
+
+// ClearOverlayOpaque removes the marks SetOverlayOpaque and overlayfs set on
+// the directory at dir.
+func ClearOverlayOpaque(dir string) error {
+	for _, attr := range opaqueXattrs {
+		err := syscall.Removexattr(dir, attr)
+		if err != nil && err != syscall.ENODATA {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertOCIWhiteouts replaces the OCI whiteout files in the extracted OCI
+// layer at dir with overlayfs whiteouts. Creating those needs root, so the
+// layer is left as it is otherwise, which keeps the whiteouts in it when it's
+// written out again.
+func ConvertOCIWhiteouts(dir string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	var whiteouts []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), OCIWhiteoutPrefix) && !info.IsDir() {
+			whiteouts = append(whiteouts, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range whiteouts {
+		err := os.Remove(p)
+		if err != nil {
+			return err
+		}
+		parent, name := path.Split(p)
+		if name == OCIOpaqueWhiteout {
+			err = SetOverlayOpaque(parent)
+		} else {
+			target := path.Join(parent, strings.TrimPrefix(name, OCIWhiteoutPrefix))
+			err = os.RemoveAll(target)
+			if err != nil {
+				return err
+			}
+			err = MakeOverlayWhiteout(target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OCILayerWalker is like PathWalker, but for an expanded OCI layer: its
+// overlayfs whiteouts are written to the tarball as OCI whiteout files.
+func OCILayerWalker(twriter *tar.Writer, tarSrcPath string) filepath.WalkFunc {
+	walker := PathWalker(twriter, tarSrcPath)
+	prefixLen := len(tarSrcPath + "/")
+	return func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == tarSrcPath {
+			return nil
+		}
+		hdrName := p[prefixLen:]
+
+		if IsOverlayWhiteout(info) {
+			dir, name := path.Split(hdrName)
+			return writeOCIWhiteout(twriter, dir+OCIWhiteoutPrefix+name, info)
+		}
+		err = walker(p, info, nil)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && IsOverlayOpaque(p) {
+			// Right after the directory, so it comes before what's in it
+			return writeOCIWhiteout(twriter, path.Join(hdrName, OCIOpaqueWhiteout), info)
+		}
+		return nil
+	}
+}
+
+func writeOCIWhiteout(twriter *tar.Writer, name string, info os.FileInfo) error {
+	return twriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+	})
+}